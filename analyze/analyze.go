@@ -0,0 +1,449 @@
+// Package analyze finds likely mistakes within the conditions of logical blocks,
+// such as contradictions and statements which can never run.
+// None of these prevent a project from compiling, so they are reported
+// back to the author as diagnostics rather than errors.
+package analyze
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/decompile"
+	"github.com/talkative-ai/lakshmi/evaluate"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// Diagnostic is a likely mistake within the logic of a dialog node
+type Diagnostic struct {
+	DialogNodeID uuid.UUID
+	// Statements is the index of the []LStatement within the logical block,
+	// and Statement is the index of the statement within it
+	Statements int
+	Statement  int
+	Message    string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("dialog node %v: statements %v: statement %v: %v", d.DialogNodeID.String(), d.Statements, d.Statement, d.Message)
+}
+
+// Project analyzes every dialog node within the project rows
+// The rows repeat dialog nodes, but each node is only analyzed once.
+// Diagnostics are ordered by dialog node ID and then by statement.
+func Project(items []prepare.ProjectItem) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	analyzed := map[uuid.UUID]bool{}
+	for _, item := range items {
+		if analyzed[item.DialogID] {
+			continue
+		}
+		analyzed[item.DialogID] = true
+		for _, d := range RawLBlock(&item.RawLBlock) {
+			d.DialogNodeID = item.DialogID
+			diagnostics = append(diagnostics, d)
+		}
+	}
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		a, b := diagnostics[i], diagnostics[j]
+		if a.DialogNodeID != b.DialogNodeID {
+			return a.DialogNodeID.String() < b.DialogNodeID.String()
+		}
+		if a.Statements != b.Statements {
+			return a.Statements < b.Statements
+		}
+		return a.Statement < b.Statement
+	})
+	return diagnostics
+}
+
+// RawLBlock analyzes a logical block before its actions are bundled
+// The DialogNodeID of the diagnostics is left for the caller to fill.
+func RawLBlock(raw *prepare.RawLBlock) []Diagnostic {
+	if raw.Statements == nil {
+		return nil
+	}
+	return analyzeGroups(*raw.Statements)
+}
+
+// LBlock analyzes a logical block after its actions are bundled
+// The DialogNodeID of the diagnostics is left for the caller to fill.
+func LBlock(lblock *models.LBlock) []Diagnostic {
+	if lblock.Statements == nil {
+		return nil
+	}
+	// Bundled statements have no Condition, so only their OrGroups are conditions
+	groups := make([][]prepare.RawLStatement, len(*lblock.Statements))
+	for i, statements := range *lblock.Statements {
+		groups[i] = make([]prepare.RawLStatement, len(statements))
+		for j, stmt := range statements {
+			groups[i][j] = prepare.RawLStatement{Operators: stmt.Operators}
+		}
+	}
+	return analyzeGroups(groups)
+}
+
+// analyzeGroups checks the conditions of each []Statement group in turn
+// Within a group only the first true statement runs, so a statement can never run when
+// its condition is always false, or whenever an earlier condition is true as well.
+// Within a random group the order doesn't matter, so only the conditions themselves are checked.
+func analyzeGroups(groups [][]prepare.RawLStatement) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	for i, group := range groups {
+		report := func(j int, format string, args ...interface{}) {
+			diagnostics = append(diagnostics, Diagnostic{Statements: i, Statement: j, Message: fmt.Sprintf(format, args...)})
+		}
+
+		conditions := make([]helpers.Expr, len(group))
+		randoms := make([]*helpers.Random, len(group))
+		compiles := true
+		for j, stmt := range group {
+			condition, random, err := helpers.StatementCondition(stmt)
+			if err == nil {
+				// Compiling the condition alone checks its values, such as regex patterns
+				_, err = helpers.CompileBlock(&helpers.Block{Statements: [][]helpers.Statement{{{Condition: condition}}}})
+			}
+			if err != nil {
+				report(j, "condition does not compile: %v", err)
+				compiles = false
+				continue
+			}
+			conditions[j], randoms[j] = condition, random
+		}
+		// The publish will fail anyway, and the rest would only add noise
+		if !compiles {
+			continue
+		}
+		kind, _, err := helpers.CheckRandomGroup(randoms)
+		if err != nil {
+			report(0, "%v", err)
+			continue
+		}
+		isRandom := kind != helpers.GroupKindFirst
+
+		// The conditions of the earlier statements which may run
+		type prior struct {
+			index     int
+			condition helpers.Expr
+		}
+		earlier := []prior{}
+		alwaysRuns := -1
+
+		for j, condition := range conditions {
+			if alwaysRuns >= 0 {
+				report(j, "can never run, as statement %v before it always runs", alwaysRuns)
+				continue
+			}
+			if condition == nil {
+				if !isRandom {
+					alwaysRuns = j
+				}
+				continue
+			}
+
+			folded, known, value := helpers.FoldExpr(condition)
+			if known {
+				if !value {
+					report(j, "can never run, as its condition is always false")
+					continue
+				}
+				report(j, "condition is always true")
+				if !isRandom {
+					alwaysRuns = j
+				}
+				continue
+			}
+
+			if conflict, ok := unsatisfiable(folded); ok {
+				report(j, "can never run, as its conditions contradict: %v", conflict)
+				continue
+			}
+			for _, conflict := range contradictions(folded) {
+				report(j, "conditions contradict: %v", conflict)
+			}
+			if isRandom {
+				continue
+			}
+
+			for _, p := range earlier {
+				if implies(folded, p.condition) {
+					report(j, "can never run, as statement %v before it is true whenever it is", p.index)
+					break
+				}
+			}
+			earlier = append(earlier, prior{j, folded})
+		}
+	}
+	return diagnostics
+}
+
+// unsatisfiable reports whether an expression can never be true,
+// along with the contradiction which makes it so
+func unsatisfiable(expr helpers.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case helpers.ExprOr:
+		conflicts := []string{}
+		for _, child := range e {
+			conflict, ok := unsatisfiable(child)
+			if !ok {
+				return "", false
+			}
+			conflicts = append(conflicts, conflict)
+		}
+		return strings.Join(conflicts, ", and "), true
+	case helpers.ExprAnd:
+		if conflict, ok := contradicts(e); ok {
+			return conflict, true
+		}
+		for _, child := range e {
+			if conflict, ok := unsatisfiable(child); ok {
+				return conflict, true
+			}
+		}
+	}
+	return "", false
+}
+
+// contradictions finds every "and" within an expression whose comparisons contradict
+func contradictions(expr helpers.Expr) []string {
+	conflicts := []string{}
+	switch e := expr.(type) {
+	case helpers.ExprAnd:
+		if conflict, ok := contradicts(e); ok {
+			conflicts = append(conflicts, conflict)
+		}
+		for _, child := range e {
+			conflicts = append(conflicts, contradictions(child)...)
+		}
+	case helpers.ExprOr:
+		for _, child := range e {
+			conflicts = append(conflicts, contradictions(child)...)
+		}
+	case helpers.ExprNot:
+		conflicts = append(conflicts, contradictions(e.Expr)...)
+	}
+	return conflicts
+}
+
+// contradicts checks whether the comparisons within an "and" can all be true together
+// Only comparisons against literal values are considered.
+func contradicts(and helpers.ExprAnd) (string, bool) {
+	byVar := map[uint64][]helpers.ExprCompare{}
+	vars := []uint64{}
+	for _, expr := range and {
+		cmp, ok := expr.(helpers.ExprCompare)
+		if !ok || !isLiteral(cmp.Value) {
+			continue
+		}
+		if _, ok := byVar[cmp.Var]; !ok {
+			vars = append(vars, cmp.Var)
+		}
+		byVar[cmp.Var] = append(byVar[cmp.Var], cmp)
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i] < vars[j] })
+
+	for _, vr := range vars {
+		cmps := byVar[vr]
+		if len(cmps) < 2 || satisfiable(cmps) {
+			continue
+		}
+		dumped := make([]string, len(cmps))
+		for idx, cmp := range cmps {
+			dumped[idx] = decompile.DumpExpr(cmp)
+		}
+		return strings.Join(dumped, " && "), true
+	}
+	return "", false
+}
+
+// satisfiable checks whether a variable could satisfy every comparison at once
+func satisfiable(cmps []helpers.ExprCompare) bool {
+	// When the variable must equal one of a few values, try each of them
+	for _, cmp := range cmps {
+		var candidates []interface{}
+		switch cmp.Operator {
+		case "eq":
+			candidates = []interface{}{cmp.Value}
+		case "in":
+			candidates, _ = cmp.Value.([]interface{})
+		default:
+			continue
+		}
+		for _, candidate := range candidates {
+			if satisfies(candidate, cmps) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Otherwise check that the numeric bounds leave some room
+	var lower, upper *helpers.ExprCompare
+	for idx, cmp := range cmps {
+		n, ok := number(cmp.Value)
+		if !ok {
+			continue
+		}
+		switch cmp.Operator {
+		case "gt", "gte":
+			if lower == nil || tighter(cmp, *lower, n) {
+				lower = &cmps[idx]
+			}
+		case "lt", "lte":
+			if upper == nil || tighter(cmp, *upper, n) {
+				upper = &cmps[idx]
+			}
+		}
+	}
+	if lower == nil || upper == nil {
+		return true
+	}
+	lo, _ := number(lower.Value)
+	hi, _ := number(upper.Value)
+	if lo == hi {
+		return lower.Operator == "gte" && upper.Operator == "lte"
+	}
+	return lo < hi
+}
+
+// tighter reports whether a bound with the value n is tighter than the current bound
+func tighter(cmp, current helpers.ExprCompare, n float64) bool {
+	c, _ := number(current.Value)
+	switch {
+	case n == c:
+		return cmp.Operator == "gt" || cmp.Operator == "lt"
+	case cmp.Operator == "gt" || cmp.Operator == "gte":
+		return n > c
+	}
+	return n < c
+}
+
+// satisfies checks a value against every comparison, exactly as the runtime would
+func satisfies(val interface{}, cmps []helpers.ExprCompare) bool {
+	for _, cmp := range cmps {
+		if !evaluate.Compare(cmp.Operator, val, cmp.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// implies reports whether the earlier condition is true whenever the later one is,
+// in which case the later statement can never run.
+// This holds when every "or" branch of the later condition
+// contains every comparison of some "or" branch of the earlier condition,
+// or a comparison which is stricter than it.
+func implies(later, earlier helpers.Expr) bool {
+	for _, l := range disjuncts(later) {
+		covered := false
+		for _, e := range disjuncts(earlier) {
+			if conjunctsImply(conjuncts(l), conjuncts(e)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+func conjunctsImply(later, earlier []helpers.Expr) bool {
+	for _, e := range earlier {
+		implied := false
+		for _, l := range later {
+			if leafImplies(l, e) {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			return false
+		}
+	}
+	return true
+}
+
+// leafImplies reports whether b is true whenever a is
+func leafImplies(a, b helpers.Expr) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	ca, ok := a.(helpers.ExprCompare)
+	if !ok || !isLiteral(ca.Value) {
+		return false
+	}
+	cb, ok := b.(helpers.ExprCompare)
+	if !ok || !isLiteral(cb.Value) || ca.Var != cb.Var {
+		return false
+	}
+
+	switch ca.Operator {
+	case "eq":
+		return evaluate.Compare(cb.Operator, ca.Value, cb.Value)
+	case "in":
+		list, _ := ca.Value.([]interface{})
+		for _, item := range list {
+			if !evaluate.Compare(cb.Operator, item, cb.Value) {
+				return false
+			}
+		}
+		return len(list) > 0
+	}
+
+	x, ok := number(ca.Value)
+	if !ok {
+		return false
+	}
+	y, ok := number(cb.Value)
+	if !ok {
+		return false
+	}
+	lowerA, lowerB := ca.Operator == "gt" || ca.Operator == "gte", cb.Operator == "gt" || cb.Operator == "gte"
+	upperA, upperB := ca.Operator == "lt" || ca.Operator == "lte", cb.Operator == "lt" || cb.Operator == "lte"
+	switch {
+	case lowerA && lowerB:
+		return x > y || (x == y && (ca.Operator == "gt" || cb.Operator == "gte"))
+	case upperA && upperB:
+		return x < y || (x == y && (ca.Operator == "lt" || cb.Operator == "lte"))
+	}
+	return false
+}
+
+func disjuncts(expr helpers.Expr) []helpers.Expr {
+	if or, ok := expr.(helpers.ExprOr); ok {
+		return or
+	}
+	return []helpers.Expr{expr}
+}
+
+func conjuncts(expr helpers.Expr) []helpers.Expr {
+	if and, ok := expr.(helpers.ExprAnd); ok {
+		return and
+	}
+	return []helpers.Expr{expr}
+}
+
+// isLiteral reports whether a comparison value is known when compiling
+func isLiteral(val interface{}) bool {
+	switch val.(type) {
+	case helpers.VarRef, helpers.Calc:
+		return false
+	}
+	return true
+}
+
+func number(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,85 @@
+package analyze
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+func TestLBlock(t *testing.T) {
+	lblock := models.LBlock{
+		AlwaysExec: "bundle:0",
+		Statements: &[][]models.LStatement{
+			{
+				// 0: x can't be both 1 and not 1
+				{Operators: &models.OrGroup{{"eq": {1: 1.0}, "ne": {1: 1.0}}}, Exec: "bundle:1"},
+				// 1: one branch contradicts, but the other may be true
+				{Operators: &models.OrGroup{{"gt": {2: 10.0}, "lt": {2: 5.0}}, {"eq": {3: "a"}}}, Exec: "bundle:2"},
+				// 2: fine
+				{Operators: &models.OrGroup{{"gt": {4: 5.0}}}, Exec: "bundle:3"},
+				// 3: shadowed by 2, as #4 > 10 implies #4 > 5
+				{Operators: &models.OrGroup{{"gt": {4: 10.0}, "eq": {5: true}}}, Exec: "bundle:4"},
+				// 4: shadowed by 1
+				{Operators: &models.OrGroup{{"eq": {3: "a"}}}, Exec: "bundle:5"},
+				// 5: always false
+				{Operators: &models.OrGroup{{"in": {6: []interface{}{}}}}, Exec: "bundle:6"},
+				// 6: an else
+				{Exec: "bundle:7"},
+				// 7: after the else
+				{Operators: &models.OrGroup{{"eq": {7: 1.0}}}, Exec: "bundle:8"},
+			},
+			{
+				// 0: #8 can be 3, within both the list and the bounds
+				{Operators: &models.OrGroup{{"in": {8: []interface{}{1.0, 3.0}}, "gte": {8: 2.0}, "lte": {8: 3.0}}}, Exec: "bundle:9"},
+				// 1: #8 < 2 is not implied by #8 <= 3
+				{Operators: &models.OrGroup{{"lt": {8: 2.0}}}, Exec: "bundle:10"},
+				// 2: the upper and lower bounds meet, but neither includes 5
+				{Operators: &models.OrGroup{{"gte": {9: 5.0}, "lt": {9: 5.0}}}, Exec: "bundle:11"},
+			},
+		},
+	}
+
+	diagnostics := LBlock(&lblock)
+	expected := [][2]int{{0, 0}, {0, 1}, {0, 3}, {0, 4}, {0, 5}, {0, 7}, {1, 2}}
+	found := [][2]int{}
+	for _, d := range diagnostics {
+		found = append(found, [2]int{d.Statements, d.Statement})
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected diagnostics at %v, got %v", expected, diagnostics)
+	}
+
+	expectedMessages := map[[2]int]string{
+		{0, 0}: "can never run, as its conditions contradict: #1 eq 1 && #1 ne 1",
+		{0, 3}: "can never run, as statement 2 before it is true whenever it is",
+		{0, 7}: "can never run, as statement 6 before it always runs",
+	}
+	for _, d := range diagnostics {
+		if message, ok := expectedMessages[[2]int{d.Statements, d.Statement}]; ok && message != d.Message {
+			t.Errorf("expected %q, got %q", message, d.Message)
+		}
+	}
+}
+
+func TestRawLBlock(t *testing.T) {
+	raw := prepare.RawLBlock{
+		Statements: &[][]prepare.RawLStatement{
+			{
+				{Exec: prepare.ActionSet{}},
+				{Operators: &models.OrGroup{{"eq": {1: "a"}}}},
+			},
+			{
+				{Operators: &models.OrGroup{{"regex": {1: "("}}}},
+			},
+		},
+	}
+	diagnostics := RawLBlock(&raw)
+	if len(diagnostics) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %v", diagnostics)
+	}
+	if diagnostics[1].Statements != 1 || diagnostics[1].Statement != 0 {
+		t.Errorf("expected the invalid regex to be reported, got %v", diagnostics[1])
+	}
+}
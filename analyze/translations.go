@@ -0,0 +1,119 @@
+package analyze
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// Translations reports what is missing its translation into each locale of a project,
+// of which the first is the default. Missing translations fall back to the default locale,
+// so, like the other diagnostics, they never fail a publish.
+// Entry inputs are reported with a Statements and Statement index of -1, as are play sounds within AlwaysExec.
+// Only text is expected to be translated, as audio such as music or a bell may suit every locale.
+// The messages of play sounds within triggers begin with the trigger.
+func Translations(items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, locales []string) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	if len(locales) < 2 {
+		return diagnostics
+	}
+	// missing lists the locales, other than the default, without a translation
+	missing := func(has map[string]bool) string {
+		list := []string{}
+		for _, locale := range locales[1:] {
+			if !has[locale] {
+				list = append(list, locale)
+			}
+		}
+		return strings.Join(list, ", ")
+	}
+
+	nodes := map[uuid.UUID]prepare.ProjectItem{}
+	nodeIDs := []uuid.UUID{}
+	for _, item := range items {
+		if _, ok := nodes[item.DialogID]; !ok {
+			nodes[item.DialogID] = item
+			nodeIDs = append(nodeIDs, item.DialogID)
+		}
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i].String() < nodeIDs[j].String() })
+	for _, id := range nodeIDs {
+		item := nodes[id]
+		if len(item.DialogEntry) > 0 && !item.UnknownHandler {
+			has := map[string]bool{}
+			for _, input := range item.DialogEntry {
+				if locale, _, ok := prepare.EntryInputLocale(input); ok {
+					has[locale] = true
+				}
+			}
+			if m := missing(has); m != "" {
+				diagnostics = append(diagnostics, Diagnostic{
+					DialogNodeID: id,
+					Statements:   -1,
+					Statement:    -1,
+					Message:      fmt.Sprintf("entry inputs have no translation into %v", m),
+				})
+			}
+		}
+		diagnostics = append(diagnostics, blockTranslations(&item.RawLBlock, Diagnostic{DialogNodeID: id}, "", missing)...)
+	}
+
+	sortedTriggers := make([]prepare.ProjectTriggerItem, len(triggers))
+	copy(sortedTriggers, triggers)
+	sort.SliceStable(sortedTriggers, func(i, j int) bool {
+		if sortedTriggers[i].ZoneID != sortedTriggers[j].ZoneID {
+			return sortedTriggers[i].ZoneID.String() < sortedTriggers[j].ZoneID.String()
+		}
+		return sortedTriggers[i].TriggerType < sortedTriggers[j].TriggerType
+	})
+	for _, trigger := range sortedTriggers {
+		prefix := fmt.Sprintf("trigger %v in zone %v: ", trigger.TriggerType, trigger.ZoneID.String())
+		diagnostics = append(diagnostics, blockTranslations(&trigger.RawLBlock, Diagnostic{}, prefix, missing)...)
+	}
+	return diagnostics
+}
+
+// blockTranslations reports the text play sounds of a logical block which are missing translations
+func blockTranslations(block *prepare.RawLBlock, at Diagnostic, prefix string, missing func(has map[string]bool) string) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	check := func(set prepare.ActionSet, at Diagnostic) {
+		for _, sound := range set.PlaySounds {
+			if sound.SoundType != models.RAPlaySoundTypeText {
+				continue
+			}
+			has := map[string]bool{}
+			if translations, ok := prepare.Translations(sound); ok {
+				for locale := range translations {
+					has[locale] = true
+				}
+			}
+			m := missing(has)
+			if m == "" {
+				continue
+			}
+			what := "text"
+			if text, ok := sound.Val.(string); ok {
+				what = fmt.Sprintf("text %q", text)
+			}
+			at.Message = fmt.Sprintf("%v%v has no translation into %v", prefix, what, m)
+			diagnostics = append(diagnostics, at)
+		}
+	}
+
+	at.Statements, at.Statement = -1, -1
+	check(block.AlwaysExec, at)
+	if block.Statements == nil {
+		return diagnostics
+	}
+	for i, statements := range *block.Statements {
+		for j, stmt := range statements {
+			at.Statements, at.Statement = i, j
+			check(stmt.Exec, at)
+		}
+	}
+	return diagnostics
+}
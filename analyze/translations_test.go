@@ -0,0 +1,44 @@
+package analyze
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+func TestTranslations(t *testing.T) {
+	node, _ := uuid.FromString("00000000-0000-0000-0000-00000000000a")
+	zone, _ := uuid.FromString("00000000-0000-0000-0000-00000000000b")
+	text := func(val interface{}) prepare.ActionSet {
+		return prepare.ActionSet{PlaySounds: []models.RAPlaySound{{SoundType: models.RAPlaySoundTypeText, Val: val}}}
+	}
+	items := []prepare.ProjectItem{{
+		DialogID:    node,
+		DialogEntry: []string{"hello", "[es] hola"},
+		RawLBlock: prepare.RawLBlock{
+			AlwaysExec: text(map[string]interface{}{"en": "Hello", "es": "Hola", "de": "Hallo"}),
+			Statements: &[][]prepare.RawLStatement{{
+				{Exec: text("Goodbye")},
+				{Exec: prepare.ActionSet{PlaySounds: []models.RAPlaySound{{SoundType: models.RAPlaySoundTypeAudio, Val: "https://example.com/bell.mp3"}}}},
+			}},
+		},
+	}}
+	triggers := []prepare.ProjectTriggerItem{{ZoneID: zone}}
+	triggers[0].RawLBlock.AlwaysExec = text(map[string]interface{}{"en": "Welcome"})
+
+	locales := []string{"en", "es", "de"}
+	expected := []Diagnostic{
+		{DialogNodeID: node, Statements: -1, Statement: -1, Message: "entry inputs have no translation into de"},
+		{DialogNodeID: node, Statements: 0, Statement: 0, Message: `text "Goodbye" has no translation into es, de`},
+		{Statements: -1, Statement: -1, Message: "trigger 0 in zone 00000000-0000-0000-0000-00000000000b: text has no translation into es, de"},
+	}
+	if diagnostics := Translations(items, triggers, locales); !reflect.DeepEqual(diagnostics, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diagnostics)
+	}
+	if diagnostics := Translations(items, triggers, []string{"en"}); len(diagnostics) != 0 {
+		t.Errorf("expected no diagnostics for a project with one locale, got %+v", diagnostics)
+	}
+}
@@ -0,0 +1,352 @@
+package analyze
+
+import (
+	"fmt"
+	"sort"
+
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// VarType is the type of value a variable holds
+type VarType string
+
+const (
+	TypeString VarType = "string"
+	TypeNumber VarType = "number"
+	TypeBool   VarType = "boolean"
+)
+
+// Declaration explicitly gives a variable its type,
+// and optionally the value it holds before anything sets it
+type Declaration struct {
+	Type    VarType
+	Default interface{}
+}
+
+// Check fails when the type is unknown, or the default isn't of the type
+func (d Declaration) Check() error {
+	switch d.Type {
+	case TypeString, TypeNumber, TypeBool:
+	default:
+		return fmt.Errorf("unknown type %q, expected string, number or boolean", d.Type)
+	}
+	if d.Default == nil {
+		return nil
+	}
+	if t, ok := valueType(d.Default); !ok || t != d.Type {
+		return fmt.Errorf("default %#v is not a %v", d.Default, d.Type)
+	}
+	return nil
+}
+
+// TypeError fails a publish when variables are used as conflicting types
+type TypeError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("%v variables are used as conflicting types, such as %v", len(e.Diagnostics), e.Diagnostics[0])
+}
+
+// Types infers the type of every variable from how it is set and compared
+// across the dialog nodes and triggers, and reports each use which disagrees.
+// A declared variable is of its declared type, and otherwise of the type it is first used as.
+// Variables compared against one another share a type, whereas the seed variables of random groups may be of any.
+// The names, from prepare.PrepareVariables, are used within the messages where known.
+// Uses within AlwaysExec have a Statements and Statement index of -1,
+// and the messages of uses within triggers begin with the trigger.
+// Declarations which conflict with one another are reported without a dialog node.
+func Types(items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, declarations map[uint64]Declaration, names map[uint64]string) []Diagnostic {
+	c := &typeChecker{parent: map[uint64]uint64{}}
+
+	// Nodes and triggers are visited in a fixed order, so the first use of a variable is always the same one
+	nodes := map[uuid.UUID]*prepare.RawLBlock{}
+	nodeIDs := []uuid.UUID{}
+	for idx := range items {
+		if _, ok := nodes[items[idx].DialogID]; !ok {
+			nodes[items[idx].DialogID] = &items[idx].RawLBlock
+			nodeIDs = append(nodeIDs, items[idx].DialogID)
+		}
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i].String() < nodeIDs[j].String() })
+	for _, id := range nodeIDs {
+		c.block(nodes[id], Diagnostic{DialogNodeID: id})
+	}
+
+	sortedTriggers := make([]prepare.ProjectTriggerItem, len(triggers))
+	copy(sortedTriggers, triggers)
+	sort.SliceStable(sortedTriggers, func(i, j int) bool {
+		if sortedTriggers[i].ZoneID != sortedTriggers[j].ZoneID {
+			return sortedTriggers[i].ZoneID.String() < sortedTriggers[j].ZoneID.String()
+		}
+		return sortedTriggers[i].TriggerType < sortedTriggers[j].TriggerType
+	})
+	for _, trigger := range sortedTriggers {
+		c.trigger = fmt.Sprintf("trigger %v in zone %v", trigger.TriggerType, trigger.ZoneID.String())
+		c.block(&trigger.RawLBlock, Diagnostic{})
+	}
+
+	name := func(id uint64) string {
+		if n, ok := names[id]; ok {
+			return n
+		}
+		return fmt.Sprintf("#%v", id)
+	}
+
+	// The type of each group of variables compared against one another,
+	// along with the variable which decided it and why
+	type expectation struct {
+		t      VarType
+		id     uint64
+		reason string
+	}
+	// because explains the type a variable is expected to be
+	because := func(id uint64, e expectation) string {
+		if e.id == id {
+			return e.reason
+		}
+		return fmt.Sprintf("%v, which it is compared with, %v", name(e.id), e.reason)
+	}
+	expected := map[uint64]expectation{}
+	declared := []uint64{}
+	for id := range declarations {
+		declared = append(declared, id)
+	}
+	sort.Slice(declared, func(i, j int) bool { return declared[i] < declared[j] })
+	for _, id := range declared {
+		root := c.find(id)
+		if e, ok := expected[root]; ok && e.t != declarations[id].Type {
+			c.diagnostics = append(c.diagnostics, Diagnostic{
+				Statements: -1,
+				Statement:  -1,
+				Message:    fmt.Sprintf("%v is declared a %v, but %v", name(id), declarations[id].Type, because(id, e)),
+			})
+			continue
+		}
+		t := declarations[id].Type
+		expected[root] = expectation{t, id, fmt.Sprintf("is declared a %v", t)}
+	}
+
+	for _, use := range c.uses {
+		root := c.find(use.id)
+		e, ok := expected[root]
+		if !ok {
+			expected[root] = expectation{use.t, use.id, fmt.Sprintf("is a %v, as it is %v at %v", use.t, use.how, use.location())}
+			continue
+		}
+		if e.t == use.t {
+			continue
+		}
+		d := use.at
+		d.Message = fmt.Sprintf("%v is used as a %v, as it is %v, but %v", name(use.id), use.t, use.how, because(use.id, e))
+		if use.trigger != "" {
+			d.Message = fmt.Sprintf("%v: %v", use.trigger, d.Message)
+		}
+		c.diagnostics = append(c.diagnostics, d)
+	}
+	return c.diagnostics
+}
+
+// typeUse is a use of a variable which requires it to be of a type
+type typeUse struct {
+	id  uint64
+	t   VarType
+	how string
+	at  Diagnostic
+	// trigger names the trigger the use is within, if it isn't within a dialog node
+	trigger string
+}
+
+// location describes where a use is, for the message of another diagnostic
+func (u typeUse) location() string {
+	where := "AlwaysExec"
+	if u.at.Statements >= 0 {
+		where = fmt.Sprintf("statements %v statement %v", u.at.Statements, u.at.Statement)
+	}
+	if u.trigger != "" {
+		return fmt.Sprintf("%v %v", u.trigger, where)
+	}
+	return fmt.Sprintf("dialog node %v %v", u.at.DialogNodeID.String(), where)
+}
+
+// typeChecker collects the uses of variables in order, and which variables are compared against one another
+type typeChecker struct {
+	uses        []typeUse
+	parent      map[uint64]uint64
+	diagnostics []Diagnostic
+	// trigger names the trigger being visited
+	trigger string
+}
+
+func (c *typeChecker) find(id uint64) uint64 {
+	for {
+		p, ok := c.parent[id]
+		if !ok || p == id {
+			return id
+		}
+		id = p
+	}
+}
+
+func (c *typeChecker) union(a, b uint64) {
+	a, b = c.find(a), c.find(b)
+	if a != b {
+		c.parent[b] = a
+	}
+}
+
+func (c *typeChecker) use(id uint64, t VarType, at Diagnostic, format string, args ...interface{}) {
+	c.uses = append(c.uses, typeUse{id, t, fmt.Sprintf(format, args...), at, c.trigger})
+}
+
+func (c *typeChecker) block(block *prepare.RawLBlock, at Diagnostic) {
+	at.Statements, at.Statement = -1, -1
+	c.actions(block.AlwaysExec, at)
+	if block.Statements == nil {
+		return
+	}
+	for i, statements := range *block.Statements {
+		for j, stmt := range statements {
+			at.Statements, at.Statement = i, j
+			// Conditions which don't normalize fail the publish with their own error
+			if condition, _, err := helpers.StatementCondition(stmt); err == nil {
+				c.expr(condition, at)
+			}
+			c.actions(stmt.Exec, at)
+		}
+	}
+}
+
+func (c *typeChecker) actions(set prepare.ActionSet, at Diagnostic) {
+	// The actions run ahead of the play sounds, see prepare.ActionSet
+	for _, val := range set.Actions {
+		action, ok := val.(prepare.RAVariable)
+		if !ok {
+			continue
+		}
+		switch action.Operation {
+		case prepare.VariableSet:
+			if t, ok := valueType(action.Value); ok {
+				c.use(action.ID, t, at, "set to %#v", action.Value)
+			}
+		case prepare.VariableIncrement:
+			c.use(action.ID, TypeNumber, at, "incremented")
+		case prepare.VariableDecrement:
+			c.use(action.ID, TypeNumber, at, "decremented")
+		case prepare.VariableToggle:
+			c.use(action.ID, TypeBool, at, "toggled")
+		}
+	}
+	for _, sound := range set.PlaySounds {
+		if template, ok := sound.Val.(prepare.RATemplate); ok {
+			c.template(template.Tokens, at)
+			continue
+		}
+		if speech, ok := sound.Val.(prepare.RASpeechTemplate); ok {
+			c.template(speech.SSML, at)
+			continue
+		}
+		if variants, ok := sound.Val.(prepare.RAVariants); ok {
+			c.actions(prepare.ActionSet{PlaySounds: variants.Sounds}, at)
+		}
+	}
+}
+
+// template notes that every variable pluralized within a template is a number
+// Values and conditionals accept variables of any type.
+func (c *typeChecker) template(tokens []prepare.TemplateToken, at Diagnostic) {
+	for _, token := range tokens {
+		switch token.Kind {
+		case prepare.TemplatePlural:
+			c.use(token.ID, TypeNumber, at, "pluralized within a template")
+		case prepare.TemplateIf:
+			c.template(token.Then, at)
+			c.template(token.Else, at)
+		}
+	}
+}
+
+func (c *typeChecker) expr(expr helpers.Expr, at Diagnostic) {
+	switch e := expr.(type) {
+	case helpers.ExprAnd:
+		for _, child := range e {
+			c.expr(child, at)
+		}
+	case helpers.ExprOr:
+		for _, child := range e {
+			c.expr(child, at)
+		}
+	case helpers.ExprNot:
+		c.expr(e.Expr, at)
+	case helpers.ExprCalc:
+		c.calc(e.Left, at)
+		c.calc(e.Right, at)
+	case helpers.ExprCompare:
+		c.compare(e, at)
+	}
+}
+
+func (c *typeChecker) compare(e helpers.ExprCompare, at Diagnostic) {
+	switch e.Operator {
+	case "contains", "startswith", "endswith", "ieq", "regex":
+		c.use(e.Var, TypeString, at, "compared by %v", e.Operator)
+		if ref, ok := e.Value.(helpers.VarRef); ok {
+			c.use(uint64(ref), TypeString, at, "compared by %v", e.Operator)
+		}
+		return
+	case "in":
+		list, _ := e.Value.([]interface{})
+		for _, item := range list {
+			if t, ok := valueType(item); ok {
+				c.use(e.Var, t, at, "compared with %#v by in", item)
+			}
+		}
+		return
+	case "lt", "gt", "lte", "gte":
+		if _, ok := e.Value.(string); !ok {
+			// Strings may be ordered as well as numbers
+			c.use(e.Var, TypeNumber, at, "compared by %v", e.Operator)
+		}
+	}
+
+	switch v := e.Value.(type) {
+	case helpers.VarRef:
+		c.union(e.Var, uint64(v))
+	case helpers.Calc:
+		c.use(e.Var, TypeNumber, at, "compared with a calc by %v", e.Operator)
+		c.calc(v, at)
+	default:
+		if t, ok := valueType(v); ok {
+			c.use(e.Var, t, at, "compared with %#v by %v", v, e.Operator)
+		}
+	}
+}
+
+// calc notes that every variable within a calc is a number
+func (c *typeChecker) calc(calc helpers.Calc, at Diagnostic) {
+	switch v := calc.(type) {
+	case helpers.CalcVar:
+		c.use(uint64(v), TypeNumber, at, "used within a calc")
+	case helpers.CalcBinary:
+		c.calc(v.Left, at)
+		c.calc(v.Right, at)
+	case helpers.CalcNeg:
+		c.calc(v.Calc, at)
+	}
+}
+
+// valueType returns the type of a literal value, if it has one
+// Null is the value of an unset variable of any type.
+func valueType(val interface{}) (VarType, bool) {
+	switch val.(type) {
+	case string:
+		return TypeString, true
+	case float64, int, int32, int64:
+		return TypeNumber, true
+	case bool:
+		return TypeBool, true
+	}
+	return "", false
+}
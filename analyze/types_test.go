@@ -0,0 +1,112 @@
+package analyze
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+func setVariable(operation prepare.VariableOperation, id uint64, value interface{}) prepare.ActionSet {
+	return prepare.ActionSet{Actions: []interface{}{prepare.RAVariable{Operation: operation, ID: id, Value: value}}}
+}
+
+func TestTypes(t *testing.T) {
+	nodeA, _ := uuid.FromString("00000000-0000-0000-0000-00000000000a")
+	nodeB, _ := uuid.FromString("00000000-0000-0000-0000-00000000000b")
+	items := []prepare.ProjectItem{
+		{
+			DialogID: nodeB,
+			RawLBlock: prepare.RawLBlock{
+				Statements: &[][]prepare.RawLStatement{{
+					// 0: #1 is compared with a string, but it is a number
+					{Operators: &models.OrGroup{{"eq": {1: "many"}}}},
+					// 1: #2 is ordered, so it is a number, but it is toggled
+					{Operators: &models.OrGroup{{"gt": {2: 3.0}}}, Exec: setVariable(prepare.VariableToggle, 2, nil)},
+				}},
+			},
+		},
+		{
+			DialogID: nodeA,
+			RawLBlock: prepare.RawLBlock{
+				AlwaysExec: setVariable(prepare.VariableIncrement, 1, 1.0),
+				Statements: &[][]prepare.RawLStatement{{
+					// #3 is compared with #4, which is declared a string, and #5 is a string
+					{Operators: &models.OrGroup{{"eq": {3: map[string]interface{}{"var": 4.0}}, "contains": {5: "a"}}}},
+					// #3 is used within a calc, so is a number
+					{Operators: &models.OrGroup{{"eq": {6: map[string]interface{}{"calc": "#3 + 1"}}}}},
+				}},
+			},
+		},
+		// The rows repeat dialog nodes, which are only checked once
+		{DialogID: nodeA},
+	}
+	triggers := []prepare.ProjectTriggerItem{
+		{TriggerType: 1, RawLBlock: prepare.RawLBlock{AlwaysExec: setVariable(prepare.VariableSet, 5, 1.0)}},
+	}
+	declarations := map[uint64]Declaration{4: {Type: TypeString}}
+	names := map[uint64]string{1: "gold", 4: "name"}
+
+	diagnostics := Types(items, triggers, declarations, names)
+	expected := []Diagnostic{
+		{DialogNodeID: nodeA, Statements: 0, Statement: 1},
+		{DialogNodeID: nodeB, Statements: 0, Statement: 0},
+		{DialogNodeID: nodeB, Statements: 0, Statement: 1},
+		{Statements: -1, Statement: -1},
+	}
+	found := []Diagnostic{}
+	for _, d := range diagnostics {
+		found = append(found, Diagnostic{DialogNodeID: d.DialogNodeID, Statements: d.Statements, Statement: d.Statement})
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected diagnostics at %v, got %v", expected, diagnostics)
+	}
+
+	messages := []string{
+		"#3 is used as a number, as it is used within a calc, but name, which it is compared with, is declared a string",
+		"gold is used as a string, as it is compared with \"many\" by eq, but is a number, as it is incremented at dialog node " + nodeA.String() + " AlwaysExec",
+		"#2 is used as a boolean, as it is toggled, but is a number, as it is compared by gt at dialog node " + nodeB.String() + " statements 0 statement 1",
+		"trigger 1 in zone " + uuid.UUID{}.String() + ": #5 is used as a number, as it is set to 1, but is a string, as it is compared by contains at dialog node " + nodeA.String() + " statements 0 statement 0",
+	}
+	for idx, message := range messages {
+		if !strings.HasPrefix(diagnostics[idx].Message, message) {
+			t.Errorf("expected %q, got %q", message, diagnostics[idx].Message)
+		}
+	}
+}
+
+func TestTypesTemplates(t *testing.T) {
+	// gold is pluralized within a conditional, so it is a number, but it is set to a string
+	template := prepare.RATemplate{Tokens: []prepare.TemplateToken{
+		{Kind: prepare.TemplateIf, ID: 2, Then: []prepare.TemplateToken{
+			{Kind: prepare.TemplateValue, ID: 1},
+			{Kind: prepare.TemplatePlural, ID: 1, Singular: " coin", Plural: " coins"},
+		}},
+	}}
+	set := setVariable(prepare.VariableSet, 1, "none")
+	set.PlaySounds = append(set.PlaySounds, models.RAPlaySound{SoundType: models.RAPlaySoundTypeText, Val: template})
+	items := []prepare.ProjectItem{{RawLBlock: prepare.RawLBlock{AlwaysExec: set}}}
+
+	diagnostics := Types(items, nil, nil, map[uint64]string{1: "gold"})
+	if len(diagnostics) != 1 || !strings.HasPrefix(diagnostics[0].Message, "gold is used as a number, as it is pluralized within a template") {
+		t.Errorf("expected gold to be a number, got %v", diagnostics)
+	}
+}
+
+func TestDeclarationCheck(t *testing.T) {
+	valid := []Declaration{{Type: TypeNumber}, {Type: TypeNumber, Default: 1.0}, {Type: TypeBool, Default: false}, {Type: TypeString, Default: ""}}
+	for _, d := range valid {
+		if err := d.Check(); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", d, err)
+		}
+	}
+	invalid := []Declaration{{Type: "list"}, {Type: TypeNumber, Default: "1"}, {Type: TypeBool, Default: 0.0}}
+	for _, d := range invalid {
+		if err := d.Check(); err == nil {
+			t.Errorf("expected %+v to be invalid", d)
+		}
+	}
+}
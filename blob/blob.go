@@ -0,0 +1,84 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Every compiled blob written to Redis begins with a header:
+//
+// - 4 bytes magic "LKSM"
+// - uint16 format version
+// - uint8 blob kind
+//
+// This lets the runtime reject or adapt to artifacts
+// compiled by a different version of lakshmi.
+
+// Version is the current compiled format version
+// It must be incremented whenever the layout of any compiled blob changes
+const Version uint16 = 15
+
+// HeaderLength is the number of bytes taken by the header
+const HeaderLength = 7
+
+// Magic identifies a blob as compiled by lakshmi
+var Magic = []byte("LKSM")
+
+// Kind identifies what a compiled blob contains
+type Kind uint8
+
+const (
+	// KindDialogNode is a dialog node continue flag followed by its logical block
+	KindDialogNode Kind = iota + 1
+	// KindTrigger is the logical block of a trigger
+	KindTrigger
+	// KindActionBundle is a sequence of compiled request actions
+	KindActionBundle
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindDialogNode:
+		return "dialog node"
+	case KindTrigger:
+		return "trigger"
+	case KindActionBundle:
+		return "action bundle"
+	}
+	return fmt.Sprintf("unknown kind %v", uint8(k))
+}
+
+// Header returns the header for a blob of the given kind at the current Version
+func Header(kind Kind) []byte {
+	header := make([]byte, HeaderLength)
+	copy(header, Magic)
+	binary.LittleEndian.PutUint16(header[4:], Version)
+	header[6] = byte(kind)
+	return header
+}
+
+// Read parses the header at the beginning of a blob
+// and returns the format version, the kind and the remaining payload
+func Read(b []byte) (uint16, Kind, []byte, error) {
+	if len(b) < HeaderLength || !bytes.Equal(b[:4], Magic) {
+		return 0, 0, nil, fmt.Errorf("blob: missing header")
+	}
+	return binary.LittleEndian.Uint16(b[4:]), Kind(b[6]), b[HeaderLength:], nil
+}
+
+// Open checks that a blob is of the expected kind and of the current Version
+// and returns its payload
+func Open(b []byte, kind Kind) ([]byte, error) {
+	version, k, payload, err := Read(b)
+	if err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, fmt.Errorf("blob: unsupported format version %v, expected %v", version, Version)
+	}
+	if k != kind {
+		return nil, fmt.Errorf("blob: expected a %v but found a %v", kind, k)
+	}
+	return payload, nil
+}
@@ -0,0 +1,32 @@
+package blob
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	b := append(Header(KindTrigger), 1, 2, 3)
+
+	payload, err := Open(b, KindTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("unexpected payload %v", payload)
+	}
+
+	if _, err := Open(b, KindDialogNode); err == nil {
+		t.Error("expected an error opening a trigger as a dialog node")
+	}
+
+	newer := append([]byte{}, b...)
+	newer[4]++
+	if _, err := Open(newer, KindTrigger); err == nil {
+		t.Error("expected an error opening a newer format version")
+	}
+
+	if _, err := Open([]byte{0, 2, 3}, KindTrigger); err == nil {
+		t.Error("expected an error opening a blob without a header")
+	}
+}
@@ -1,12 +1,15 @@
 package compile
 
 import (
+	"sort"
+
 	"github.com/talkative-ai/core/common"
 	"github.com/talkative-ai/core/models"
 	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/prepare"
 )
 
-func Actor(redisWriter chan common.RedisCommand, items *[]models.ProjectItem, publishID string) error {
+func Actor(redisWriter chan common.RedisCommand, items *[]prepare.ProjectItem, publishID string) error {
 	zoneActorMap := map[uuid.UUID]map[uuid.UUID]bool{}
 	for _, item := range *items {
 		if _, ok := zoneActorMap[item.ZoneID]; !ok {
@@ -15,9 +18,22 @@ func Actor(redisWriter chan common.RedisCommand, items *[]models.ProjectItem, pu
 		zoneActorMap[item.ZoneID][item.ActorID] = true
 	}
 
+	// Write in a sorted order so that every publish issues the same commands
+	zoneIDs := []string{}
+	actorIDsByZone := map[string][]string{}
 	for zoneID, mapping := range zoneActorMap {
+		zoneIDs = append(zoneIDs, zoneID.String())
 		for actorID := range mapping {
-			redisWriter <- common.RedisSADD(models.KeynavCompiledActorsWithinZone(publishID, zoneID.String()), actorID.String())
+			actorIDsByZone[zoneID.String()] = append(actorIDsByZone[zoneID.String()], actorID.String())
+		}
+	}
+	sort.Strings(zoneIDs)
+
+	for _, zoneID := range zoneIDs {
+		actorIDs := actorIDsByZone[zoneID]
+		sort.Strings(actorIDs)
+		for _, actorID := range actorIDs {
+			redisWriter <- common.RedisSADD(models.KeynavCompiledActorsWithinZone(publishID, zoneID), actorID)
 		}
 	}
 
@@ -8,6 +8,7 @@ import (
 	"github.com/talkative-ai/core/models"
 	uuid "github.com/talkative-ai/go.uuid"
 	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
 )
 
 // Dialog compiles the dialogs into byte slices.
@@ -15,14 +16,18 @@ import (
 // Then for each dialog graph root item, it compiles it via the helper DialogNode
 // which will finish the compilation process.
 // This includes action bundles, logical blocks, and child nodes recursively.
-func Dialog(redisWriter chan common.RedisCommand, items *[]models.ProjectItem, publishID string) (map[uuid.UUID]*models.DialogNode, error) {
+// Action bundles are stored through bundleStore, and what the optimizer saves is added to stats.
+// The NLU is trained to understand the entry inputs in the given language.
+func Dialog(redisWriter chan common.RedisCommand, items *[]prepare.ProjectItem, publishID string, bundleStore *helpers.BundleStore, stats *helpers.OptimizeStats, language string) (map[uuid.UUID]*models.DialogNode, error) {
 
 	dialogGraph := map[uuid.UUID]*models.DialogNode{}
+	// A models.DialogNode has no place for what lakshmi adds to the logical blocks, so they are kept by node
+	blocks := map[uuid.UUID]*prepare.RawLBlock{}
 	dialogGraphRoots := map[uuid.UUID]bool{}
 	dialogEntrySet := map[uuid.UUID]map[uuid.UUID]bool{}
 	edgeTo := map[uuid.UUID]map[uuid.UUID]bool{}
 
-	for _, item := range *items {
+	for idx, item := range *items {
 
 		// TODO: Generalize this using reflection and tags somehow
 		// Many ProjectItems have repeating DialogIDs
@@ -35,10 +40,10 @@ func Dialog(redisWriter chan common.RedisCommand, items *[]models.ProjectItem, p
 				ActorID:        item.ActorID,
 				ProjectID:      item.ProjectID,
 				EntryInput:     []models.DialogInput{},
-				RawLBlock:      item.RawLBlock,
 				IsRoot:         item.IsRoot,
 				UnknownHandler: item.UnknownHandler,
 			}
+			blocks[item.DialogID] = &(*items)[idx].RawLBlock
 
 			edgeTo[item.DialogID] = map[uuid.UUID]bool{}
 
@@ -120,6 +125,7 @@ func Dialog(redisWriter chan common.RedisCommand, items *[]models.ProjectItem, p
 
 	rootNodesByActorID := map[uuid.UUID]*[]*models.DialogNode{}
 	syncmap := common.SyncMapUUID{}
+	errs := make(chan error, len(dialogGraphRoots))
 
 	for rootID := range dialogGraphRoots {
 
@@ -139,7 +145,7 @@ func Dialog(redisWriter chan common.RedisCommand, items *[]models.ProjectItem, p
 		wg.Add(1)
 		go func(node models.DialogNode) {
 			defer wg.Done()
-			helpers.DialogNode(node, redisWriter, &syncmap, publishID)
+			errs <- helpers.DialogNode(node, blocks, redisWriter, &syncmap, publishID, bundleStore, stats, language)
 		}(node)
 	}
 
@@ -147,11 +153,18 @@ func Dialog(redisWriter chan common.RedisCommand, items *[]models.ProjectItem, p
 		wg.Add(1)
 		go func(aid string, arr []*models.DialogNode) {
 			defer wg.Done()
-			helpers.TrainData(nil, aid, &arr, redisWriter, publishID)
+			helpers.TrainData(nil, aid, &arr, redisWriter, publishID, language)
 		}(actorID.String(), *rootNodesArray)
 	}
 
 	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return dialogGraph, nil
 }
@@ -0,0 +1,29 @@
+package compile
+
+import (
+	"fmt"
+
+	"github.com/talkative-ai/core/common"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// LocalePublishID scopes the keys of the dialogs and triggers of a publish to one of its locales
+// The default locale is compiled under the publishID itself, so runtimes unaware of locales play it as ever.
+func LocalePublishID(publishID string, locale string) string {
+	return fmt.Sprintf("%v:%v", publishID, locale)
+}
+
+// Locale compiles the dialogs, along with their NLU dataset, and the triggers of a locale other than the default,
+// from the items and triggers localized with prepare.Localize and prepared like those of the default locale.
+// Their keys, including those of their action bundles, are scoped with LocalePublishID,
+// so that the bundles of a locale may be listed or dropped along with the rest of it.
+// The BundleStore of the locale is returned for its stats.
+func Locale(redisWriter chan common.RedisCommand, items *[]prepare.ProjectItem, triggers *[]prepare.ProjectTriggerItem, publishID string, locale string, stats *helpers.OptimizeStats) (*helpers.BundleStore, error) {
+	scoped := LocalePublishID(publishID, locale)
+	bundleStore := helpers.NewBundleStore(scoped)
+	if _, err := Dialog(redisWriter, items, scoped, bundleStore, stats, prepare.LocaleLanguage(locale)); err != nil {
+		return nil, err
+	}
+	return bundleStore, Trigger(redisWriter, triggers, scoped, bundleStore)
+}
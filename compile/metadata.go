@@ -2,27 +2,40 @@ package compile
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/talkative-ai/core/common"
 	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/prepare"
 )
 
 // Metadata saves all of the static and dynamic project metadata
-func Metadata(redisWriter chan common.RedisCommand, project models.Project, items *[]models.ProjectItem, version int64, publishID string, isDemo bool) error {
+// The locales of the project are saved in order, the first being the default.
+func Metadata(redisWriter chan common.RedisCommand, project models.Project, items *[]prepare.ProjectItem, version int64, publishID string, isDemo bool, locales []string) error {
 	redisWriter <- common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "title", []byte(project.Title))
 	redisWriter <- common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "start_zone_id", []byte(fmt.Sprintf("%v", project.StartZoneID.UUID.String())))
 	redisWriter <- common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "pubver", []byte(fmt.Sprintf("%v", version)))
+	redisWriter <- common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "format_version", []byte(fmt.Sprintf("%v", blob.Version)))
+	redisWriter <- common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "locales", []byte(strings.Join(locales, ",")))
+	redisWriter <- common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "default_locale", []byte(locales[0]))
 	if !isDemo {
 		redisWriter <- common.RedisHSET(models.KeynavGlobalMetaProjects(), strings.ToUpper(project.Title), []byte(fmt.Sprintf("%v", publishID)))
 	}
 
-	zoneIDs := map[string]bool{}
+	zoneIDSet := map[string]bool{}
+	zoneIDs := []string{}
 	for _, item := range *items {
-		zoneIDs[fmt.Sprintf("%v", item.ZoneID)] = true
+		id := fmt.Sprintf("%v", item.ZoneID)
+		if !zoneIDSet[id] {
+			zoneIDSet[id] = true
+			zoneIDs = append(zoneIDs, id)
+		}
 	}
+	sort.Strings(zoneIDs)
 
-	for id := range zoneIDs {
+	for _, id := range zoneIDs {
 		redisWriter <- common.RedisSADD(fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "all_zones"), []byte(id))
 	}
 
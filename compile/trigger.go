@@ -2,28 +2,45 @@ package compile
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/talkative-ai/core/common"
 	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/blob"
 	"github.com/talkative-ai/lakshmi/helpers"
 	"github.com/talkative-ai/lakshmi/prepare"
 )
 
-func Trigger(redisWriter chan common.RedisCommand, items *[]models.ProjectTriggerItem, projectID string) error {
-
-	bundle := uint64(0)
-
-	for _, item := range *items {
-		bundle++
+// Trigger compiles the logical block of every trigger into the triggers of its zone
+// Action bundles are stored through bundleStore.
+func Trigger(redisWriter chan common.RedisCommand, items *[]prepare.ProjectTriggerItem, projectID string, bundleStore *helpers.BundleStore) error {
+
+	// The rows arrive in no particular order
+	// Sort them so that the triggers are always compiled in the same order
+	sorted := make([]prepare.ProjectTriggerItem, len(*items))
+	copy(sorted, *items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].ZoneID != sorted[j].ZoneID {
+			return sorted[i].ZoneID.String() < sorted[j].ZoneID.String()
+		}
+		return sorted[i].TriggerType < sorted[j].TriggerType
+	})
+
+	for _, item := range sorted {
 		lblock := models.LBlock{}
 
-		key := models.KeynavCompiledTriggerActionBundle(projectID, item.ZoneID.String(), uint64(item.TriggerType), bundle)
 		bslice := prepare.BundleActions(item.RawLBlock.AlwaysExec)
-		lblock.AlwaysExec = key
-		redisWriter <- common.RedisSET(key, bslice)
-
-		compiled := helpers.CompileLogic(&lblock)
-		key = models.KeynavCompiledTriggersWithinZone(projectID, item.ZoneID.String())
+		lblock.AlwaysExec = bundleStore.Store(bslice, redisWriter)
+
+		compiled, err := helpers.CompileLogic(&lblock)
+		if err != nil {
+			return &helpers.CompileError{
+				Entity: fmt.Sprintf("trigger %v in zone %v", item.TriggerType, item.ZoneID.String()),
+				Err:    err,
+			}
+		}
+		compiled = append(blob.Header(blob.KindTrigger), compiled...)
+		key := models.KeynavCompiledTriggersWithinZone(projectID, item.ZoneID.String())
 		redisWriter <- common.RedisHSET(key, fmt.Sprintf("%v", item.TriggerType), compiled)
 	}
 
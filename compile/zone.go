@@ -0,0 +1,57 @@
+package compile
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/talkative-ai/core/common"
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// ZoneExitsKey is the Redis set of the zones which a zone leads to,
+// through the zone changes of its dialogs and triggers
+func ZoneExitsKey(publishID string, zoneID string) string {
+	return fmt.Sprintf("%v:%v:%v", models.KeynavProjectMetadataStatic(publishID), "zone_exits", zoneID)
+}
+
+// Zones compiles the zone adjacency index
+// A dialog belongs to every zone its actor is within.
+// The zone changes must already be prepared with prepare.PrepareZones.
+func Zones(redisWriter chan common.RedisCommand, items *[]prepare.ProjectItem, triggers *[]prepare.ProjectTriggerItem, publishID string) error {
+	exits := map[string]map[string]bool{}
+	addExits := func(zoneID uuid.UUID, block *prepare.RawLBlock) {
+		for _, target := range prepare.ZoneChanges(block) {
+			if exits[zoneID.String()] == nil {
+				exits[zoneID.String()] = map[string]bool{}
+			}
+			exits[zoneID.String()][target.String()] = true
+		}
+	}
+	for idx := range *items {
+		addExits((*items)[idx].ZoneID, &(*items)[idx].RawLBlock)
+	}
+	for idx := range *triggers {
+		addExits((*triggers)[idx].ZoneID, &(*triggers)[idx].RawLBlock)
+	}
+
+	// Write in a sorted order so that every publish issues the same commands
+	zoneIDs := []string{}
+	for zoneID := range exits {
+		zoneIDs = append(zoneIDs, zoneID)
+	}
+	sort.Strings(zoneIDs)
+	for _, zoneID := range zoneIDs {
+		targets := []string{}
+		for target := range exits[zoneID] {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			redisWriter <- common.RedisSADD(ZoneExitsKey(publishID, zoneID), []byte(target))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,324 @@
+package decompile
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// ActionBundle decodes a compiled action bundle back into its request actions
+// It is the inverse of prepare.BundleActions, and validates every record on the way:
+// each RAID must be known and each payload well-formed.
+func ActionBundle(b []byte) ([]models.RequestAction, error) {
+	payload, err := blob.Open(b, blob.KindActionBundle)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{b: payload}
+	actions := []models.RequestAction{}
+	for !r.done() {
+		offset := r.pos
+		raid, err := r.uint64()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.next(int(length))
+		if err != nil {
+			return nil, err
+		}
+		action, err := readAction(models.RAID(raid), data)
+		if err != nil {
+			return nil, fmt.Errorf("decompile: action %v at offset %v: %v", len(actions), offset, err)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// readAction decodes the compiled payload of a single request action
+func readAction(raid models.RAID, data []byte) (models.RequestAction, error) {
+	switch raid {
+	case models.RAIDPlaySound:
+		return readPlaySound(data)
+	case prepare.RAIDVariable:
+		return readVariable(data)
+	case prepare.RAIDChangeZone:
+		return readChangeZone(data)
+	case prepare.RAIDSpeech:
+		return readSpeech(data)
+	case prepare.RAIDTemplate:
+		return readTemplate(data)
+	case prepare.RAIDSpeechTemplate:
+		return readSpeechTemplate(data)
+	case prepare.RAIDVariants:
+		return readVariants(data)
+	}
+	return nil, fmt.Errorf("unknown RAID %v", raid)
+}
+
+func readPlaySound(data []byte) (models.RequestAction, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("play sound is missing its sound type")
+	}
+	action := models.RAPlaySound{SoundType: models.RAPlaySoundType(data[0])}
+	value := string(data[1:])
+	switch action.SoundType {
+	case models.RAPlaySoundTypeText:
+		if !utf8.ValidString(value) {
+			return nil, fmt.Errorf("play sound text is not valid UTF-8")
+		}
+		action.Val = value
+	case models.RAPlaySoundTypeAudio:
+		u, err := url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("play sound audio has an invalid URL: %v", err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("play sound audio URL %q is not absolute", value)
+		}
+		action.Val = u
+	default:
+		return nil, fmt.Errorf("unknown play sound type %v", action.SoundType)
+	}
+	return action, nil
+}
+
+// readVariable decodes a prepare.RAVariable, whose set values use the value types of compiled logic
+func readVariable(data []byte) (models.RequestAction, error) {
+	r := &reader{b: data}
+	operation, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	id, err := r.uint64()
+	if err != nil {
+		return nil, err
+	}
+	action := prepare.RAVariable{Operation: prepare.VariableOperation(operation), ID: id}
+	switch action.Operation {
+	case prepare.VariableSet:
+		valueType, err := r.uint8()
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case uint8(helpers.ValueTypeString):
+			action.Value, err = r.string()
+		case uint8(helpers.ValueTypeFloat):
+			var bits uint64
+			bits, err = r.uint64()
+			action.Value = math.Float64frombits(bits)
+		case uint8(helpers.ValueTypeBool):
+			var value uint8
+			value, err = r.uint8()
+			if err == nil && value > 1 {
+				err = fmt.Errorf("invalid boolean %v", value)
+			}
+			action.Value = value == 1
+		default:
+			err = fmt.Errorf("unknown variable value type %v", valueType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case prepare.VariableIncrement, prepare.VariableDecrement:
+		bits, err := r.uint64()
+		if err != nil {
+			return nil, err
+		}
+		action.Value = math.Float64frombits(bits)
+	case prepare.VariableToggle:
+	default:
+		return nil, fmt.Errorf("unknown variable operation %v", operation)
+	}
+	if !r.done() {
+		return nil, fmt.Errorf("variable action has %v trailing bytes", len(data)-r.pos)
+	}
+	return action, nil
+}
+
+func readChangeZone(data []byte) (models.RequestAction, error) {
+	action := prepare.RAChangeZone{}
+	if len(data) != len(action.ZoneID) {
+		return nil, fmt.Errorf("zone change has %v bytes, expected a %v byte zone ID", len(data), len(action.ZoneID))
+	}
+	copy(action.ZoneID[:], data)
+	return action, nil
+}
+
+func readSpeech(data []byte) (models.RequestAction, error) {
+	r := &reader{b: data}
+	ssml, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	text, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	if !r.done() {
+		return nil, fmt.Errorf("speech has %v trailing bytes", len(data)-r.pos)
+	}
+	// The SSML must still be valid, and its text must be the fallback
+	speech, err := prepare.ParseSSML(ssml)
+	if err != nil {
+		return nil, err
+	}
+	if speech.Text != text {
+		return nil, fmt.Errorf("speech fallback %q does not match its SSML", text)
+	}
+	return speech, nil
+}
+
+func readTemplate(data []byte) (models.RequestAction, error) {
+	r := &reader{b: data}
+	tokens, err := readTemplateTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	if !r.done() {
+		return nil, fmt.Errorf("template has %v trailing bytes", len(data)-r.pos)
+	}
+	return prepare.RATemplate{Tokens: tokens}, nil
+}
+
+func readSpeechTemplate(data []byte) (models.RequestAction, error) {
+	r := &reader{b: data}
+	ssml, err := readTemplateTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	text, err := readTemplateTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	if !r.done() {
+		return nil, fmt.Errorf("speech template has %v trailing bytes", len(data)-r.pos)
+	}
+	// As with speech, the SSML must still be valid, and its text must be the fallback
+	speech, err := prepare.NewSpeechTemplate(ssml)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(speech.Text, text) {
+		return nil, fmt.Errorf("speech template fallback does not match its SSML")
+	}
+	return speech, nil
+}
+
+// readTemplateTokens decodes a token list of a prepare.RATemplate, including those nested within its conditionals
+func readTemplateTokens(r *reader) ([]prepare.TemplateToken, error) {
+	count, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	tokens := []prepare.TemplateToken{}
+	for i := 0; i < int(count); i++ {
+		kind, err := r.uint8()
+		if err != nil {
+			return nil, err
+		}
+		token := prepare.TemplateToken{Kind: prepare.TemplateTokenKind(kind)}
+		switch token.Kind {
+		case prepare.TemplateText:
+			token.Text, err = r.string()
+		case prepare.TemplateValue:
+			token.ID, err = r.uint64()
+		case prepare.TemplatePlural:
+			if token.ID, err = r.uint64(); err == nil {
+				if token.Singular, err = r.string(); err == nil {
+					token.Plural, err = r.string()
+				}
+			}
+		case prepare.TemplateIf:
+			var negate uint8
+			if token.ID, err = r.uint64(); err == nil {
+				negate, err = r.uint8()
+			}
+			if err == nil && negate > 1 {
+				err = fmt.Errorf("invalid boolean %v", negate)
+			}
+			token.Negate = negate == 1
+			if err == nil {
+				if token.Then, err = readTemplateTokens(r); err == nil {
+					token.Else, err = readTemplateTokens(r)
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown template token kind %v", kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range []string{token.Text, token.Singular, token.Plural} {
+			if !utf8.ValidString(s) {
+				return nil, fmt.Errorf("template text is not valid UTF-8")
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// readVariants decodes a prepare.RAVariants, whose variants are records like those of an action bundle
+// Each variant must be text, audio, speech or a template, and the text and audio may not be mixed.
+func readVariants(data []byte) (models.RequestAction, error) {
+	r := &reader{b: data}
+	policy, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	if policy > uint8(prepare.VariantShuffle) {
+		return nil, fmt.Errorf("unknown variant policy %v", policy)
+	}
+	count, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	action := prepare.RAVariants{Policy: prepare.VariantPolicy(policy)}
+	for i := 0; i < int(count); i++ {
+		raid, err := r.uint64()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(int(length))
+		if err != nil {
+			return nil, err
+		}
+		variant, err := readAction(models.RAID(raid), b)
+		if err != nil {
+			return nil, fmt.Errorf("variant %v: %v", i, err)
+		}
+		sound := models.RAPlaySound{SoundType: models.RAPlaySoundTypeText, Val: variant}
+		switch v := variant.(type) {
+		case models.RAPlaySound:
+			sound = v
+		case prepare.RASpeech, prepare.RATemplate, prepare.RASpeechTemplate:
+		default:
+			return nil, fmt.Errorf("variant %v is a %T rather than a play sound", i, variant)
+		}
+		if len(action.Sounds) > 0 && action.Sounds[0].SoundType != sound.SoundType {
+			return nil, fmt.Errorf("variant %v mixes text and audio", i)
+		}
+		action.Sounds = append(action.Sounds, sound)
+	}
+	if !r.done() {
+		return nil, fmt.Errorf("variants have %v trailing bytes", len(data)-r.pos)
+	}
+	return action, nil
+}
@@ -0,0 +1,138 @@
+package decompile
+
+import (
+	"encoding/binary"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// record encodes a single action record as prepare.BundleActions does
+func record(raid models.RAID, data []byte) []byte {
+	b := make([]byte, 12)
+	binary.LittleEndian.PutUint64(b, uint64(raid))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(data)))
+	return append(b, data...)
+}
+
+func TestActionBundle(t *testing.T) {
+	AAS := prepare.ActionSet{}
+	AAS.PlaySounds = make([]models.RAPlaySound, 2)
+	AAS.PlaySounds[0].SoundType = models.RAPlaySoundTypeText
+	AAS.PlaySounds[0].Val = "Hello world"
+	AAS.PlaySounds[1].SoundType = models.RAPlaySoundTypeAudio
+	AAS.PlaySounds[1].Val, _ = url.Parse("https://upload.wikimedia.org/wikipedia/commons/b/bb/Test_ogg_mp3_48kbps.wav")
+
+	actions, err := ActionBundle(prepare.BundleActions(AAS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []models.RequestAction{AAS.PlaySounds[0], AAS.PlaySounds[1]}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actions)
+	}
+
+	// Variable actions and zone changes are compiled from the actions, ahead of the play sounds,
+	// and speech and templates from text
+	variables := []prepare.RAVariable{
+		{Operation: prepare.VariableSet, ID: 1, Value: "gold"},
+		{Operation: prepare.VariableSet, ID: 2, Value: 1.5},
+		{Operation: prepare.VariableSet, ID: 3, Value: true},
+		{Operation: prepare.VariableIncrement, ID: 4, Value: 2.0},
+		{Operation: prepare.VariableDecrement, ID: 5, Value: 1.0},
+		{Operation: prepare.VariableToggle, ID: 6},
+	}
+	AAS = prepare.ActionSet{}
+	expected = []models.RequestAction{}
+	for _, action := range variables {
+		AAS.Actions = append(AAS.Actions, action)
+		expected = append(expected, action)
+	}
+	zone := prepare.RAChangeZone{}
+	zone.ZoneID[15] = 1
+	AAS.Actions = append(AAS.Actions, zone)
+	expected = append(expected, zone)
+	speech, _ := prepare.ParseSSML(`Wait <break time="1s"/>for it`)
+	AAS.PlaySounds = append(AAS.PlaySounds, models.RAPlaySound{SoundType: models.RAPlaySoundTypeText, Val: speech})
+	expected = append(expected, speech)
+	tokens, _ := prepare.ParseTemplate("{if gold}{gold} {gold|coin|coins}{else}Nothing{end}", func(string) (uint64, error) { return 1, nil })
+	template := prepare.RATemplate{Tokens: tokens}
+	AAS.PlaySounds = append(AAS.PlaySounds, models.RAPlaySound{SoundType: models.RAPlaySoundTypeText, Val: template})
+	expected = append(expected, template)
+	speechTemplate, _ := prepare.ParseSSMLTemplate(`You have <emphasis>{gold}</emphasis>{if gold}<break time="1s"/>{gold|coin|coins}{end}`, func(string) (uint64, error) { return 1, nil })
+	AAS.PlaySounds = append(AAS.PlaySounds, models.RAPlaySound{SoundType: models.RAPlaySoundTypeText, Val: speechTemplate})
+	expected = append(expected, speechTemplate)
+	bell, _ := url.Parse("https://example.com/bell.mp3")
+	variants := []prepare.RAVariants{
+		{Policy: prepare.VariantShuffle, Sounds: []models.RAPlaySound{
+			{SoundType: models.RAPlaySoundTypeText, Val: "Hello"},
+			{SoundType: models.RAPlaySoundTypeText, Val: speech},
+			{SoundType: models.RAPlaySoundTypeText, Val: template},
+			{SoundType: models.RAPlaySoundTypeText, Val: speechTemplate},
+		}},
+		{Policy: prepare.VariantRoundRobin, Sounds: []models.RAPlaySound{
+			{SoundType: models.RAPlaySoundTypeAudio, Val: bell},
+			{SoundType: models.RAPlaySoundTypeAudio, Val: bell},
+		}},
+	}
+	for _, action := range variants {
+		AAS.PlaySounds = append(AAS.PlaySounds, models.RAPlaySound{SoundType: action.Sounds[0].SoundType, Val: action})
+		expected = append(expected, action)
+	}
+	actions, err = ActionBundle(prepare.BundleActions(AAS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actions)
+	}
+
+	actions, err = ActionBundle(prepare.BundleActions(prepare.ActionSet{}))
+	if err != nil || len(actions) != 0 {
+		t.Errorf("expected an empty bundle to decode to no actions, got %v %v", actions, err)
+	}
+}
+
+func TestActionBundleInvalid(t *testing.T) {
+	bundles := map[string][]byte{
+		"unknown RAID":       record(999, []byte{0}),
+		"missing sound type": record(models.RAIDPlaySound, []byte{}),
+		"unknown sound type": record(models.RAIDPlaySound, []byte{200, 'a'}),
+		"invalid text":       record(models.RAIDPlaySound, []byte{byte(models.RAPlaySoundTypeText), 0xff}),
+		"relative URL":       record(models.RAIDPlaySound, append([]byte{byte(models.RAPlaySoundTypeAudio)}, "sounds/a.wav"...)),
+		"unknown operation":  record(prepare.RAIDVariable, []byte{9, 1, 0, 0, 0, 0, 0, 0, 0}),
+		"trailing bytes":     record(prepare.RAIDVariable, []byte{byte(prepare.VariableToggle), 1, 0, 0, 0, 0, 0, 0, 0, 0}),
+		"short zone ID":      record(prepare.RAIDChangeZone, []byte{1, 2, 3}),
+		"invalid speech":     record(prepare.RAIDSpeech, prepare.RASpeech{SSML: "<b>a</b>", Text: "a"}.Compile()),
+		"mismatched speech":  record(prepare.RAIDSpeech, prepare.RASpeech{SSML: "<speak>a</speak>", Text: "b"}.Compile()),
+		"unknown token kind": record(prepare.RAIDTemplate, []byte{1, 0, 9}),
+		"invalid speech template": record(prepare.RAIDSpeechTemplate, prepare.RASpeechTemplate{
+			SSML: []prepare.TemplateToken{{Kind: prepare.TemplateText, Text: "<b>a</b>"}},
+			Text: []prepare.TemplateToken{{Kind: prepare.TemplateText, Text: "a"}},
+		}.Compile()),
+		"mismatched speech template": record(prepare.RAIDSpeechTemplate, prepare.RASpeechTemplate{
+			SSML: []prepare.TemplateToken{{Kind: prepare.TemplateText, Text: "<speak>a</speak>"}},
+			Text: []prepare.TemplateToken{{Kind: prepare.TemplateText, Text: "b"}},
+		}.Compile()),
+		"truncated template": record(prepare.RAIDTemplate, []byte{1, 0, byte(prepare.TemplateIf), 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}),
+		"unknown policy":     record(prepare.RAIDVariants, []byte{9, 0, 0}),
+		"nested variants":    record(prepare.RAIDVariants, append([]byte{0, 1, 0}, record(prepare.RAIDVariants, []byte{0, 0, 0})...)),
+		"mixed variants":     record(prepare.RAIDVariants, append(append([]byte{0, 2, 0}, record(models.RAIDPlaySound, []byte{0, 'a'})...), record(models.RAIDPlaySound, append([]byte{1}, "https://example.com/a.mp3"...))...)),
+		"truncated record":   record(models.RAIDPlaySound, []byte{0, 'a'})[:13],
+	}
+	for name, bundle := range bundles {
+		_, err := ActionBundle(append(blob.Header(blob.KindActionBundle), bundle...))
+		if err == nil || !strings.HasPrefix(err.Error(), "decompile:") {
+			t.Errorf("%v: expected an error, got %v", name, err)
+		}
+	}
+
+	if _, err := ActionBundle(blob.Header(blob.KindTrigger)); err == nil {
+		t.Error("expected an error decoding a trigger as an action bundle")
+	}
+}
@@ -0,0 +1,109 @@
+package decompile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/talkative-ai/lakshmi/helpers"
+)
+
+// Dump renders a decoded logical block as readable pseudocode,
+// in the spirit of the example within the README
+//
+//	run <always exec key>
+//	if (#123 eq "bar" && #456 eq "world") || !(#789 gt 100)
+//		run <action bundle key>
+//	else
+//		run <action bundle key>
+//	random seeded by #12
+//	weight 9
+//		run <action bundle key>
+//	weight 1 if #789 gt 100
+//		run <action bundle key>
+func Dump(lblock *helpers.Block) string {
+	buf := &bytes.Buffer{}
+	dumpLogic(buf, lblock)
+	return buf.String()
+}
+
+// DumpNode renders a decoded dialog node as readable pseudocode
+func DumpNode(node *Node) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "continues %v\n", node.Continues)
+	dumpLogic(buf, &node.Logic)
+	return buf.String()
+}
+
+func dumpLogic(buf *bytes.Buffer, lblock *helpers.Block) {
+	if lblock.AlwaysExec != "" {
+		fmt.Fprintf(buf, "run %v\n", lblock.AlwaysExec)
+	}
+	for _, statements := range lblock.Statements {
+		isRandom := len(statements) > 0 && statements[0].Random != nil
+		if isRandom && statements[0].Random.Seeded {
+			fmt.Fprintf(buf, "random seeded by #%v\n", statements[0].Random.Seed)
+		} else if isRandom {
+			buf.WriteString("random\n")
+		}
+		for idx, stmt := range statements {
+			switch {
+			case isRandom && stmt.Condition == nil:
+				fmt.Fprintf(buf, "weight %v\n", stmt.Random.Weight)
+			case isRandom:
+				fmt.Fprintf(buf, "weight %v if %v\n", stmt.Random.Weight, DumpExpr(stmt.Condition))
+			case stmt.Condition == nil:
+				buf.WriteString("else\n")
+			case idx == 0:
+				fmt.Fprintf(buf, "if %v\n", DumpExpr(stmt.Condition))
+			default:
+				fmt.Fprintf(buf, "elif %v\n", DumpExpr(stmt.Condition))
+			}
+			if stmt.Exec == "" {
+				buf.WriteString("\tpass\n")
+			} else {
+				fmt.Fprintf(buf, "\trun %v\n", stmt.Exec)
+			}
+		}
+	}
+}
+
+// DumpExpr renders a condition expression tree
+func DumpExpr(expr helpers.Expr) string {
+	switch e := expr.(type) {
+	case helpers.ExprAnd:
+		return dumpExprList(e, " && ")
+	case helpers.ExprOr:
+		return dumpExprList(e, " || ")
+	case helpers.ExprNot:
+		return fmt.Sprintf("!(%v)", DumpExpr(e.Expr))
+	case helpers.ExprCompare:
+		return fmt.Sprintf("#%v %v %v", e.Var, e.Operator, dumpValue(e.Value))
+	case helpers.ExprCalc:
+		return fmt.Sprintf("%v %v %v", e.Left, e.Operator, e.Right)
+	}
+	return fmt.Sprintf("%v", expr)
+}
+
+func dumpExprList(exprs []helpers.Expr, separator string) string {
+	dumped := make([]string, len(exprs))
+	for i, expr := range exprs {
+		switch expr.(type) {
+		case helpers.ExprAnd, helpers.ExprOr:
+			dumped[i] = fmt.Sprintf("(%v)", DumpExpr(expr))
+		default:
+			dumped[i] = DumpExpr(expr)
+		}
+	}
+	return strings.Join(dumped, separator)
+}
+
+func dumpValue(val interface{}) string {
+	switch v := val.(type) {
+	case helpers.VarRef:
+		return v.String()
+	case helpers.Calc:
+		return v.String()
+	}
+	return fmt.Sprintf("%#v", val)
+}
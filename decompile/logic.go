@@ -0,0 +1,406 @@
+package decompile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/helpers"
+)
+
+// Node is the decoded form of a compiled dialog node
+// as written to Redis by helpers.DialogNode
+type Node struct {
+	// Continues is true when the dialog has child nodes to continue into
+	Continues bool
+	Logic     helpers.Block
+}
+
+// reader walks through a compiled byte slice,
+// failing cleanly when the data ends before it should
+type reader struct {
+	b   []byte
+	pos int
+}
+
+func (r *reader) next(n int) ([]byte, error) {
+	if r.pos+n > len(r.b) {
+		return nil, fmt.Errorf("decompile: unexpected end of data at offset %v, wanted %v more bytes", r.pos, n)
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) uint8() (uint8, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *reader) uint16() (uint16, error) {
+	b, err := r.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	b, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (r *reader) uint64() (uint64, error) {
+	b, err := r.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// string reads a uint16 length prefixed string
+func (r *reader) string() (string, error) {
+	l, err := r.uint16()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.next(int(l))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (r *reader) done() bool {
+	return r.pos >= len(r.b)
+}
+
+// DialogNode decodes a compiled dialog node
+// It is the inverse of helpers.DialogNode
+func DialogNode(b []byte) (*Node, error) {
+	payload, err := blob.Open(b, blob.KindDialogNode)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{b: payload}
+	flag, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	if flag > 1 {
+		return nil, fmt.Errorf("decompile: invalid continue flag %v", flag)
+	}
+	node := &Node{Continues: flag == 1}
+	if err := readLogic(r, &node.Logic); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Trigger decodes the compiled logical block of a trigger
+// as written by compile.Trigger
+func Trigger(b []byte) (*helpers.Block, error) {
+	payload, err := blob.Open(b, blob.KindTrigger)
+	if err != nil {
+		return nil, err
+	}
+	return Logic(payload)
+}
+
+// Logic decodes the output of helpers.CompileLogic back into a logical block
+// Conditions are decoded as the expression trees they were normalized into
+func Logic(b []byte) (*helpers.Block, error) {
+	lblock := &helpers.Block{}
+	if err := readLogic(&reader{b: b}, lblock); err != nil {
+		return nil, err
+	}
+	return lblock, nil
+}
+
+func readLogic(r *reader, lblock *helpers.Block) error {
+	keys, err := readKeyTable(r)
+	if err != nil {
+		return err
+	}
+	lblock.AlwaysExec, err = readKey(r, keys)
+	if err != nil {
+		return err
+	}
+
+	// A logical block without statements ends after the AlwaysExec key
+	if r.done() {
+		return nil
+	}
+
+	count, err := r.uint8()
+	if err != nil {
+		return err
+	}
+	lblock.Statements = make([][]helpers.Statement, count)
+	for i := range lblock.Statements {
+		lblock.Statements[i], err = readStatements(r, keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !r.done() {
+		return fmt.Errorf("decompile: %v trailing bytes after logical block", len(r.b)-r.pos)
+	}
+	return nil
+}
+
+// readKeyTable is the inverse of helpers.keyTable.compile
+func readKeyTable(r *reader) ([]string, error) {
+	prefix, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	count, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, count)
+	for i := range keys {
+		suffix, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = prefix + suffix
+	}
+	return keys, nil
+}
+
+// readKey reads the index of an action bundle key within the key table
+// Index 0 means there is no action bundle, which is the empty key
+func readKey(r *reader, keys []string) (string, error) {
+	idx, err := r.uint16()
+	if err != nil {
+		return "", err
+	}
+	if idx == 0 {
+		return "", nil
+	}
+	if int(idx) > len(keys) {
+		return "", fmt.Errorf("decompile: key index %v is beyond the %v keys in the table", idx, len(keys))
+	}
+	return keys[idx-1], nil
+}
+
+// readStatements is the inverse of helpers.compileStatements
+func readStatements(r *reader, keys []string) ([]helpers.Statement, error) {
+	kind, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	var random *helpers.Random
+	switch helpers.GroupKind(kind) {
+	case helpers.GroupKindFirst:
+	case helpers.GroupKindRandom:
+		random = &helpers.Random{}
+	case helpers.GroupKindRandomSeeded:
+		seed, err := r.uint64()
+		if err != nil {
+			return nil, err
+		}
+		random = &helpers.Random{Seeded: true, Seed: seed}
+	default:
+		return nil, fmt.Errorf("decompile: unknown statements kind %v", kind)
+	}
+
+	count, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	statements := make([]helpers.Statement, count)
+	for i := range statements {
+		statements[i], err = readStatement(r, keys)
+		if err != nil {
+			return nil, err
+		}
+		if random == nil {
+			continue
+		}
+		weight, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		statements[i].Random = &helpers.Random{Weight: weight, Seeded: random.Seeded, Seed: random.Seed}
+	}
+	return statements, nil
+}
+
+// readStatement is the inverse of helpers.compileStatement
+func readStatement(r *reader, keys []string) (helpers.Statement, error) {
+	stmt := helpers.Statement{}
+	var err error
+	stmt.Condition, err = readExpr(r)
+	if err != nil {
+		return stmt, err
+	}
+	stmt.Exec, err = readKey(r, keys)
+	return stmt, err
+}
+
+// readExpr is the inverse of helpers.compileHelper
+func readExpr(r *reader) (helpers.Expr, error) {
+	tag, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	switch helpers.ExprTag(tag) {
+	case helpers.ExprTagNone:
+		return nil, nil
+	case helpers.ExprTagAnd:
+		exprs, err := readExprList(r)
+		return helpers.ExprAnd(exprs), err
+	case helpers.ExprTagOr:
+		exprs, err := readExprList(r)
+		return helpers.ExprOr(exprs), err
+	case helpers.ExprTagNot:
+		expr, err := readExpr(r)
+		if err == nil && expr == nil {
+			return nil, fmt.Errorf("decompile: not without an expression at offset %v", r.pos-1)
+		}
+		return helpers.ExprNot{Expr: expr}, err
+	case helpers.ExprTagCompare:
+		return readCompare(r)
+	case helpers.ExprTagCalc:
+		return readCalcCompare(r)
+	}
+	return nil, fmt.Errorf("decompile: unknown expression tag %v at offset %v", tag, r.pos-1)
+}
+
+func readExprList(r *reader) ([]helpers.Expr, error) {
+	count, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	exprs := make([]helpers.Expr, count)
+	for i := range exprs {
+		exprs[i], err = readExpr(r)
+		if err != nil {
+			return nil, err
+		}
+		if exprs[i] == nil {
+			return nil, fmt.Errorf("decompile: empty expression at offset %v", r.pos-1)
+		}
+	}
+	return exprs, nil
+}
+
+func operatorIntStrMap() map[uint8]string {
+	operators := map[uint8]string{}
+	for str, op := range helpers.GenerateOperatorStrIntMap() {
+		operators[op] = str
+	}
+	return operators
+}
+
+func readCompare(r *reader) (helpers.Expr, error) {
+	op, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	operator, ok := operatorIntStrMap()[op]
+	if !ok {
+		return nil, fmt.Errorf("decompile: unknown operator %v at offset %v", op, r.pos-1)
+	}
+	vr, err := r.uint64()
+	if err != nil {
+		return nil, err
+	}
+	val, err := readValue(r)
+	if err != nil {
+		return nil, err
+	}
+	return helpers.ExprCompare{Operator: operator, Var: vr, Value: val}, nil
+}
+
+func readCalcCompare(r *reader) (helpers.Expr, error) {
+	op, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	operator, ok := operatorIntStrMap()[op]
+	if !ok {
+		return nil, fmt.Errorf("decompile: unknown operator %v at offset %v", op, r.pos-1)
+	}
+	left, err := readCalc(r)
+	if err != nil {
+		return nil, err
+	}
+	right, err := readCalc(r)
+	if err != nil {
+		return nil, err
+	}
+	return helpers.ExprCalc{Operator: operator, Left: left, Right: right}, nil
+}
+
+// readCalc reads a uint16 length prefixed Calc program
+func readCalc(r *reader) (helpers.Calc, error) {
+	l, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	program, err := r.next(int(l))
+	if err != nil {
+		return nil, err
+	}
+	c, err := helpers.DecodeCalc(program)
+	if err != nil {
+		return nil, fmt.Errorf("decompile: %v at offset %v", err, r.pos-int(l))
+	}
+	return c, nil
+}
+
+func readValue(r *reader) (interface{}, error) {
+	vt, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	switch helpers.ValueType(vt) {
+	case helpers.ValueTypeString:
+		return r.string()
+	case helpers.ValueTypeInt:
+		v, err := r.uint32()
+		return int(int32(v)), err
+	case helpers.ValueTypeFloat:
+		v, err := r.uint64()
+		return math.Float64frombits(v), err
+	case helpers.ValueTypeBool:
+		v, err := r.uint8()
+		if err == nil && v > 1 {
+			return nil, fmt.Errorf("decompile: invalid boolean %v at offset %v", v, r.pos-1)
+		}
+		return v == 1, err
+	case helpers.ValueTypeNull:
+		return nil, nil
+	case helpers.ValueTypeVar:
+		v, err := r.uint64()
+		return helpers.VarRef(v), err
+	case helpers.ValueTypeList:
+		count, err := r.uint8()
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, count)
+		for i := range list {
+			list[i], err = readValue(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case helpers.ValueTypeCalc:
+		return readCalc(r)
+	}
+	return nil, fmt.Errorf("decompile: unknown value type %v at offset %v", vt, r.pos-1)
+}
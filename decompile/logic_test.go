@@ -0,0 +1,221 @@
+package decompile
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+func compileLogic(t *testing.T, lblock *models.LBlock) []byte {
+	compiled, err := helpers.CompileLogic(lblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compiled
+}
+
+func TestLogicRoundTrip(t *testing.T) {
+	blocks := map[string]models.LBlock{
+		"always only": {
+			AlwaysExec: "compiled:pub:bundle:0",
+		},
+		"if elif else": {
+			AlwaysExec: "compiled:pub:bundle:0",
+			Statements: &[][]models.LStatement{
+				{
+					{
+						Operators: &models.OrGroup{
+							{
+								"eq": {123: "bar", 456: "world"},
+								"gt": {789: 100},
+							},
+						},
+						Exec: "compiled:pub:bundle:1",
+					},
+					{
+						Operators: &models.OrGroup{
+							{"eq": {321: "foo", 654: "hello"}},
+							{"lte": {1231: -100}},
+						},
+						Exec: "compiled:pub:bundle:2",
+					},
+					{
+						Exec: "compiled:pub:bundle:3",
+					},
+				},
+				{
+					{
+						Operators: &models.OrGroup{{"ne": {1: ""}}},
+						Exec:      "compiled:pub:bundle:4",
+					},
+					{
+						Operators: &models.OrGroup{
+							{
+								"gt":    {2: 0.5},
+								"eq":    {3: true, 4: false, 5: nil},
+								"lt":    {6: helpers.VarRef(7)},
+								"in":    {8: []interface{}{"a", 1.0}},
+								"regex": {9: "^a+$"},
+							},
+						},
+						Exec: "compiled:pub:bundle:5",
+					},
+				},
+			},
+		},
+	}
+
+	for name, lblock := range blocks {
+		expected, err := helpers.NormalizeLBlock(&lblock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Logic(compileLogic(t, &lblock))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Errorf("%v: round trip mismatch\n%v\n%v", name, Dump(expected), Dump(decoded))
+		}
+	}
+
+	// Random groups are only written by lakshmi, so their block is built as it normalizes
+	random := helpers.Block{
+		AlwaysExec: "compiled:pub:bundle:0",
+		Statements: [][]helpers.Statement{
+			{
+				{Exec: "compiled:pub:bundle:1", Random: &helpers.Random{Weight: 9}},
+				{Condition: helpers.ExprCompare{Operator: "eq", Var: 2, Value: "rare"}, Exec: "compiled:pub:bundle:2", Random: &helpers.Random{Weight: 1}},
+			},
+			{
+				{Exec: "compiled:pub:bundle:3", Random: &helpers.Random{Weight: 1, Seeded: true, Seed: 12}},
+				{Exec: "compiled:pub:bundle:4", Random: &helpers.Random{Weight: 2, Seeded: true, Seed: 12}},
+			},
+			{
+				{Exec: "compiled:pub:bundle:5", Random: &helpers.Random{Weight: 1, Seeded: true}},
+				{Exec: "compiled:pub:bundle:6", Random: &helpers.Random{Weight: 3, Seeded: true}},
+			},
+		},
+	}
+	compiled, err := helpers.CompileBlock(&random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Logic(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, &random) {
+		t.Errorf("random: round trip mismatch\n%v\n%v", Dump(&random), Dump(decoded))
+	}
+}
+
+func TestDialogNode(t *testing.T) {
+	lblock := models.LBlock{
+		AlwaysExec: "compiled:pub:bundle:0",
+		Statements: &[][]models.LStatement{
+			{
+				{Operators: &models.OrGroup{{"eq": {1: 1}}}, Exec: "compiled:pub:bundle:1"},
+				{Exec: "compiled:pub:bundle:2"},
+			},
+		},
+	}
+	compiled := append(blob.Header(blob.KindDialogNode), 1)
+	node, err := DialogNode(append(compiled, compileLogic(t, &lblock)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := helpers.NormalizeLBlock(&lblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.Continues || !reflect.DeepEqual(node.Logic, *expected) {
+		t.Errorf("unexpected node\n%v", DumpNode(node))
+	}
+
+	expectedDump := "continues true\nrun compiled:pub:bundle:0\nif #1 eq 1\n\trun compiled:pub:bundle:1\nelse\n\trun compiled:pub:bundle:2\n"
+	if DumpNode(node) != expectedDump {
+		t.Errorf("unexpected dump\n%v", DumpNode(node))
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	lblock := models.LBlock{
+		AlwaysExec: "compiled:pub:bundle:0",
+		Statements: &[][]models.LStatement{
+			{{Operators: &models.OrGroup{{"eq": {1: "value"}}}, Exec: "compiled:pub:bundle:1"}},
+		},
+	}
+	compiled := compileLogic(t, &lblock)
+	// Cutting the data right after the AlwaysExec key index is a valid block without statements
+	// The key table is the shared prefix "compiled:pub:bundle:", the key count and the suffixes "0" and "1"
+	keyTable := 2 + len("compiled:pub:bundle:") + 2 + 2*(2+1)
+	for i := keyTable + 2 + 1; i < len(compiled); i++ {
+		_, err := Logic(compiled[:i])
+		if err == nil || !strings.HasPrefix(err.Error(), "decompile:") {
+			t.Errorf("expected an error decoding %v of %v bytes, got %v", i, len(compiled), err)
+		}
+	}
+}
+
+func TestUnsupportedValue(t *testing.T) {
+	lblock := models.LBlock{
+		AlwaysExec: "compiled:pub:bundle:0",
+		Statements: &[][]models.LStatement{
+			{{Operators: &models.OrGroup{{"eq": {1: []string{"a"}}}}, Exec: "compiled:pub:bundle:1"}},
+		},
+	}
+	if _, err := helpers.CompileLogic(&lblock); err == nil {
+		t.Error("expected an error compiling an unsupported value")
+	}
+}
+
+func TestExpr(t *testing.T) {
+	// a && (b || !c), written as the Condition of the statement
+	stmt := prepare.RawLStatement{}
+	err := json.Unmarshal([]byte(`{
+		"Condition": {"and": [
+			{"eq": {"1": true}},
+			{"or": [{"gt": {"2": 3}}, {"not": {"eq": {"3": "x"}}}]}
+		]}
+	}`), &stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition, _, err := helpers.StatementCondition(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := helpers.CompileBlock(&helpers.Block{
+		AlwaysExec: "compiled:pub:bundle:0",
+		Statements: [][]helpers.Statement{{{Condition: condition, Exec: "compiled:pub:bundle:1"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Logic(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := helpers.ExprAnd{
+		helpers.ExprCompare{Operator: "eq", Var: 1, Value: true},
+		helpers.ExprOr{
+			helpers.ExprCompare{Operator: "gt", Var: 2, Value: 3.0},
+			helpers.ExprNot{Expr: helpers.ExprCompare{Operator: "eq", Var: 3, Value: "x"}},
+		},
+	}
+	if !reflect.DeepEqual(decoded.Statements[0][0].Condition, expected) {
+		t.Errorf("unexpected expression %v", DumpExpr(decoded.Statements[0][0].Condition))
+	}
+	if DumpExpr(expected) != `#1 eq true && (#2 gt 3 || !(#3 eq "x"))` {
+		t.Errorf("unexpected dump %v", DumpExpr(expected))
+	}
+}
@@ -0,0 +1,90 @@
+package decompile
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/helpers"
+)
+
+// Verify decodes every compiled blob of a publish, mapped by the key it was read from,
+// and checks that every action bundle referred to by a logical block is among them.
+// kinds maps the keys which must hold a blob, such as those of the compiled dialog nodes and triggers,
+// to the kind they must hold, so a bad header there is a problem, as is one under a key referred to as an action bundle.
+// Other values which aren't lakshmi blobs, such as metadata, are skipped.
+// It returns every problem found, in key order.
+func Verify(blobs map[string][]byte, kinds map[string]blob.Kind) []error {
+	keys := make([]string, 0, len(blobs))
+	for key := range blobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problems := []error{}
+	for _, key := range keys {
+		_, kind, _, err := blob.Read(blobs[key])
+		if expected, ok := kinds[key]; ok {
+			if err == nil && kind != expected {
+				err = fmt.Errorf("expected a %v but found a %v", expected, kind)
+			}
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%v: %v", key, err))
+				continue
+			}
+		}
+		if err != nil {
+			continue
+		}
+
+		var lblock *helpers.Block
+		switch kind {
+		case blob.KindDialogNode:
+			var node *Node
+			if node, err = DialogNode(blobs[key]); err == nil {
+				lblock = &node.Logic
+			}
+		case blob.KindTrigger:
+			lblock, err = Trigger(blobs[key])
+		case blob.KindActionBundle:
+			_, err = ActionBundle(blobs[key])
+		default:
+			err = fmt.Errorf("unknown blob kind %v", kind)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%v: %v", key, err))
+			continue
+		}
+		if lblock == nil {
+			continue
+		}
+
+		for _, bundle := range bundleKeys(lblock) {
+			b, ok := blobs[bundle]
+			if !ok {
+				problems = append(problems, fmt.Errorf("%v: action bundle %v was not stored", key, bundle))
+				continue
+			}
+			if _, kind, _, err := blob.Read(b); err != nil || kind != blob.KindActionBundle {
+				problems = append(problems, fmt.Errorf("%v: action bundle %v does not hold an action bundle", key, bundle))
+			}
+		}
+	}
+	return problems
+}
+
+// bundleKeys returns the action bundle keys a logical block refers to
+func bundleKeys(lblock *helpers.Block) []string {
+	keys := []string{}
+	if lblock.AlwaysExec != "" {
+		keys = append(keys, lblock.AlwaysExec)
+	}
+	for _, statements := range lblock.Statements {
+		for _, stmt := range statements {
+			if stmt.Exec != "" {
+				keys = append(keys, stmt.Exec)
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,67 @@
+package decompile
+
+import (
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+func TestVerify(t *testing.T) {
+	lblock := models.LBlock{
+		AlwaysExec: "bundle:0",
+		Statements: &[][]models.LStatement{
+			{{Operators: &models.OrGroup{{"eq": {1: 1}}}, Exec: "bundle:1"}},
+		},
+	}
+	node := append(blob.Header(blob.KindDialogNode), 0)
+	node = append(node, compileLogic(t, &lblock)...)
+	bundle := prepare.BundleActions(prepare.ActionSet{PlaySounds: []models.RAPlaySound{{Val: "Hi"}}})
+
+	blobs := map[string][]byte{
+		"node":     node,
+		"bundle:0": bundle,
+		"bundle:1": bundle,
+		"metadata": []byte("not a blob"),
+	}
+	kinds := map[string]blob.Kind{"node": blob.KindDialogNode}
+	if problems := Verify(blobs, kinds); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	delete(blobs, "bundle:1")
+	blobs["broken"] = append(blob.Header(blob.KindActionBundle), 1)
+	problems := Verify(blobs, kinds)
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", problems)
+	}
+	if problems[0].Error() != "broken: decompile: unexpected end of data at offset 0, wanted 8 more bytes" {
+		t.Errorf("unexpected problem %v", problems[0])
+	}
+	if problems[1].Error() != "node: action bundle bundle:1 was not stored" {
+		t.Errorf("unexpected problem %v", problems[1])
+	}
+
+	// Keys which must hold blobs report a bad header rather than being skipped,
+	// as do the action bundles a logical block refers to
+	blobs["bundle:1"] = []byte("not a blob")
+	delete(blobs, "broken")
+	blobs["trigger"] = bundle
+	kinds["trigger"] = blob.KindTrigger
+	kinds["metadata"] = blob.KindActionBundle
+	problems = Verify(blobs, kinds)
+	expected := []string{
+		"metadata: blob: missing header",
+		"node: action bundle bundle:1 does not hold an action bundle",
+		"trigger: expected a trigger but found a action bundle",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %v problems, got %v", len(expected), problems)
+	}
+	for idx, problem := range problems {
+		if problem.Error() != expected[idx] {
+			t.Errorf("expected %q, got %q", expected[idx], problem)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package evaluate
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"regexp"
+	"strings"
+
+	"github.com/talkative-ai/lakshmi/decompile"
+	"github.com/talkative-ai/lakshmi/helpers"
+)
+
+// Logic takes the output of helpers.CompileLogic and the runtime variable state,
+// and returns the action bundle keys that would execute, in order.
+//
+// The AlwaysExec bundle runs first. Then for every []Statement group,
+// the first statement whose condition resolves to true runs, and the rest
+// of the group is skipped. A statement without a condition is an "else" and always runs.
+//
+// Note that the runtime mutates the state as each bundle executes,
+// whereas here the state is treated as fixed for the whole block.
+func Logic(b []byte, state map[uint64]interface{}) ([]string, error) {
+	lblock, err := decompile.Logic(b)
+	if err != nil {
+		return nil, err
+	}
+	return Block(lblock, state), nil
+}
+
+// Block evaluates an already decoded logical block. See Logic
+func Block(lblock *helpers.Block, state map[uint64]interface{}) []string {
+	keys := []string{}
+	if lblock.AlwaysExec != "" {
+		keys = append(keys, lblock.AlwaysExec)
+	}
+	for _, statements := range lblock.Statements {
+		if len(statements) > 0 && statements[0].Random != nil {
+			if key := Random(statements, state); key != "" {
+				keys = append(keys, key)
+			}
+			continue
+		}
+		for _, stmt := range statements {
+			if stmt.Condition == nil || Expr(stmt.Condition, state) {
+				// An empty key runs nothing, but still ends the group
+				if stmt.Exec != "" {
+					keys = append(keys, stmt.Exec)
+				}
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// Random picks the statement to run within a random group, returning its Exec key
+// Only the statements whose conditions are true take part, each in proportion to its weight.
+//
+// The pick is made by a roll from 0 up to the total weight of those statements,
+// running the statement whose share of the total contains the roll.
+// Without a seed the roll is random. With a seed variable the roll is its value modulo the total,
+// where a number is truncated to an integer, a string is hashed with 64 bit FNV-1a,
+// true is 1, and false or an unset variable is 0.
+// A seed such as a visit counter therefore steps through the statements in turn.
+func Random(statements []helpers.Statement, state map[uint64]interface{}) string {
+	eligible := []helpers.Statement{}
+	total := uint64(0)
+	for _, stmt := range statements {
+		if stmt.Condition == nil || Expr(stmt.Condition, state) {
+			eligible = append(eligible, stmt)
+			total += uint64(stmt.Random.Weight)
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+
+	var roll uint64
+	if random := statements[0].Random; random.Seeded {
+		roll = seedValue(state[random.Seed]) % total
+	} else {
+		roll = uint64(rand.Int63n(int64(total)))
+	}
+	for _, stmt := range eligible {
+		if roll < uint64(stmt.Random.Weight) {
+			return stmt.Exec
+		}
+		roll -= uint64(stmt.Random.Weight)
+	}
+	return ""
+}
+
+// seedValue converts the value of a seed variable into a roll. See Random
+func seedValue(val interface{}) uint64 {
+	if n, ok := number(val); ok {
+		return uint64(int64(n))
+	}
+	switch v := val.(type) {
+	case string:
+		hash := fnv.New64a()
+		hash.Write([]byte(v))
+		return hash.Sum64()
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Expr resolves a condition expression tree against the variable state
+// An empty and is true, whereas an empty or is false.
+func Expr(expr helpers.Expr, state map[uint64]interface{}) bool {
+	switch e := expr.(type) {
+	case helpers.ExprAnd:
+		for _, child := range e {
+			if !Expr(child, state) {
+				return false
+			}
+		}
+		return true
+	case helpers.ExprOr:
+		for _, child := range e {
+			if Expr(child, state) {
+				return true
+			}
+		}
+		return false
+	case helpers.ExprNot:
+		return !Expr(e.Expr, state)
+	case helpers.ExprCompare:
+		val := e.Value
+		// A variable reference compares against the other variable's current value
+		// and like any unset variable, an unset reference never satisfies a comparison
+		if ref, ok := val.(helpers.VarRef); ok {
+			if val = state[uint64(ref)]; val == nil {
+				return false
+			}
+		}
+		if c, ok := val.(helpers.Calc); ok {
+			n, ok := Calc(c, state)
+			if !ok {
+				return false
+			}
+			val = n
+		}
+		return Compare(e.Operator, state[e.Var], val)
+	case helpers.ExprCalc:
+		left, ok := Calc(e.Left, state)
+		if !ok {
+			return false
+		}
+		right, ok := Calc(e.Right, state)
+		if !ok {
+			return false
+		}
+		return Compare(e.Operator, left, right)
+	}
+	return false
+}
+
+// Calc computes an arithmetic expression against the variable state
+// It fails when a variable is unset or not a number, or on division by zero.
+// Modulo follows math.Mod, so the result takes the sign of the dividend.
+func Calc(c helpers.Calc, state map[uint64]interface{}) (float64, bool) {
+	switch v := c.(type) {
+	case helpers.CalcNumber:
+		return float64(v), true
+	case helpers.CalcVar:
+		return number(state[uint64(v)])
+	case helpers.CalcNeg:
+		n, ok := Calc(v.Calc, state)
+		return -n, ok
+	case helpers.CalcBinary:
+		a, ok := Calc(v.Left, state)
+		if !ok {
+			return 0, false
+		}
+		b, ok := Calc(v.Right, state)
+		if !ok {
+			return 0, false
+		}
+		switch v.Op {
+		case '+':
+			return a + b, true
+		case '-':
+			return a - b, true
+		case '*':
+			return a * b, true
+		case '/':
+			return a / b, b != 0
+		case '%':
+			return math.Mod(a, b), b != 0
+		}
+	}
+	return 0, false
+}
+
+// Compare applies the operator to a variable's current value and the compiled value.
+// A null value is only equal to an unset variable,
+// and otherwise an unset variable never satisfies a comparison.
+// Values of different kinds are never equal and cannot be ordered,
+// and booleans can only be tested for equality.
+// The string operators only apply to strings, and "in" is true
+// when the variable equals any item in the list.
+func Compare(operator string, current, val interface{}) bool {
+	switch operator {
+	case "in":
+		list, _ := val.([]interface{})
+		for _, item := range list {
+			if Compare("eq", current, item) {
+				return true
+			}
+		}
+		return false
+	case "contains", "startswith", "endswith", "ieq", "regex":
+		a, ok := current.(string)
+		if !ok {
+			return false
+		}
+		b, ok := val.(string)
+		if !ok {
+			return false
+		}
+		switch operator {
+		case "contains":
+			return strings.Contains(a, b)
+		case "startswith":
+			return strings.HasPrefix(a, b)
+		case "endswith":
+			return strings.HasSuffix(a, b)
+		case "ieq":
+			return strings.EqualFold(a, b)
+		}
+		matched, err := regexp.MatchString(b, a)
+		return err == nil && matched
+	}
+
+	if val == nil {
+		switch operator {
+		case "eq":
+			return current == nil
+		case "ne":
+			return current != nil
+		}
+		return false
+	}
+	if current == nil {
+		return false
+	}
+
+	if a, ok := current.(bool); ok {
+		b, ok := val.(bool)
+		switch operator {
+		case "eq":
+			return ok && a == b
+		case "ne":
+			return !ok || a != b
+		}
+		return false
+	}
+
+	var cmp int
+	if a, ok := number(current); ok {
+		b, ok := number(val)
+		if !ok {
+			return operator == "ne"
+		}
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else if a, ok := current.(string); ok {
+		b, ok := val.(string)
+		if !ok {
+			return operator == "ne"
+		}
+		cmp = strings.Compare(a, b)
+	} else {
+		return false
+	}
+
+	switch operator {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "lt":
+		return cmp < 0
+	case "gt":
+		return cmp > 0
+	case "lte":
+		return cmp <= 0
+	case "gte":
+		return cmp >= 0
+	}
+	return false
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,298 @@
+package evaluate
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// readmeBlock is the example logical block from the README
+var readmeBlock = models.LBlock{
+	AlwaysExec: "bundle:4",
+	Statements: &[][]models.LStatement{
+		{
+			{
+				Operators: &models.OrGroup{
+					{"eq": {123: "bar", 456: "world"}},
+					{"gt": {789: 100}},
+				},
+				Exec: "bundle:1000",
+			},
+			{
+				Operators: &models.OrGroup{
+					{
+						"eq":  {321: "foo", 654: "hello"},
+						"lte": {789: 100},
+					},
+				},
+				Exec: "bundle:2000",
+			},
+			{
+				Exec: "bundle:3000",
+			},
+		},
+	},
+}
+
+func TestLogic(t *testing.T) {
+	compiled, err := helpers.CompileLogic(&readmeBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		state    map[uint64]interface{}
+		expected []string
+	}{
+		{
+			state:    map[uint64]interface{}{123: "bar", 456: "world"},
+			expected: []string{"bundle:4", "bundle:1000"},
+		},
+		{
+			state:    map[uint64]interface{}{123: "bar", 456: "moon", 789: 101},
+			expected: []string{"bundle:4", "bundle:1000"},
+		},
+		{
+			state:    map[uint64]interface{}{321: "foo", 654: "hello", 789: 100},
+			expected: []string{"bundle:4", "bundle:2000"},
+		},
+		{
+			state:    map[uint64]interface{}{321: "foo", 654: "hello"},
+			expected: []string{"bundle:4", "bundle:3000"},
+		},
+		{
+			state:    map[uint64]interface{}{},
+			expected: []string{"bundle:4", "bundle:3000"},
+		},
+	}
+
+	for _, test := range tests {
+		keys, err := Logic(compiled, test.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("state %v: expected %v, got %v", test.state, test.expected, keys)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		operator string
+		current  interface{}
+		val      interface{}
+		expected bool
+	}{
+		{"eq", 1, 1, true},
+		{"eq", 1.0, 1, true},
+		{"ne", 1, "1", true},
+		{"eq", 1, "1", false},
+		{"lt", "a", "b", true},
+		{"gte", 2, 3, false},
+		{"eq", nil, 0, false},
+		{"ne", nil, 0, false},
+		{"gt", 0.75, 0.5, true},
+		{"eq", true, true, true},
+		{"ne", true, false, true},
+		{"lt", false, true, false},
+		{"eq", nil, nil, true},
+		{"ne", "", nil, true},
+		{"contains", "Sir Lancelot", "Lance", true},
+		{"startswith", "Sir Lancelot", "Sir", true},
+		{"endswith", "Sir Lancelot", "Sir", false},
+		{"ieq", "ARTHUR", "arthur", true},
+		{"regex", "blue. no, yellow", "^blue", true},
+		{"regex", "yellow", "^blue", false},
+		{"in", "swallow", []interface{}{"coconut", "swallow"}, true},
+		{"in", 3, []interface{}{1.0, 2.0}, false},
+		{"contains", 12, "1", false},
+	}
+	for _, test := range tests {
+		if Compare(test.operator, test.current, test.val) != test.expected {
+			t.Errorf("%v %v %v: expected %v", test.current, test.operator, test.val, test.expected)
+		}
+	}
+}
+
+func TestVariableReference(t *testing.T) {
+	lblock := models.LBlock{
+		AlwaysExec: "bundle:0",
+		Statements: &[][]models.LStatement{
+			{
+				{
+					// gold >= price, as written within project JSON
+					Operators: &models.OrGroup{{"gte": {1: map[string]interface{}{"var": float64(2)}}}},
+					Exec:      "bundle:buy",
+				},
+				{
+					Exec: "bundle:too_poor",
+				},
+			},
+		},
+	}
+	compiled, err := helpers.CompileLogic(&lblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		state    map[uint64]interface{}
+		expected string
+	}{
+		{map[uint64]interface{}{1: 10.0, 2: 5.0}, "bundle:buy"},
+		{map[uint64]interface{}{1: 5, 2: 5}, "bundle:buy"},
+		{map[uint64]interface{}{1: 4, 2: 5}, "bundle:too_poor"},
+		{map[uint64]interface{}{1: 4}, "bundle:too_poor"},
+	}
+	for _, test := range tests {
+		keys, err := Logic(compiled, test.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys[len(keys)-1] != test.expected {
+			t.Errorf("state %v: expected %v, got %v", test.state, test.expected, keys)
+		}
+	}
+}
+
+func TestExpr(t *testing.T) {
+	// a && (b || !c)
+	expr := helpers.ExprAnd{
+		helpers.ExprCompare{Operator: "eq", Var: 1, Value: true},
+		helpers.ExprOr{
+			helpers.ExprCompare{Operator: "eq", Var: 2, Value: true},
+			helpers.ExprNot{Expr: helpers.ExprCompare{Operator: "eq", Var: 3, Value: true}},
+		},
+	}
+	tests := []struct {
+		state    map[uint64]interface{}
+		expected bool
+	}{
+		{map[uint64]interface{}{1: true, 2: true, 3: true}, true},
+		{map[uint64]interface{}{1: true, 2: false, 3: false}, true},
+		{map[uint64]interface{}{1: true, 2: false, 3: true}, false},
+		{map[uint64]interface{}{1: false, 2: true}, false},
+	}
+	for _, test := range tests {
+		if Expr(expr, test.state) != test.expected {
+			t.Errorf("state %v: expected %v", test.state, test.expected)
+		}
+	}
+}
+
+func TestCalc(t *testing.T) {
+	stmt := prepare.RawLStatement{}
+	err := json.Unmarshal([]byte(`{
+		"Operators": [{"lt": {"4": {"calc": "#1 * 2"}}}],
+		"Condition": {"or": [
+			{"calc": "#1 + #2 > 10"},
+			{"calc": "#3 % 3 == 0"}
+		]}
+	}`), &stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition, _, err := helpers.StatementCondition(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := helpers.CompileBlock(&helpers.Block{
+		AlwaysExec: "bundle:0",
+		Statements: [][]helpers.Statement{{{Condition: condition, Exec: "bundle:1"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		state    map[uint64]interface{}
+		expected int
+	}{
+		{map[uint64]interface{}{1: 6.0, 2: 5.0, 3: 1.0, 4: 0.0}, 2},
+		{map[uint64]interface{}{1: 1.0, 2: 2.0, 3: 6.0, 4: 0.0}, 2},
+		{map[uint64]interface{}{1: 1.0, 2: 2.0, 3: 4.0, 4: 0.0}, 1},
+		{map[uint64]interface{}{1: 6.0, 2: 5.0, 3: 1.0, 4: 12.0}, 1},
+		{map[uint64]interface{}{1: 6.0, 3: 3.0}, 1},
+	}
+	for _, test := range tests {
+		keys, err := Logic(compiled, test.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != test.expected {
+			t.Errorf("state %v: expected %v bundles, got %v", test.state, test.expected, keys)
+		}
+	}
+}
+
+func TestRandom(t *testing.T) {
+	block := helpers.Block{
+		AlwaysExec: "bundle:0",
+		Statements: [][]helpers.Statement{
+			{
+				{Exec: "bundle:common", Random: &helpers.Random{Weight: 2, Seeded: true, Seed: 1}},
+				{Condition: helpers.ExprCompare{Operator: "eq", Var: 2, Value: true}, Exec: "bundle:rare", Random: &helpers.Random{Weight: 1, Seeded: true, Seed: 1}},
+			},
+		},
+	}
+	compiled, err := helpers.CompileBlock(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seeded by a visit counter, the statements take turns by weight
+	tests := []struct {
+		state    map[uint64]interface{}
+		expected string
+	}{
+		{map[uint64]interface{}{1: 0.0, 2: true}, "bundle:common"},
+		{map[uint64]interface{}{1: 1.0, 2: true}, "bundle:common"},
+		{map[uint64]interface{}{1: 2.0, 2: true}, "bundle:rare"},
+		{map[uint64]interface{}{1: 3.0, 2: true}, "bundle:common"},
+		// The rare statement only takes part when its condition is true
+		{map[uint64]interface{}{1: 2.0}, "bundle:common"},
+	}
+	for _, test := range tests {
+		keys, err := Logic(compiled, test.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 || keys[1] != test.expected {
+			t.Errorf("state %v: expected %v, got %v", test.state, test.expected, keys)
+		}
+	}
+
+	// Variable 0 may be a seed as well as any other
+	zero := helpers.Block{Statements: [][]helpers.Statement{{
+		{Exec: "bundle:a", Random: &helpers.Random{Weight: 1, Seeded: true}},
+		{Exec: "bundle:b", Random: &helpers.Random{Weight: 1, Seeded: true}},
+	}}}
+	compiled, err = helpers.CompileBlock(&zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seed, expected := range []string{"bundle:a", "bundle:b", "bundle:a"} {
+		keys, err := Logic(compiled, map[uint64]interface{}{0: float64(seed)})
+		if err != nil || len(keys) != 1 || keys[0] != expected {
+			t.Errorf("seed %v: expected %v, got %v %v", seed, expected, keys, err)
+		}
+	}
+
+	// Without a seed, every statement is picked at some point
+	unseeded := helpers.Block{Statements: [][]helpers.Statement{{
+		{Exec: "a", Random: &helpers.Random{Weight: 1}},
+		{Exec: "b", Random: &helpers.Random{Weight: 1}},
+	}}}
+	picked := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		picked[Block(&unseeded, nil)[0]] = true
+	}
+	if !picked["a"] || !picked["b"] {
+		t.Errorf("expected both statements to be picked, got %v", picked)
+	}
+}
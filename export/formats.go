@@ -0,0 +1,146 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// xliffNamespace is the namespace of XLIFF 2.0 documents
+const xliffNamespace = "urn:oasis:names:tc:xliff:document:2.0"
+
+type xliffDocument struct {
+	XMLName xml.Name    `xml:"urn:oasis:names:tc:xliff:document:2.0 xliff"`
+	Version string      `xml:"version,attr"`
+	SrcLang string      `xml:"srcLang,attr"`
+	TrgLang string      `xml:"trgLang,attr,omitempty"`
+	Files   []xliffFile `xml:"file"`
+}
+
+type xliffFile struct {
+	ID    string      `xml:"id,attr"`
+	Units []xliffUnit `xml:"unit"`
+}
+
+type xliffUnit struct {
+	ID       string         `xml:"id,attr"`
+	Space    string         `xml:"http://www.w3.org/XML/1998/namespace space,attr,omitempty"`
+	Notes    []string       `xml:"notes>note,omitempty"`
+	Segments []xliffSegment `xml:"segment"`
+}
+
+type xliffSegment struct {
+	State  string `xml:"state,attr,omitempty"`
+	Source string `xml:"source"`
+	Target string `xml:"target,omitempty"`
+}
+
+// XLIFF writes units as an XLIFF 2.0 document of a single file
+// Translated units are in the translated state, and the rest in the initial state.
+func XLIFF(units []Unit, file string, sourceLocale string, targetLocale string) ([]byte, error) {
+	doc := xliffDocument{
+		Version: "2.0",
+		SrcLang: sourceLocale,
+		TrgLang: targetLocale,
+		Files:   []xliffFile{{ID: file, Units: []xliffUnit{}}},
+	}
+	for _, unit := range units {
+		segment := xliffSegment{State: "initial", Source: unit.Source, Target: unit.Target}
+		if unit.Target != "" {
+			segment.State = "translated"
+		}
+		u := xliffUnit{ID: unit.ID, Segments: []xliffSegment{segment}}
+		if strings.Contains(unit.Source, "\n") {
+			u.Space = "preserve"
+		}
+		if unit.Note != "" {
+			u.Notes = []string{unit.Note}
+		}
+		doc.Files[0].Units = append(doc.Files[0].Units, u)
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// ReadXLIFF reads the units of an XLIFF 2.0 document, along with its target locale if it has one
+// The segments of a unit are joined, and markup within the source or target is dropped.
+func ReadXLIFF(data []byte) (string, []Unit, error) {
+	doc := xliffDocument{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return "", nil, fmt.Errorf("invalid XLIFF: %v", err)
+	}
+	if doc.XMLName.Space != xliffNamespace || doc.Version != "2.0" {
+		return "", nil, fmt.Errorf("only XLIFF 2.0 is supported, found version %q", doc.Version)
+	}
+	units := []Unit{}
+	for _, file := range doc.Files {
+		for _, u := range file.Units {
+			unit := Unit{ID: u.ID, Note: strings.Join(u.Notes, "\n")}
+			for _, segment := range u.Segments {
+				unit.Source += segment.Source
+				unit.Target += segment.Target
+			}
+			units = append(units, unit)
+		}
+	}
+	return doc.TrgLang, units, nil
+}
+
+// csvHeader is the header of the CSV form of units
+var csvHeader = []string{"id", "source", "target", "note"}
+
+// CSV writes units as CSV, with a header of id, source, target and note
+func CSV(units []Unit) ([]byte, error) {
+	buf := bytes.Buffer{}
+	w := csv.NewWriter(&buf)
+	w.Write(csvHeader)
+	for _, unit := range units {
+		w.Write([]string{unit.ID, unit.Source, unit.Target, unit.Note})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// ReadCSV reads the units of CSV with a header, in which the id, source and target columns may be in any order
+// Spreadsheets often add a byte order mark and CRLF line endings, which are removed.
+func ReadCSV(data []byte) ([]Unit, error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("invalid CSV: missing the header")
+	}
+	columns := map[string]int{}
+	for idx, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+	for _, name := range csvHeader[:3] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("invalid CSV: missing the %v column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		idx, ok := columns[name]
+		if !ok {
+			return ""
+		}
+		return strings.Replace(record[idx], "\r\n", "\n", -1)
+	}
+	units := []Unit{}
+	for _, record := range records[1:] {
+		units = append(units, Unit{
+			ID:     field(record, "id"),
+			Source: field(record, "source"),
+			Target: field(record, "target"),
+			Note:   field(record, "note"),
+		})
+	}
+	return units, nil
+}
@@ -0,0 +1,78 @@
+package export
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var formatUnits = []Unit{
+	{ID: "dialog:a:entry", Source: "hello\nhi", Target: "hola", Note: "Entry inputs, one per line."},
+	{ID: "dialog:a:always:0", Source: `Say "hi", <break time="1s"/> & wave`},
+}
+
+func TestXLIFF(t *testing.T) {
+	b, err := XLIFF(formatUnits, "project", "en", "es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<xliff xmlns="urn:oasis:names:tc:xliff:document:2.0" version="2.0" srcLang="en" trgLang="es">`,
+		`<segment state="translated">`,
+		`<segment state="initial">`,
+		`<note>Entry inputs, one per line.</note>`,
+	} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("expected %v within %s", expected, b)
+		}
+	}
+	locale, units, err := ReadXLIFF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locale != "es" || !reflect.DeepEqual(units, formatUnits) {
+		t.Errorf("expected %+v in es, got %+v in %v", formatUnits, units, locale)
+	}
+
+	// Segments are joined
+	split := `<?xml version="1.0"?>
+<xliff xmlns="urn:oasis:names:tc:xliff:document:2.0" version="2.0" srcLang="en">
+  <file id="f"><unit id="u">
+    <segment><source>One. </source><target>Uno. </target></segment>
+    <ignorable><source> </source></ignorable>
+    <segment><source>Two.</source><target>Dos.</target></segment>
+  </unit></file>
+</xliff>`
+	locale, units, err = ReadXLIFF([]byte(split))
+	if err != nil || locale != "" || !reflect.DeepEqual(units, []Unit{{ID: "u", Source: "One. Two.", Target: "Uno. Dos."}}) {
+		t.Errorf("unexpected %+v, %v", units, err)
+	}
+
+	old := `<xliff xmlns="urn:oasis:names:tc:xliff:document:1.2" version="1.2"><file/></xliff>`
+	if _, _, err := ReadXLIFF([]byte(old)); err == nil {
+		t.Error("expected an error for XLIFF 1.2")
+	}
+}
+
+func TestCSV(t *testing.T) {
+	b, err := CSV(formatUnits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units, err := ReadCSV(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(units, formatUnits) {
+		t.Errorf("expected %+v, got %+v", formatUnits, units)
+	}
+
+	// Columns may be reordered, as spreadsheets save them
+	units, err = ReadCSV([]byte("\ufeffTarget,ID,Source\r\nHola,dialog:a:always:0,Hello\r\n"))
+	if err != nil || !reflect.DeepEqual(units, []Unit{{ID: "dialog:a:always:0", Source: "Hello", Target: "Hola"}}) {
+		t.Errorf("unexpected %+v, %v", units, err)
+	}
+	if _, err := ReadCSV([]byte("id,target\na,b\n")); err == nil {
+		t.Error("expected an error for a missing source column")
+	}
+}
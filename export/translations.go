@@ -0,0 +1,346 @@
+package export
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// Unit is a translatable string of a project, as given to translators
+// The ID stays the same across snapshots of the project for as long as the string stays where it is,
+// and the Source is the string in the default locale, so an import can tell when it has since changed.
+// The entry inputs of a dialog node are a single unit, with one input per line.
+type Unit struct {
+	ID     string
+	Source string
+	Target string
+	Note   string
+}
+
+// Report is the outcome of importing translations, listing units by ID
+// Stale units were translated from a source which has since changed, unknown units are no longer
+// in the project, and missing units are in the project without a translation in the import.
+type Report struct {
+	Applied int
+	Missing []string
+	Stale   []string
+	Unknown []string
+
+	// Dialogs are the IDs of the dialog nodes changed by the import
+	Dialogs []uuid.UUID `json:"-"`
+	// Triggers are the indexes of the triggers changed by the import
+	Triggers []int `json:"-"`
+}
+
+// entry is a unit along with where it is within the project
+type entry struct {
+	Unit
+	dialog  uuid.UUID
+	trigger int
+	apply   func(target string)
+	// normalize, when set, tidies a target before it is compared and applied
+	normalize func(target string) string
+}
+
+// CheckLocale fails unless locale is one of the locales of a project, other than the default which is translated from
+func CheckLocale(locales []string, locale string) error {
+	if len(locales) > 0 && locale == locales[0] {
+		return fmt.Errorf("%v is the default locale, which is translated from", locale)
+	}
+	for _, l := range locales {
+		if l == locale {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not a locale of the project", locale)
+}
+
+// Units lists every translatable string of a project: the entry inputs of each dialog node and the text play sounds
+// of the dialog nodes and triggers, along with their translations into locale so far.
+// Each variant of a text play sound is a unit of its own. Units are ordered by dialog node, then trigger.
+func Units(items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, locales []string, locale string) ([]Unit, error) {
+	list, err := entries(items, triggers, locales, locale)
+	if err != nil {
+		return nil, err
+	}
+	units := []Unit{}
+	seen := map[string]bool{}
+	for _, e := range list {
+		if !seen[e.ID] {
+			seen[e.ID] = true
+			units = append(units, e.Unit)
+		}
+	}
+	return units, nil
+}
+
+// Import applies the translations of units into locale to the dialogs and triggers of a project, in place
+// Nothing is applied when any unit is stale or unknown, in which case the report lists them along with an error.
+// Units with an empty target are left untranslated, and fall back to the default locale when published.
+func Import(items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, locales []string, locale string, units []Unit) (Report, error) {
+	report := Report{Missing: []string{}, Stale: []string{}, Unknown: []string{}, Dialogs: []uuid.UUID{}, Triggers: []int{}}
+	list, err := entries(items, triggers, locales, locale)
+	if err != nil {
+		return report, err
+	}
+	// A dialog node is read once for each of its relations, so each copy of a unit is translated
+	byID := map[string][]entry{}
+	ids := []string{}
+	for _, e := range list {
+		if _, ok := byID[e.ID]; !ok {
+			ids = append(ids, e.ID)
+		}
+		byID[e.ID] = append(byID[e.ID], e)
+	}
+
+	translated := map[string]bool{}
+	for _, unit := range units {
+		found, ok := byID[unit.ID]
+		switch {
+		case !ok:
+			report.Unknown = append(report.Unknown, unit.ID)
+		case unit.Source != found[0].Source:
+			report.Stale = append(report.Stale, unit.ID)
+			translated[unit.ID] = true
+		case unit.Target != "":
+			translated[unit.ID] = true
+		}
+	}
+	for _, id := range ids {
+		if !translated[id] {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	if len(report.Stale) > 0 || len(report.Unknown) > 0 {
+		return report, fmt.Errorf("%v stale and %v unknown translations, so nothing was imported", len(report.Stale), len(report.Unknown))
+	}
+
+	dialogs := map[uuid.UUID]bool{}
+	changedTriggers := map[int]bool{}
+	for _, unit := range units {
+		found := byID[unit.ID]
+		target := unit.Target
+		if found[0].normalize != nil {
+			target = found[0].normalize(target)
+		}
+		if target == "" || target == found[0].Target {
+			continue
+		}
+		for _, e := range found {
+			e.apply(target)
+			if e.trigger >= 0 {
+				changedTriggers[e.trigger] = true
+			} else {
+				dialogs[e.dialog] = true
+			}
+		}
+		report.Applied++
+	}
+	for id := range dialogs {
+		report.Dialogs = append(report.Dialogs, id)
+	}
+	sort.Slice(report.Dialogs, func(i, j int) bool { return report.Dialogs[i].String() < report.Dialogs[j].String() })
+	for idx := range changedTriggers {
+		report.Triggers = append(report.Triggers, idx)
+	}
+	sort.Ints(report.Triggers)
+	return report, nil
+}
+
+// entries lists the translatable strings of a project, ordered by dialog node, then trigger
+func entries(items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, locales []string, locale string) ([]entry, error) {
+	if err := CheckLocale(locales, locale); err != nil {
+		return nil, err
+	}
+	defaultLocale := locales[0]
+	list := []entry{}
+
+	order := make([]int, len(items))
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.SliceStable(order, func(i, j int) bool { return items[order[i]].DialogID.String() < items[order[j]].DialogID.String() })
+	for _, idx := range order {
+		item := &items[idx]
+		prefix := fmt.Sprintf("dialog:%v", item.DialogID.String())
+		at := entry{dialog: item.DialogID, trigger: -1}
+		if !item.UnknownHandler {
+			list = append(list, entryInputs(item, prefix, at, locale)...)
+		}
+		list = append(list, blockEntries(&item.RawLBlock, prefix, at, defaultLocale, locale)...)
+	}
+
+	order = make([]int, len(triggers))
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := triggers[order[i]], triggers[order[j]]
+		if a.ZoneID != b.ZoneID {
+			return a.ZoneID.String() < b.ZoneID.String()
+		}
+		return a.TriggerType < b.TriggerType
+	})
+	for _, idx := range order {
+		trigger := &triggers[idx]
+		prefix := fmt.Sprintf("trigger:%v:%v", trigger.ZoneID.String(), trigger.TriggerType)
+		list = append(list, blockEntries(&trigger.RawLBlock, prefix, entry{trigger: idx}, defaultLocale, locale)...)
+	}
+	return list, nil
+}
+
+// entryInputs lists the entry inputs of a dialog node, unless it has none in the default locale
+func entryInputs(item *prepare.ProjectItem, prefix string, at entry, locale string) []entry {
+	sources, targets := []string{}, []string{}
+	for _, input := range item.DialogEntry {
+		l, text, ok := prepare.EntryInputLocale(input)
+		if !ok {
+			sources = append(sources, text)
+		} else if l == locale {
+			targets = append(targets, text)
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	at.Unit = Unit{
+		ID:     prefix + ":entry",
+		Source: strings.Join(sources, "\n"),
+		Target: strings.Join(targets, "\n"),
+		Note:   "Entry inputs, one per line. Any number of lines may be translated.",
+	}
+	at.normalize = func(target string) string {
+		lines := []string{}
+		for _, line := range strings.Split(target, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	at.apply = func(target string) {
+		inputs := []string{}
+		for _, input := range item.DialogEntry {
+			if l, _, ok := prepare.EntryInputLocale(input); !ok || l != locale {
+				inputs = append(inputs, input)
+			}
+		}
+		for _, line := range strings.Split(target, "\n") {
+			inputs = append(inputs, fmt.Sprintf("[%v] %v", locale, line))
+		}
+		item.DialogEntry = inputs
+	}
+	return []entry{at}
+}
+
+// blockEntries lists the text play sounds of a logical block, identified by the action set and their index within it
+func blockEntries(block *prepare.RawLBlock, prefix string, at entry, defaultLocale, locale string) []entry {
+	list := []entry{}
+	add := func(set *prepare.ActionSet, where string) {
+		for idx := range set.PlaySounds {
+			id := fmt.Sprintf("%v:%v:%v", prefix, where, idx)
+			list = append(list, soundEntries(&set.PlaySounds[idx], id, at, defaultLocale, locale)...)
+		}
+	}
+	add(&block.AlwaysExec, "always")
+	if block.Statements == nil {
+		return list
+	}
+	for i := range *block.Statements {
+		for j := range (*block.Statements)[i] {
+			add(&(*block.Statements)[i][j].Exec, fmt.Sprintf("statement:%v:%v", i, j))
+		}
+	}
+	return list
+}
+
+// soundEntries lists a text play sound, or each of its variants
+// Translating one writes the play sound as translations, as prepare.Localize reads them.
+func soundEntries(sound *models.RAPlaySound, id string, at entry, defaultLocale, locale string) []entry {
+	if sound.SoundType != models.RAPlaySoundTypeText {
+		return nil
+	}
+	source, target := sound.Val, interface{}(nil)
+	if translations, ok := prepare.Translations(*sound); ok {
+		source, target = translations[defaultLocale], translations[locale]
+	}
+	set := func(val interface{}) {
+		updated := map[string]interface{}{}
+		if translations, ok := prepare.Translations(*sound); ok {
+			for l, v := range translations {
+				updated[l] = v
+			}
+		} else {
+			updated[defaultLocale] = sound.Val
+		}
+		updated[locale] = val
+		sound.Val = updated
+	}
+
+	switch source := source.(type) {
+	case string:
+		at.Unit = Unit{ID: id, Source: source, Note: textNote(source)}
+		at.Unit.Target, _ = target.(string)
+		at.apply = func(target string) { set(target) }
+		return []entry{at}
+
+	case map[string]interface{}:
+		variants, _ := source["variants"].([]interface{})
+		targetVariants := []interface{}{}
+		if m, ok := target.(map[string]interface{}); ok {
+			targetVariants, _ = m["variants"].([]interface{})
+		}
+		// The translations of every variant, which are written together as the variants of the locale
+		// Untranslated variants are written in the default locale, so that each translation stays beside its source.
+		translated := make([]string, len(variants))
+		list := []entry{}
+		for v, variant := range variants {
+			text, ok := variant.(string)
+			if !ok {
+				continue
+			}
+			if v < len(targetVariants) {
+				if t, _ := targetVariants[v].(string); t != text {
+					translated[v] = t
+				}
+			}
+			e := at
+			e.Unit = Unit{ID: fmt.Sprintf("%v:variant:%v", id, v), Source: text, Target: translated[v], Note: textNote(text)}
+			v := v
+			e.apply = func(target string) {
+				translated[v] = target
+				list := []interface{}{}
+				for v, text := range translated {
+					if text == "" {
+						text, _ = variants[v].(string)
+					}
+					list = append(list, text)
+				}
+				val := map[string]interface{}{"variants": list}
+				if policy, ok := source["policy"]; ok {
+					val["policy"] = policy
+				}
+				set(val)
+			}
+			list = append(list, e)
+		}
+		return list
+	}
+	return nil
+}
+
+// textNote tells translators what to keep as it is within text
+func textNote(text string) string {
+	notes := []string{}
+	if strings.Contains(text, "<") {
+		notes = append(notes, "SSML: translate the text between the tags and keep the tags.")
+	}
+	if prepare.IsTemplate(text) {
+		notes = append(notes, "Template: keep the variable names within braces, and translate the words of plurals and conditionals.")
+	}
+	return strings.Join(notes, " ")
+}
@@ -0,0 +1,148 @@
+package export
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+const (
+	nodeID    = "00000000-0000-0000-0000-00000000000a"
+	zoneID    = "00000000-0000-0000-0000-00000000000b"
+	nodeUnit  = "dialog:" + nodeID
+	triggerAt = "trigger:" + zoneID + ":0"
+)
+
+var locales = []string{"en", "es", "de"}
+
+func translationsProject() ([]prepare.ProjectItem, []prepare.ProjectTriggerItem) {
+	node, _ := uuid.FromString(nodeID)
+	zone, _ := uuid.FromString(zoneID)
+	block := func() prepare.RawLBlock {
+		return prepare.RawLBlock{
+			AlwaysExec: prepare.ActionSet{PlaySounds: []models.RAPlaySound{
+				{SoundType: models.RAPlaySoundTypeText, Val: map[string]interface{}{"en": "Hello, {name}.", "es": "Hola, {name}."}},
+				{SoundType: models.RAPlaySoundTypeAudio, Val: "https://example.com/bell.mp3"},
+			}},
+			Statements: &[][]prepare.RawLStatement{{
+				{Exec: prepare.ActionSet{PlaySounds: []models.RAPlaySound{
+					{SoundType: models.RAPlaySoundTypeText, Val: map[string]interface{}{"variants": []interface{}{"Bye", "Farewell"}, "policy": "shuffle"}},
+				}}},
+			}},
+		}
+	}
+	// The node has a parent and a child, so it is read twice
+	entry := []string{"hello", "hi", "[es] hola", "[de] hallo"}
+	items := []prepare.ProjectItem{
+		{DialogID: node, DialogEntry: entry, RawLBlock: block()},
+		{DialogID: node, DialogEntry: entry, RawLBlock: block()},
+	}
+	triggers := []prepare.ProjectTriggerItem{{ZoneID: zone}}
+	triggers[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeText, Val: "<speak>Welcome</speak>"},
+	}
+	return items, triggers
+}
+
+func TestUnits(t *testing.T) {
+	items, triggers := translationsProject()
+	units, err := Units(items, triggers, locales, "es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Unit{
+		{ID: nodeUnit + ":entry", Source: "hello\nhi", Target: "hola"},
+		{ID: nodeUnit + ":always:0", Source: "Hello, {name}.", Target: "Hola, {name}."},
+		{ID: nodeUnit + ":statement:0:0:0:variant:0", Source: "Bye"},
+		{ID: nodeUnit + ":statement:0:0:0:variant:1", Source: "Farewell"},
+		{ID: triggerAt + ":always:0", Source: "<speak>Welcome</speak>"},
+	}
+	for idx := range units {
+		units[idx].Note = ""
+	}
+	if !reflect.DeepEqual(units, expected) {
+		t.Errorf("expected %+v, got %+v", expected, units)
+	}
+
+	if _, err := Units(items, triggers, locales, "en"); err == nil {
+		t.Error("expected an error for the default locale")
+	}
+	if _, err := Units(items, triggers, locales, "fr"); err == nil {
+		t.Error("expected an error for a locale not of the project")
+	}
+}
+
+func TestImport(t *testing.T) {
+	items, triggers := translationsProject()
+	units := []Unit{
+		{ID: nodeUnit + ":entry", Source: "hello\nhi", Target: "hallo\n\nguten tag "},
+		{ID: nodeUnit + ":statement:0:0:0:variant:1", Source: "Farewell", Target: "Lebewohl"},
+		{ID: triggerAt + ":always:0", Source: "<speak>Welcome</speak>", Target: "<speak>Willkommen</speak>"},
+		{ID: nodeUnit + ":always:0", Source: "Hello, {name}."},
+	}
+
+	stale := append([]Unit{
+		{ID: "dialog:gone:always:0", Source: "Gone", Target: "Weg"},
+		{ID: nodeUnit + ":statement:0:0:0:variant:0", Source: "Goodbye", Target: "Tschüss"},
+	}, units...)
+	report, err := Import(items, triggers, locales, "de", stale)
+	if err == nil {
+		t.Fatal("expected an error for stale and unknown units")
+	}
+	if !reflect.DeepEqual(report.Unknown, []string{"dialog:gone:always:0"}) || !reflect.DeepEqual(report.Stale, []string{nodeUnit + ":statement:0:0:0:variant:0"}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if items[0].RawLBlock.AlwaysExec.PlaySounds[0].Val.(map[string]interface{})["de"] != nil || len(items[0].DialogEntry) != 4 {
+		t.Error("expected nothing to be imported")
+	}
+
+	report, err = Import(items, triggers, locales, "de", units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Report{
+		Applied:  3,
+		Missing:  []string{nodeUnit + ":always:0", nodeUnit + ":statement:0:0:0:variant:0"},
+		Stale:    []string{},
+		Unknown:  []string{},
+		Dialogs:  []uuid.UUID{items[0].DialogID},
+		Triggers: []int{0},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+
+	// Each copy of the node is translated, and reads as the translation when localized
+	for _, copy := range [][]prepare.ProjectItem{items[:1], items[1:]} {
+		localized, localizedTriggers, err := prepare.Localize(copy, triggers, locales, "de")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(localized[0].DialogEntry, []string{"hallo", "guten tag"}) {
+			t.Errorf("unexpected entry inputs %v", localized[0].DialogEntry)
+		}
+		sounds := localized[0].RawLBlock.AlwaysExec.PlaySounds
+		if sounds[0].Val != "Hello, {name}." || sounds[1].Val != "https://example.com/bell.mp3" {
+			t.Errorf("expected untranslated play sounds to fall back to the default locale, got %v", sounds)
+		}
+		variants := (*localized[0].RawLBlock.Statements)[0][0].Exec.PlaySounds[0].Val
+		if !reflect.DeepEqual(variants, map[string]interface{}{"variants": []interface{}{"Bye", "Lebewohl"}, "policy": "shuffle"}) {
+			t.Errorf("unexpected variants %v", variants)
+		}
+		if welcome := localizedTriggers[0].RawLBlock.AlwaysExec.PlaySounds[0].Val; welcome != "<speak>Willkommen</speak>" {
+			t.Errorf("unexpected trigger text %v", welcome)
+		}
+	}
+	if !reflect.DeepEqual(items[0].DialogEntry, []string{"hello", "hi", "[es] hola", "[de] hallo", "[de] guten tag"}) {
+		t.Errorf("expected the translations into other locales to be kept, got %v", items[0].DialogEntry)
+	}
+
+	// Importing the same translations again changes nothing
+	report, err = Import(items, triggers, locales, "de", units)
+	if err != nil || report.Applied != 0 || len(report.Dialogs) != 0 || len(report.Triggers) != 0 {
+		t.Errorf("expected nothing to change, got %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,82 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/talkative-ai/core/common"
+	"github.com/talkative-ai/core/models"
+)
+
+// BundleStore writes action bundles under a hash of their contents,
+// so that a bundle repeated across dialog nodes and triggers,
+// such as the same "I don't understand" line, is stored once per publish.
+// It is shared between every goroutine compiling the publish.
+type BundleStore struct {
+	publishID string
+
+	mu     sync.Mutex
+	stored map[string]bool
+	// references counts every bundle stored, and referencedBytes their sizes,
+	// whereas unique and uniqueBytes only count each distinct bundle once
+	references      int
+	unique          int
+	referencedBytes int
+	uniqueBytes     int
+}
+
+// NewBundleStore returns an empty BundleStore for the publish
+func NewBundleStore(publishID string) *BundleStore {
+	return &BundleStore{publishID: publishID, stored: map[string]bool{}}
+}
+
+// Key returns the key an action bundle is stored under within the publish namespace
+// The first 128 bits of the SHA-256 of the bundle are plenty to tell bundles apart.
+func (s *BundleStore) Key(bundle []byte) string {
+	hash := sha256.Sum256(bundle)
+	return models.KeynavCompiledEntity(s.publishID, models.AEIDActionBundle, hex.EncodeToString(hash[:16]))
+}
+
+// Store sends an action bundle to be written to Redis, unless it already has been,
+// and returns its key. Empty bundles are never stored, and have the empty key.
+func (s *BundleStore) Store(bundle []byte, redisWriter chan common.RedisCommand) string {
+	if isEmptyBundle(bundle) {
+		return ""
+	}
+	key := s.Key(bundle)
+
+	s.mu.Lock()
+	s.references++
+	s.referencedBytes += len(bundle)
+	stored := s.stored[key]
+	if !stored {
+		s.stored[key] = true
+		s.unique++
+		s.uniqueBytes += len(bundle)
+	}
+	s.mu.Unlock()
+
+	if !stored {
+		redisWriter <- common.RedisSET(key, bundle)
+	}
+	return key
+}
+
+// Stats returns the number of bundles referenced and stored, and their sizes in bytes
+func (s *BundleStore) Stats() (references, unique, referencedBytes, uniqueBytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.references, s.unique, s.referencedBytes, s.uniqueBytes
+}
+
+func (s *BundleStore) String() string {
+	references, unique, referencedBytes, uniqueBytes := s.Stats()
+	ratio := 1.0
+	if unique > 0 {
+		ratio = float64(references) / float64(unique)
+	}
+	return fmt.Sprintf("%v action bundles stored for %v references, a %.2f:1 dedup ratio, %v of %v bytes",
+		unique, references, ratio, uniqueBytes, referencedBytes)
+}
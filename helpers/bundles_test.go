@@ -0,0 +1,38 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/talkative-ai/core/common"
+)
+
+func TestBundleStore(t *testing.T) {
+	store := NewBundleStore("pub")
+	redisWriter := make(chan common.RedisCommand, 10)
+
+	x := store.Store(testBundle("x"), redisWriter)
+	y := store.Store(testBundle("y"), redisWriter)
+	if x == y {
+		t.Errorf("expected different bundles to have different keys, got %v", x)
+	}
+	if again := store.Store(testBundle("x"), redisWriter); again != x {
+		t.Errorf("expected the same bundle to have the same key, got %v and %v", x, again)
+	}
+	if store.Key(testBundle("x")) != x {
+		t.Errorf("expected Key to match the stored key %v", x)
+	}
+	if empty := store.Store(testBundle(""), redisWriter); empty != "" {
+		t.Errorf("expected an empty bundle to have the empty key, got %v", empty)
+	}
+
+	// Each distinct bundle is written once
+	if len(redisWriter) != 2 {
+		t.Errorf("expected 2 writes, got %v", len(redisWriter))
+	}
+
+	references, unique, referencedBytes, uniqueBytes := store.Stats()
+	size := len(testBundle("x"))
+	if references != 3 || unique != 2 || referencedBytes != 3*size || uniqueBytes != 2*size {
+		t.Errorf("unexpected stats %v", store)
+	}
+}
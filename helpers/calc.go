@@ -0,0 +1,362 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Calc is an arithmetic expression over variables and numeric literals,
+// usable as either side of a comparison. It is written as text such as
+//
+//	(#12 + #13) * 2 - 1
+//	#7 % 3
+//
+// where #12 refers to the variable with ID 12.
+// Calcs compile into a postfix program for a stack machine.
+type Calc interface {
+	calc()
+	String() string
+}
+
+// CalcNumber is a numeric literal
+type CalcNumber float64
+
+// CalcVar is the current value of a variable
+type CalcVar uint64
+
+// CalcBinary applies one of + - * / % to its operands
+type CalcBinary struct {
+	Op    byte
+	Left  Calc
+	Right Calc
+}
+
+// CalcNeg negates its operand
+type CalcNeg struct {
+	Calc Calc
+}
+
+func (CalcNumber) calc() {}
+func (CalcVar) calc()    {}
+func (CalcBinary) calc() {}
+func (CalcNeg) calc()    {}
+
+func (c CalcNumber) String() string { return strconv.FormatFloat(float64(c), 'g', -1, 64) }
+func (c CalcVar) String() string    { return fmt.Sprintf("#%v", uint64(c)) }
+func (c CalcBinary) String() string { return fmt.Sprintf("(%v %c %v)", c.Left, c.Op, c.Right) }
+func (c CalcNeg) String() string    { return fmt.Sprintf("-%v", c.Calc) }
+
+// ExprCalc compares two arithmetic expressions, such as #1 + #2 > 10
+// Within an expression tree it is written as {"calc": "#1 + #2 > 10"}
+type ExprCalc struct {
+	Operator string
+	Left     Calc
+	Right    Calc
+}
+
+func (ExprCalc) expr() {}
+
+// CalcOp is an instruction of a compiled Calc program
+type CalcOp uint8
+
+const (
+	// CalcOpNumber pushes the float64 which follows it
+	CalcOpNumber CalcOp = iota + 1
+	// CalcOpVar pushes the value of the uint64 variable ID which follows it
+	CalcOpVar
+	// CalcOpAdd pops b then a and pushes a + b, and likewise for the other binary ops
+	CalcOpAdd
+	CalcOpSub
+	CalcOpMul
+	CalcOpDiv
+	CalcOpMod
+	// CalcOpNeg pops a and pushes -a
+	CalcOpNeg
+)
+
+var calcBinaryOps = map[byte]CalcOp{
+	'+': CalcOpAdd,
+	'-': CalcOpSub,
+	'*': CalcOpMul,
+	'/': CalcOpDiv,
+	'%': CalcOpMod,
+}
+
+// calcComparisons maps the comparison operators within calc text to AndGroup operators
+// Two character operators come first so that they match before their prefixes
+var calcComparisons = []struct {
+	token    string
+	operator string
+}{
+	{"==", "eq"},
+	{"!=", "ne"},
+	{"<=", "lte"},
+	{">=", "gte"},
+	{"<", "lt"},
+	{">", "gt"},
+}
+
+// calcParser is a recursive descent parser over calc text
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | primary
+//	primary = number | "#" digits | "(" sum ")"
+type calcParser struct {
+	text string
+	pos  int
+}
+
+// ParseCalc parses the text of an arithmetic expression
+func ParseCalc(text string) (Calc, error) {
+	p := &calcParser{text: text}
+	c, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.text) {
+		return nil, p.errorf("unexpected %q", p.text[p.pos:])
+	}
+	return c, nil
+}
+
+// ParseCalcComparison parses the text of a comparison between arithmetic expressions
+func ParseCalcComparison(text string) (ExprCalc, error) {
+	for _, cmp := range calcComparisons {
+		idx := strings.Index(text, cmp.token)
+		if idx < 0 {
+			continue
+		}
+		left, err := ParseCalc(text[:idx])
+		if err != nil {
+			return ExprCalc{}, err
+		}
+		right, err := ParseCalc(text[idx+len(cmp.token):])
+		if err != nil {
+			return ExprCalc{}, err
+		}
+		return ExprCalc{Operator: cmp.operator, Left: left, Right: right}, nil
+	}
+	return ExprCalc{}, fmt.Errorf("calc %q has no comparison operator", text)
+}
+
+func (p *calcParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("calc %q at %v: %v", p.text, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *calcParser) skipSpace() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next non space character, or zero at the end of the text
+func (p *calcParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.text) {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func (p *calcParser) sum() (Calc, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = CalcBinary{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *calcParser) product() (Calc, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/' || op == '%'; op = p.peek() {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		// Catch the obvious mistakes here rather than at runtime
+		if n, ok := right.(CalcNumber); ok && n == 0 && op != '*' {
+			return nil, p.errorf("division by zero")
+		}
+		left = CalcBinary{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *calcParser) unary() (Calc, error) {
+	if p.peek() == '-' {
+		p.pos++
+		c, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return CalcNeg{c}, nil
+	}
+	return p.primary()
+}
+
+func (p *calcParser) primary() (Calc, error) {
+	switch c := p.peek(); {
+	case c == '(':
+		p.pos++
+		inner, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return inner, nil
+	case c == '#':
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.text) && p.text[p.pos] >= '0' && p.text[p.pos] <= '9' {
+			p.pos++
+		}
+		id, err := strconv.ParseUint(p.text[start:p.pos], 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid variable")
+		}
+		return CalcVar(id), nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.text) && (p.text[p.pos] == '.' || (p.text[p.pos] >= '0' && p.text[p.pos] <= '9')) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.text[start:p.pos])
+		}
+		return CalcNumber(n), nil
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected %q, only numbers and #variables may be used", p.text[p.pos])
+}
+
+// compileCalc converts a Calc into a uint16 length prefixed postfix program
+func compileCalc(c Calc) ([]byte, error) {
+	program, err := compileCalcHelper(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUint16("calc", len(program)); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, uint16(len(program)))
+	return append(b, program...), nil
+}
+
+func compileCalcHelper(c Calc) ([]byte, error) {
+	switch v := c.(type) {
+	case CalcNumber:
+		b := make([]byte, 9)
+		b[0] = uint8(CalcOpNumber)
+		binary.LittleEndian.PutUint64(b[1:], math.Float64bits(float64(v)))
+		return b, nil
+	case CalcVar:
+		b := make([]byte, 9)
+		b[0] = uint8(CalcOpVar)
+		binary.LittleEndian.PutUint64(b[1:], uint64(v))
+		return b, nil
+	case CalcNeg:
+		b, err := compileCalcHelper(v.Calc)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, uint8(CalcOpNeg)), nil
+	case CalcBinary:
+		op, ok := calcBinaryOps[v.Op]
+		if !ok {
+			return nil, fmt.Errorf("unknown calc operator %c", v.Op)
+		}
+		left, err := compileCalcHelper(v.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := compileCalcHelper(v.Right)
+		if err != nil {
+			return nil, err
+		}
+		return append(append(left, right...), uint8(op)), nil
+	}
+	return nil, fmt.Errorf("unknown calc %T", c)
+}
+
+// DecodeCalc rebuilds a Calc from a postfix program without its length prefix
+func DecodeCalc(program []byte) (Calc, error) {
+	stack := []Calc{}
+	opCalcBinary := map[CalcOp]byte{}
+	for op, calcOp := range calcBinaryOps {
+		opCalcBinary[calcOp] = op
+	}
+
+	for pos := 0; pos < len(program); {
+		op := CalcOp(program[pos])
+		pos++
+		switch {
+		case op == CalcOpNumber || op == CalcOpVar:
+			if pos+8 > len(program) {
+				return nil, fmt.Errorf("calc program ends within an operand")
+			}
+			v := binary.LittleEndian.Uint64(program[pos:])
+			pos += 8
+			if op == CalcOpNumber {
+				stack = append(stack, CalcNumber(math.Float64frombits(v)))
+			} else {
+				stack = append(stack, CalcVar(v))
+			}
+		case op == CalcOpNeg:
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("calc program stack underflow")
+			}
+			stack[len(stack)-1] = CalcNeg{stack[len(stack)-1]}
+		case opCalcBinary[op] != 0:
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("calc program stack underflow")
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = append(stack[:len(stack)-2], CalcBinary{opCalcBinary[op], left, right})
+		default:
+			return nil, fmt.Errorf("unknown calc instruction %v", op)
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("calc program leaves %v values on the stack", len(stack))
+	}
+	return stack[0], nil
+}
+
+// checkCalcComparison type checks a comparison involving arithmetic,
+// which is only ever numeric
+func checkCalcComparison(operator string, val interface{}) error {
+	switch operator {
+	case "eq", "ne", "lt", "gt", "lte", "gte":
+	default:
+		return fmt.Errorf("operator %v can't compare numbers", operator)
+	}
+	switch val.(type) {
+	case Calc, float64, int, VarRef:
+		return nil
+	}
+	return fmt.Errorf("arithmetic can only be compared to a number, found %T", val)
+}
@@ -0,0 +1,64 @@
+package helpers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCalc(t *testing.T) {
+	tests := map[string]string{
+		"#1 + #2":            "(#1 + #2)",
+		"#1 + #2 * 3":        "(#1 + (#2 * 3))",
+		"(#1 + #2) * 3":      "((#1 + #2) * 3)",
+		"-#4 % 3 - 1.5":      "((-#4 % 3) - 1.5)",
+		"  10 / ( #5 - 2 ) ": "(10 / (#5 - 2))",
+	}
+	for text, expected := range tests {
+		c, err := ParseCalc(text)
+		if err != nil {
+			t.Errorf("%v: %v", text, err)
+			continue
+		}
+		if c.String() != expected {
+			t.Errorf("%v: expected %v, got %v", text, expected, c)
+		}
+
+		// The compiled postfix program must decode into the same Calc
+		compiled, err := compileCalc(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeCalc(compiled[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c, decoded) {
+			t.Errorf("%v: round trip produced %v", text, decoded)
+		}
+	}
+
+	for _, text := range []string{"", "#1 +", "(#1", "#1 / 0", "#x", "#1 + \"a\"", "#1 #2"} {
+		if _, err := ParseCalc(text); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestParseCalcComparison(t *testing.T) {
+	c, err := ParseCalcComparison("#1 + #2 >= 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ExprCalc{
+		Operator: "gte",
+		Left:     CalcBinary{'+', CalcVar(1), CalcVar(2)},
+		Right:    CalcNumber(10),
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("unexpected comparison %#v", c)
+	}
+
+	if _, err := ParseCalcComparison("#1 + #2"); err == nil {
+		t.Error("expected an error without a comparison operator")
+	}
+}
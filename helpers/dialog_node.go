@@ -7,103 +7,70 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sync"
-	"sync/atomic"
 
 	"github.com/talkative-ai/snips-nlu-types"
 
 	"github.com/talkative-ai/core/common"
 	"github.com/talkative-ai/core/models"
 	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/blob"
 	"github.com/talkative-ai/lakshmi/prepare"
 )
 
-// compileNodeHelper relates to compiling the node.RawLBlock and the actions therein
+// compileNodeHelper relates to compiling the logical block of a node and the actions therein
 // It does this in the following steps
 //
-// 1. Bundle the AlwaysExec actions and store the key to the Action Bundle in the lblock
+// 1. Bundle the actions of the AlwaysExec and every statement,
+//		and normalize the statement conditions into expression trees
 //
-// 2. 1.	If the.RawLBlock has no statements, then convert the new lblock into binary
-//				(In this case that just means storing the length of the Action Bundle key)
-//				And return the value to the calling function "DialogNode"
+// 2. Compile the block as written, which catches authoring errors
+//		even within statements the optimizer would remove,
+//		and tells how much the optimizer saved
 //
-// 2. 2. 	Else prepare to compile the.RawLBlock statements after bundling their actions
-//				therein.
+// 3. Optimize the block. See OptimizeBlock
 //
-// 3. Every value accessed in node.RawLBlock will now be mirrored in the lblock variable
-//		This is because lblock node.RawLBlock compiled
+// 4. Key the remaining action bundles by their contents,
+//		and send those not already stored to be written to Redis. See BundleStore
 //
-// 4. Iterate through the entire array of node.RawLBlock.Statements,
-//		which is an array of arrays of statements
-//
-// 5. For each statement in each array of statements, bundle the actions
-//
-// 6. Finally send it all off to be converted to bytes,
+// 5. Finally convert the optimized block to bytes,
 //		and return the value to the calling function "DialogNode"
-func compileNodeHelper(node models.DialogNode, redisWriter chan common.RedisCommand, publishID string) []byte {
-	lblock := models.LBlock{}
-
-	wg := sync.WaitGroup{}
+func compileNodeHelper(block *prepare.RawLBlock, redisWriter chan common.RedisCommand, bundleStore *BundleStore, stats *OptimizeStats) ([]byte, error) {
+	// 1. Bundle the actions of the AlwaysExec and every statement
+	bundled, err := BundleRawLBlock(block)
+	if err != nil {
+		return nil, err
+	}
 
-	// For tracking the action bundle ID
-	// It will always be a child of the unique node, therefore we can start with a zero ID
-	bundleCount := uint64(0)
+	// 2. Compile the block as written
+	unoptimized, unoptimizedBundles := bundled.keyBundles(bundleStore.Key, true)
+	unoptimizedCompiled, err := CompileBlock(unoptimized)
+	if err != nil {
+		return nil, err
+	}
 
-	// 1. Bundle the AlwaysExec actions and store the key to the Action Bundle in the lblock
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		bslice := prepare.BundleActions(node.RawLBlock.AlwaysExec)
-		key := models.KeynavCompiledDialogNodeActionBundle(publishID, node.ID.String(), atomic.AddUint64(&bundleCount, 1)-1)
-		redisWriter <- common.RedisSET(key, bslice)
-		lblock.AlwaysExec = key
-	}()
+	// 3. Optimize the block
+	// 4. Key the remaining action bundles
+	lblock, bundles := OptimizeBlock(bundled).keyBundles(bundleStore.Key, false)
 
-	// 2. 1.	If the.RawLBlock has no statements, then convert the new lblock into binary
-	//				In this case that just means storing the length of the Action Bundle key
-	if node.RawLBlock.Statements == nil {
-		wg.Wait()
-		return CompileLogic(&lblock)
+	// 5. Convert the optimized block to bytes
+	compiled, err := CompileBlock(lblock)
+	if err != nil {
+		return nil, err
 	}
 
-	// 2. 2. 	Else prepare to compile the.RawLBlock statements after bundling their actions therein
-	stmt := make([][]models.LStatement, len(*node.RawLBlock.Statements))
-	// 3. Every value accessed in node.RawLBlock will now be mirrored in the lblock variable
-	//		This is because lblock node.RawLBlock compiled
-	lblock.Statements = &stmt
-
-	// 4. Iterate through the entire array of node.RawLBlock.Statements, which is an array of arrays of statements
-	for j, Statements := range *node.RawLBlock.Statements {
-
-		// Prepare an array for individual processed "if/elif/else" blocks
-		// Again, as per note 3:
-		// 3. Every value accessed in node.RawLBlock will now be mirrored in the lblock variable
-		//		This is because lblock node.RawLBlock compiled
-		(*lblock.Statements)[j] = make([]models.LStatement, len(Statements))
-
-		// 5. For each statement in each array of statements, bundle the actions
-		// Each "Statement" here represents an individual if/elif/else block
-		for k, Statement := range Statements {
-			wg.Add(1)
-			go func(idx1, idx2 int, Statement models.RawLStatement) {
-				defer wg.Done()
-				bslice := prepare.BundleActions(Statement.Exec)
-
-				key := models.KeynavCompiledDialogNodeActionBundle(publishID, node.ID.String(), atomic.AddUint64(&bundleCount, 1)-1)
-
-				redisWriter <- common.RedisSET(key, bslice)
-				// Again, as per note 3:
-				// 3. Every value accessed in node.RawLBlock will now be mirrored in the lblock variable
-				//		This is because lblock node.RawLBlock compiled
-				(*lblock.Statements)[idx1][idx2] = models.LStatement{Operators: Statement.Operators, Exec: key}
-			}(j, k, Statement)
-		}
+	for _, bundle := range bundles {
+		bundleStore.Store(bundle.Bundle, redisWriter)
 	}
+	stats.add(
+		storedSize(unoptimizedCompiled, unoptimizedBundles)-storedSize(compiled, bundles),
+		len(unoptimizedBundles)-len(bundles))
 
-	wg.Wait()
-	return CompileLogic(&lblock)
+	return compiled, nil
 }
 
-func TrainData(parent *models.DialogNode, actorID string, nodes *[]*models.DialogNode, redisWriter chan common.RedisCommand, publishID string) {
+// TrainData trains the NLU to tell apart the entry inputs of the given nodes, in the given language,
+// and stores what it learns for the parent node, or for the root nodes of the actor when parent is nil
+func TrainData(parent *models.DialogNode, actorID string, nodes *[]*models.DialogNode, redisWriter chan common.RedisCommand, publishID string, language string) {
 
 	var compiledKey string
 	if parent == nil {
@@ -113,7 +80,7 @@ func TrainData(parent *models.DialogNode, actorID string, nodes *[]*models.Dialo
 	}
 
 	dataset := snips.Dataset{}
-	dataset.Language = snips.LanguageEnglish
+	dataset.Language = language
 	dataset.Entities = map[string]snips.Entity{}
 	dataset.Intents = map[string]snips.Intent{}
 
@@ -174,24 +141,36 @@ func TrainData(parent *models.DialogNode, actorID string, nodes *[]*models.Dialo
 
 // DialogNode is a helper function to compile.Dialog
 // It compiles the node logical blocks, action bundles therein,
-// and its child nodes recursively.
-func DialogNode(node models.DialogNode, redisWriter chan common.RedisCommand, processed *common.SyncMapUUID, publishID string) {
+// and its child nodes recursively. The logical block of each node is found in blocks by its ID.
+// The first error met in the node or any of its children is returned.
+// Action bundles are stored through bundleStore,
+// and what the optimizer saves is added to stats, which may be nil.
+// The entry inputs are understood in the given language.
+func DialogNode(node models.DialogNode, blocks map[uuid.UUID]*prepare.RawLBlock, redisWriter chan common.RedisCommand, processed *common.SyncMapUUID, publishID string, bundleStore *BundleStore, stats *OptimizeStats, language string) error {
 	processed.Mutex.Lock()
 	if processed.Value == nil {
 		processed.Value = map[uuid.UUID]bool{}
 	}
 	if processed.Value[node.ID] {
 		processed.Mutex.Unlock()
-		return
+		return nil
 	}
 	processed.Value[node.ID] = true
 	processed.Mutex.Unlock()
 	wg := sync.WaitGroup{}
+
+	// Every goroutine compiling this node or a child sends back exactly one result
+	goroutines := 1
+	if node.ChildNodes != nil {
+		goroutines += len(*node.ChildNodes)
+	}
+	errs := make(chan error, goroutines)
+
 	wg.Add(1)
 	go func(node models.DialogNode) {
 		defer wg.Done()
 
-		bslice := []byte{}
+		bslice := blob.Header(blob.KindDialogNode)
 
 		// Boolean flag whether dialog continues or ends
 		if node.ChildNodes == nil {
@@ -201,23 +180,29 @@ func DialogNode(node models.DialogNode, redisWriter chan common.RedisCommand, pr
 		}
 
 		// Save the compiled logical blocks and action bundles
-		bslice = append(bslice, compileNodeHelper(node, redisWriter, publishID)...)
+		compiled, err := compileNodeHelper(blocks[node.ID], redisWriter, bundleStore, stats)
+		if err != nil {
+			errs <- &CompileError{Entity: fmt.Sprintf("dialog node %v", node.ID.String()), Err: err}
+			return
+		}
+		bslice = append(bslice, compiled...)
 		compiledKey := models.KeynavCompiledEntity(publishID, models.AEIDDialogNode, node.ID.String())
 
 		// Send it to be written to Redis
 		redisWriter <- common.RedisSET(compiledKey, bslice)
+		errs <- nil
 
 	}(node)
 
 	if node.ChildNodes == nil {
 		wg.Wait()
-		return
+		return <-errs
 	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		TrainData(&node, node.ActorID.String(), node.ChildNodes, redisWriter, publishID)
+		TrainData(&node, node.ActorID.String(), node.ChildNodes, redisWriter, publishID, language)
 	}()
 
 	// For every child node, recurse this operation
@@ -225,8 +210,16 @@ func DialogNode(node models.DialogNode, redisWriter chan common.RedisCommand, pr
 	for _, child := range *node.ChildNodes {
 		go func(node models.DialogNode) {
 			defer wg.Done()
-			DialogNode(node, redisWriter, processed, publishID)
+			errs <- DialogNode(node, blocks, redisWriter, processed, publishID, bundleStore, stats, language)
 		}(*child)
 	}
 	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
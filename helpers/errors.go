@@ -0,0 +1,34 @@
+package helpers
+
+import (
+	"fmt"
+	"math"
+)
+
+// CompileError is a problem within the authored project that prevents it from compiling,
+// as opposed to a problem within lakshmi or its connections.
+type CompileError struct {
+	// Entity identifies what failed to compile, such as a dialog node or trigger
+	Entity string
+	Err    error
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Entity, e.Err)
+}
+
+// checkUint8 fails when a count can't be stored as a uint8
+func checkUint8(what string, n int) error {
+	if n > math.MaxUint8 {
+		return fmt.Errorf("%v has %v entries, the limit is %v", what, n, math.MaxUint8)
+	}
+	return nil
+}
+
+// checkUint16 fails when a length can't be stored as a uint16
+func checkUint16(what string, n int) error {
+	if n > math.MaxUint16 {
+		return fmt.Errorf("%v is %v bytes long, the limit is %v", what, n, math.MaxUint16)
+	}
+	return nil
+}
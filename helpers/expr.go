@@ -0,0 +1,292 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// ExprTag identifies each node of a prefix encoded condition expression
+type ExprTag uint8
+
+const (
+	// ExprTagNone marks a statement without a condition, such as an "else"
+	ExprTagNone ExprTag = iota
+	// ExprTagAnd is followed by a uint8 number of children and then the children
+	ExprTagAnd
+	// ExprTagOr is followed by a uint8 number of children and then the children
+	ExprTagOr
+	// ExprTagNot is followed by a single child
+	ExprTagNot
+	// ExprTagCompare is followed by a uint8 operator, uint64 variable ID and a value
+	ExprTagCompare
+	// ExprTagCalc is followed by a uint8 operator and two uint16 length prefixed Calc programs
+	ExprTagCalc
+)
+
+// Expr is a node in a condition expression tree
+type Expr interface {
+	expr()
+}
+
+// ExprAnd is true when all of its children are true
+type ExprAnd []Expr
+
+// ExprOr is true when any of its children are true
+type ExprOr []Expr
+
+// ExprNot negates its child
+type ExprNot struct {
+	Expr Expr
+}
+
+// ExprCompare compares a variable against a value via an operator
+// such as "eq" or "gt", exactly as within an AndGroup
+type ExprCompare struct {
+	Operator string
+	Var      uint64
+	Value    interface{}
+}
+
+func (ExprAnd) expr()     {}
+func (ExprOr) expr()      {}
+func (ExprNot) expr()     {}
+func (ExprCompare) expr() {}
+
+// ParseExpr reads the JSON form of an expression tree
+// Each node is one of:
+//
+//	{"and": [...]}
+//	{"or": [...]}
+//	{"not": {...}}
+//	{"calc": "#1 + #2 > 10"}
+//	an AndGroup, such as {"eq": {"123": "bar"}, "gt": {"456": 1}}
+func ParseExpr(v interface{}) (Expr, error) {
+	node, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("an expression must be an object, found %T", v)
+	}
+
+	if children, ok := node["and"]; ok && len(node) == 1 {
+		exprs, err := parseExprList(children)
+		return ExprAnd(exprs), err
+	}
+	if children, ok := node["or"]; ok && len(node) == 1 {
+		exprs, err := parseExprList(children)
+		return ExprOr(exprs), err
+	}
+	if text, ok := node["calc"]; ok && len(node) == 1 {
+		str, ok := text.(string)
+		if !ok {
+			return nil, fmt.Errorf("calc must be a string, found %T", text)
+		}
+		return ParseCalcComparison(str)
+	}
+	if child, ok := node["not"]; ok && len(node) == 1 {
+		expr, err := ParseExpr(child)
+		if err != nil {
+			return nil, err
+		}
+		return ExprNot{expr}, nil
+	}
+
+	// Otherwise the node is an AndGroup of comparisons
+	andGroup := models.AndGroup{}
+	for operator, val := range node {
+		varValJSON, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operator %v must map variables to values", operator)
+		}
+		varValMap := map[uint64]interface{}{}
+		for vr, val := range varValJSON {
+			id, err := strconv.ParseUint(vr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid variable ID %v", vr)
+			}
+			varValMap[id] = val
+		}
+		andGroup[operator] = varValMap
+	}
+	return normalizeAndGroup(andGroup)
+}
+
+// StatementCondition converts the condition of a statement into an expression tree, along with its random weight
+// The condition is that of its OrGroup, see NormalizeOrGroup, ANDed with its Condition expression tree.
+func StatementCondition(stmt prepare.RawLStatement) (Expr, *Random, error) {
+	random, err := parseRandom(stmt.Random)
+	if err != nil {
+		return nil, nil, err
+	}
+	condition, err := NormalizeOrGroup(stmt.Operators)
+	if err != nil || stmt.Condition == nil {
+		return condition, random, err
+	}
+	expr, err := ParseExpr(stmt.Condition)
+	if err != nil {
+		return nil, nil, fmt.Errorf("condition: %v", err)
+	}
+	if condition == nil {
+		return expr, random, nil
+	}
+	and := ExprAnd{}
+	if all, ok := condition.(ExprAnd); ok {
+		and = append(and, all...)
+	} else {
+		and = append(and, condition)
+	}
+	return append(and, expr), random, nil
+}
+
+func parseExprList(v interface{}) ([]Expr, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of expressions, found %T", v)
+	}
+	exprs := make([]Expr, len(list))
+	for i, item := range list {
+		var err error
+		exprs[i], err = ParseExpr(item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return exprs, nil
+}
+
+// NormalizeOrGroup converts an OrGroup into the equivalent expression tree
+// An OrGroup of AndGroups becomes an ExprOr of ExprAnds of ExprCompares,
+// where single child nodes are collapsed into the child itself.
+// A nil or empty OrGroup has no condition and returns nil.
+func NormalizeOrGroup(o *models.OrGroup) (Expr, error) {
+	if o == nil || len(*o) == 0 {
+		return nil, nil
+	}
+	or := ExprOr{}
+	for _, andGroup := range *o {
+		expr, err := normalizeAndGroup(andGroup)
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, expr)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func normalizeAndGroup(andGroup models.AndGroup) (Expr, error) {
+	operators := []string{}
+	for operator := range andGroup {
+		operators = append(operators, operator)
+	}
+	sort.Strings(operators)
+
+	and := ExprAnd{}
+	for _, operator := range operators {
+		varValMap := andGroup[operator]
+		vars := []uint64{}
+		for vr := range varValMap {
+			vars = append(vars, vr)
+		}
+		sort.Slice(vars, func(i, j int) bool { return vars[i] < vars[j] })
+
+		for _, vr := range vars {
+			val, err := normalizeValue(varValMap[vr])
+			if err != nil {
+				return nil, fmt.Errorf("operator %v on variable %v: %v", operator, vr, err)
+			}
+			and = append(and, ExprCompare{operator, vr, val})
+		}
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+/**
+* compileHelper converts a condition expression into a prefix encoded byte slice
+* Every node begins with its ExprTag, and the children of and/or/not nodes follow their parent.
+ */
+func compileHelper(expr Expr) ([]byte, error) {
+	OperatorStrIntMap := GenerateOperatorStrIntMap()
+
+	switch e := expr.(type) {
+	case nil:
+		return []byte{uint8(ExprTagNone)}, nil
+	case ExprAnd:
+		return compileExprList(ExprTagAnd, e)
+	case ExprOr:
+		return compileExprList(ExprTagOr, e)
+	case ExprNot:
+		if e.Expr == nil {
+			return nil, fmt.Errorf("not without an expression")
+		}
+		compiled, err := compileHelper(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{uint8(ExprTagNot)}, compiled...), nil
+	case ExprCompare:
+		operator, ok := OperatorStrIntMap[e.Operator]
+		if !ok {
+			return nil, fmt.Errorf("unknown operator %v", e.Operator)
+		}
+		if err := validateComparison(e.Operator, e.Value); err != nil {
+			return nil, fmt.Errorf("variable %v: %v", e.Var, err)
+		}
+		compiled := make([]byte, 10)
+		compiled[0] = uint8(ExprTagCompare)
+		compiled[1] = operator
+		// Store the variable ID
+		binary.LittleEndian.PutUint64(compiled[2:], e.Var)
+		// Store an enum that identifies the value type, followed by the value
+		value, err := compileValue(e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("operator %v on variable %v: %v", e.Operator, e.Var, err)
+		}
+		return append(compiled, value...), nil
+	case ExprCalc:
+		operator, ok := OperatorStrIntMap[e.Operator]
+		if !ok {
+			return nil, fmt.Errorf("unknown operator %v", e.Operator)
+		}
+		if err := checkCalcComparison(e.Operator, e.Right); err != nil {
+			return nil, err
+		}
+		left, err := compileCalc(e.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := compileCalc(e.Right)
+		if err != nil {
+			return nil, err
+		}
+		compiled := []byte{uint8(ExprTagCalc), operator}
+		return append(append(compiled, left...), right...), nil
+	}
+	return nil, fmt.Errorf("unknown expression %T", expr)
+}
+
+func compileExprList(tag ExprTag, exprs []Expr) ([]byte, error) {
+	if err := checkUint8("expression", len(exprs)); err != nil {
+		return nil, err
+	}
+	compiled := []byte{uint8(tag), uint8(len(exprs))}
+	for _, expr := range exprs {
+		if expr == nil {
+			return nil, fmt.Errorf("empty expression")
+		}
+		b, err := compileHelper(expr)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, b...)
+	}
+	return compiled, nil
+}
@@ -2,96 +2,257 @@ package helpers
 
 import (
 	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
 
 	"github.com/talkative-ai/core/common"
 	"github.com/talkative-ai/core/models"
 )
 
-/**
-* compileHelper converts an OrGroup into a byte slice
-* where an OrGroup is an array of AndGroups
- */
-func compileHelper(o *models.OrGroup) []byte {
-	compiled := []byte{}
-	OperatorStrIntMap := models.GenerateOperatorStrIntMap()
-
-	// Iterate through all AndGroups
-	for _, AndGroup := range *o {
-		for operator, varValMap := range AndGroup {
-			// Each AndGroup is associated with a logical operator
-			// Store that here
-			compiled = append(compiled, byte(OperatorStrIntMap[operator]))
-			for vr, val := range varValMap {
-				b := make([]byte, 8)
-				// Store the variable ID
-				binary.LittleEndian.PutUint64(b, uint64(vr))
-				compiled = append(compiled, b...)
-				switch v := val.(type) {
-				case string:
-					// Store an enum that identifies the value type which is being set
-					// TODO: Determine if this is needed
-					compiled = append(compiled, uint8(0))
-					b := make([]byte, 2)
-					binary.LittleEndian.PutUint16(b, uint16(len(v)))
-					compiled = append(compiled, b...)
-					// Store the value itself
-					compiled = append(compiled, []byte(v)...)
-					break
-				case int:
-					compiled = append(compiled, uint8(1))
-					b := make([]byte, 4)
-					binary.LittleEndian.PutUint32(b, uint32(v))
-					compiled = append(compiled, b...)
-					break
-				}
+// ValueType identifies how a comparison value is encoded within a compiled logical block
+type ValueType uint8
+
+const (
+	// ValueTypeString is a uint16 length followed by the string bytes
+	ValueTypeString ValueType = iota
+	// ValueTypeInt is a little endian int32
+	ValueTypeInt
+	// ValueTypeFloat is a little endian IEEE 754 float64
+	// JSON numbers are always unmarshalled as float64
+	ValueTypeFloat
+	// ValueTypeBool is a uint8 of either 0 or 1
+	ValueTypeBool
+	// ValueTypeNull has no value following it
+	ValueTypeNull
+	// ValueTypeVar is the uint64 ID of another variable to compare against
+	ValueTypeVar
+	// ValueTypeList is a uint8 number of values followed by the values
+	ValueTypeList
+	// ValueTypeCalc is a uint16 length followed by a postfix Calc program
+	ValueTypeCalc
+)
+
+// VarRef is a comparison value which refers to another variable,
+// so that {"gte": {gold: VarRef(price)}} compares gold against price.
+// Within project JSON a reference is written as {"var": <variable id>}
+type VarRef uint64
+
+func (v VarRef) String() string {
+	return fmt.Sprintf("#%v", uint64(v))
+}
+
+// normalizeValue converts the JSON object forms of a comparison value,
+// {"var": <variable id>} and {"calc": "<arithmetic>"}, into a VarRef or Calc
+func normalizeValue(val interface{}) (interface{}, error) {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return val, nil
+	}
+	if text, ok := m["calc"]; ok && len(m) == 1 {
+		str, ok := text.(string)
+		if !ok {
+			return nil, fmt.Errorf("calc must be a string, found %T", text)
+		}
+		return ParseCalc(str)
+	}
+	return parseVarRef(m)
+}
+
+// parseVarRef reads the JSON form of a VarRef
+func parseVarRef(m map[string]interface{}) (VarRef, error) {
+	if len(m) != 1 {
+		return 0, fmt.Errorf("a variable reference must only contain \"var\"")
+	}
+	switch id := m["var"].(type) {
+	case float64:
+		if id < 0 || id != math.Trunc(id) {
+			return 0, fmt.Errorf("invalid variable reference %v", id)
+		}
+		return VarRef(id), nil
+	case VarRef:
+		return id, nil
+	}
+	return 0, fmt.Errorf("a variable reference must contain a numeric \"var\"")
+}
+
+// bsliceResult is a common.BSliceIndex along with any error met compiling it
+type bsliceResult struct {
+	common.BSliceIndex
+	Error error
+}
+
+// compileValue converts a comparison value into its value type enum and the value itself
+func compileValue(val interface{}) ([]byte, error) {
+	switch v := val.(type) {
+	case string:
+		if err := checkUint16("string value", len(v)); err != nil {
+			return nil, err
+		}
+		b := make([]byte, 3)
+		b[0] = uint8(ValueTypeString)
+		binary.LittleEndian.PutUint16(b[1:], uint16(len(v)))
+		// Store the value itself
+		return append(b, []byte(v)...), nil
+	case int:
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return nil, fmt.Errorf("integer %v does not fit within 32 bits", v)
+		}
+		b := make([]byte, 5)
+		b[0] = uint8(ValueTypeInt)
+		binary.LittleEndian.PutUint32(b[1:], uint32(v))
+		return b, nil
+	case float64:
+		b := make([]byte, 9)
+		b[0] = uint8(ValueTypeFloat)
+		binary.LittleEndian.PutUint64(b[1:], math.Float64bits(v))
+		return b, nil
+	case bool:
+		if v {
+			return []byte{uint8(ValueTypeBool), 1}, nil
+		}
+		return []byte{uint8(ValueTypeBool), 0}, nil
+	case nil:
+		return []byte{uint8(ValueTypeNull)}, nil
+	case Calc:
+		program, err := compileCalc(v)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{uint8(ValueTypeCalc)}, program...), nil
+	case VarRef:
+		b := make([]byte, 9)
+		b[0] = uint8(ValueTypeVar)
+		binary.LittleEndian.PutUint64(b[1:], uint64(v))
+		return b, nil
+	case []interface{}:
+		if err := checkUint8("list value", len(v)); err != nil {
+			return nil, err
+		}
+		b := []byte{uint8(ValueTypeList), uint8(len(v))}
+		for _, item := range v {
+			compiled, err := compileValue(item)
+			if err != nil {
+				return nil, err
 			}
+			b = append(b, compiled...)
 		}
+		return b, nil
 	}
+	return nil, fmt.Errorf("unsupported comparison value %#v of type %T", val, val)
+}
 
-	return compiled
+// Block is a logical block whose conditions have been normalized into expression trees
+// It mirrors models.LBlock, and is what is ultimately converted into bytes
+type Block struct {
+	AlwaysExec string
+	// A nil Statements means the block has no statements at all
+	Statements [][]Statement
 }
 
-func compileStatement(stmt models.LStatement, idx int, cinner chan common.BSliceIndex) {
-	bslice := []byte{}
+// Statement mirrors models.LStatement with its condition as an expression tree
+// A nil Condition is an "else" and always runs
+// Random is only set for the statements of a random group. See prepare.RandomWeight
+type Statement struct {
+	Condition Expr
+	Exec      string
+	Random    *Random
+}
+
+// NormalizeLBlock converts the OrGroup conditions of an LBlock into expression trees
+func NormalizeLBlock(logic *models.LBlock) (*Block, error) {
+	block := &Block{AlwaysExec: logic.AlwaysExec}
+	if logic.Statements == nil {
+		return block, nil
+	}
+	block.Statements = make([][]Statement, len(*logic.Statements))
+	for i, statements := range *logic.Statements {
+		block.Statements[i] = make([]Statement, len(statements))
+		for j, stmt := range statements {
+			condition, err := NormalizeOrGroup(stmt.Operators)
+			if err != nil {
+				return nil, fmt.Errorf("statements %v: statement %v: %v", i, j, err)
+			}
+			block.Statements[i][j] = Statement{Condition: condition, Exec: stmt.Exec}
+		}
+	}
+	return block, nil
+}
 
-	// Store the number of operators
-	bslice = append(bslice, uint8(len(*stmt.Operators)))
-	// And compile every operator
+func compileStatement(stmt Statement, keys *keyTable, idx int, cinner chan bsliceResult) {
+	// Compile the condition
 	// This process is really small and we're already deep in goroutines
 	// So no need to make concurrent
-	bslice = append(bslice, compileHelper(stmt.Operators)...)
-
-	b := make([]byte, 2)
+	bslice, err := compileHelper(stmt.Condition)
+	if err != nil {
+		cinner <- bsliceResult{BSliceIndex: common.BSliceIndex{Index: idx}, Error: err}
+		return
+	}
 
 	// Exec is, of course an ActionBundle key
-	// Just store the length of the key and the key
-	binary.LittleEndian.PutUint16(b, uint16(len(stmt.Exec)))
-	bslice = append(bslice, b...)
-	bslice = append(bslice, []byte(stmt.Exec)...)
+	// Just store its index within the key table
+	bslice = append(bslice, keys.compileIndex(stmt.Exec)...)
+
+	// The statements of a random group are followed by their weight
+	if stmt.Random != nil {
+		b := make([]byte, 2)
+		binary.LittleEndian.PutUint16(b, stmt.Random.Weight)
+		bslice = append(bslice, b...)
+	}
 
 	// Sending back up the chain for concatentation to the whole compiled thing
 	bsliceidx := common.BSliceIndex{
 		Bslice: bslice,
 		Index:  idx,
 	}
-	cinner <- bsliceidx
+	cinner <- bsliceResult{BSliceIndex: bsliceidx}
 }
 
-func compileStatements(statements []models.LStatement, idx int, c chan common.BSliceIndex) {
+func compileStatements(statements []Statement, keys *keyTable, idx int, c chan bsliceResult) {
 	bslice := []byte{}
 
+	if err := checkUint8("statements array", len(statements)); err != nil {
+		c <- bsliceResult{BSliceIndex: common.BSliceIndex{Index: idx}, Error: err}
+		return
+	}
+
+	// Store how the group picks a statement to run
+	randoms := make([]*Random, len(statements))
+	for idx, stmt := range statements {
+		randoms[idx] = stmt.Random
+	}
+	kind, seed, err := CheckRandomGroup(randoms)
+	if err != nil {
+		c <- bsliceResult{BSliceIndex: common.BSliceIndex{Index: idx}, Error: err}
+		return
+	}
+	bslice = append(bslice, uint8(kind))
+	if kind == GroupKindRandomSeeded {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, seed)
+		bslice = append(bslice, b...)
+	}
+
 	// Store the number of statements
 	bslice = append(bslice, uint8(len(statements)))
 
 	// Just as in CompileLogic, we compile each item internally here
-	cinner := make(chan common.BSliceIndex)
+	cinner := make(chan bsliceResult)
 	for idx, stmt := range statements {
-		go compileStatement(stmt, idx, cinner)
+		go compileStatement(stmt, keys, idx, cinner)
 	}
 
 	newBytes := make([][]byte, len(statements))
 	reg := 0
+	if len(statements) == 0 {
+		// Nothing will ever be sent, so don't wait on it
+		close(cinner)
+	}
 	for b := range cinner {
+		// Keep the first error but continue to drain the channel
+		if b.Error != nil && err == nil {
+			err = fmt.Errorf("statement %v: %v", b.Index, b.Error)
+		}
 		// Sort the results as they come in
 		newBytes[b.Index] = b.Bslice
 		reg++
@@ -100,12 +261,17 @@ func compileStatements(statements []models.LStatement, idx int, c chan common.BS
 		}
 	}
 
+	if err != nil {
+		c <- bsliceResult{BSliceIndex: common.BSliceIndex{Index: idx}, Error: err}
+		return
+	}
+
 	for _, b := range newBytes {
-		// Append the compiled LStatement to final result
+		// Append the compiled Statement to final result
 		bslice = append(bslice, b...)
 	}
 
-	// We could store the length of the entire []LStatement here
+	// We could store the length of the entire []Statement here
 	// That way when processing logic we could do it concurrently on Brahman
 	// But logic is processed sequentially as the runtime state mutates
 
@@ -113,67 +279,169 @@ func compileStatements(statements []models.LStatement, idx int, c chan common.BS
 		Bslice: bslice,
 		Index:  idx,
 	}
-	c <- bsliceidx
+	c <- bsliceResult{BSliceIndex: bsliceidx}
+}
+
+// keyTable is the shared string table of action bundle keys within a compiled block
+// The keys of a block nearly always share a long prefix, such as the publish and
+// dialog node IDs, so the prefix is stored once followed by what remains of each key.
+// Keys are referred to by their index within the table, starting at 1,
+// where 0 means there is no action bundle to run.
+type keyTable struct {
+	prefix string
+	keys   []string
+	index  map[string]uint16
+}
+
+// newKeyTable collects the keys of a block in the order they first appear
+func newKeyTable(logic *Block) (*keyTable, error) {
+	t := &keyTable{index: map[string]uint16{}}
+	add := func(key string) error {
+		if key == "" || t.index[key] != 0 {
+			return nil
+		}
+		if err := checkUint16("action bundle key", len(key)); err != nil {
+			return err
+		}
+		t.keys = append(t.keys, key)
+		if err := checkUint16("key table", len(t.keys)); err != nil {
+			return err
+		}
+		t.index[key] = uint16(len(t.keys))
+		return nil
+	}
+
+	if err := add(logic.AlwaysExec); err != nil {
+		return nil, err
+	}
+	for _, statements := range logic.Statements {
+		for _, stmt := range statements {
+			if err := add(stmt.Exec); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Find the longest prefix shared by every key
+	if len(t.keys) > 0 {
+		t.prefix = t.keys[0]
+		for _, key := range t.keys[1:] {
+			for !strings.HasPrefix(key, t.prefix) {
+				t.prefix = t.prefix[:len(t.prefix)-1]
+			}
+		}
+	}
+	return t, nil
+}
+
+// compile converts the table into bytes
+// The uint16 length prefixed prefix, then the uint16 number of keys,
+// then each uint16 length prefixed key without the prefix
+func (t *keyTable) compile() []byte {
+	b := make([]byte, 2, 4+len(t.prefix))
+	binary.LittleEndian.PutUint16(b, uint16(len(t.prefix)))
+	b = append(b, t.prefix...)
+
+	n := make([]byte, 2)
+	binary.LittleEndian.PutUint16(n, uint16(len(t.keys)))
+	b = append(b, n...)
+	for _, key := range t.keys {
+		binary.LittleEndian.PutUint16(n, uint16(len(key)-len(t.prefix)))
+		b = append(b, n...)
+		b = append(b, key[len(t.prefix):]...)
+	}
+	return b
+}
+
+// compileIndex converts a key into its uint16 index within the table
+func (t *keyTable) compileIndex(key string) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, t.index[key])
+	return b
 }
 
 // CompileLogic compiles the logical blocks within a dialog node or trigger
+// The OrGroup conditions are first normalized into expression trees. See CompileBlock
+func CompileLogic(logic *models.LBlock) ([]byte, error) {
+	block, err := NormalizeLBlock(logic)
+	if err != nil {
+		return nil, err
+	}
+	return CompileBlock(block)
+}
+
+// CompileBlock converts a logical block into bytes
 /**
-* The way this will be run is that Brahman will load an OrGroup,
-* and then begin iterating through the AndGroups.
-* Each AndGroup maps a logical operator to a map of variables and values
-* where each variable will be compared to the value via the logical operator.
-* In JSON that could Look something like this:
-	{
+* The way this will be run is that Brahman will load a statement's condition,
+* which is a prefix encoded expression tree of and/or/not nodes.
+* The leaves of the tree compare a variable to a value via a logical operator.
+* An OrGroup in JSON such as this:
+	[{
 		"eq": { foo: "bar", hello: "world" }
 		"ne": { mybar: "fooval" }
-	}
-* If an AndGroup resolves to true, then the OrGroup resolves to true,
-* which means the ActionBundle specified at Exec will then mutate the runtime state.
-* Which then completes the []LStatement before moving on to the next.
+	}]
+* Is the same as the expression:
+	foo == "bar" && hello == "world" && mybar != "fooval"
+* If the condition resolves to true, then the ActionBundle specified at Exec will then mutate the runtime state.
+* Which then completes the []Statement before moving on to the next.
 */
-func CompileLogic(logic *models.LBlock) []byte {
-	compiled := []byte{}
+func CompileBlock(logic *Block) ([]byte, error) {
+	if err := checkUint8("logical block", len(logic.Statements)); err != nil {
+		return nil, err
+	}
 
-	b := make([]byte, 2)
+	// Every action bundle key is stored once within the key table,
+	// and referred to by its index from then on
+	keys, err := newKeyTable(logic)
+	if err != nil {
+		return nil, err
+	}
+	compiled := keys.compile()
 
-	// Append the AlwaysExec length
-	binary.LittleEndian.PutUint16(b, uint16(len(logic.AlwaysExec)))
-	compiled = append(compiled, b...)
-	// and the AlwaysExec key
-	compiled = append(compiled, []byte(logic.AlwaysExec)...)
+	// Append the AlwaysExec key index
+	compiled = append(compiled, keys.compileIndex(logic.AlwaysExec)...)
 
 	if logic.Statements == nil {
-		return compiled
+		return compiled, nil
 	}
 
-	// Save the number of []LStatement slices
-	// Recall that logic.Statements.(type) == *[][]LStatement
-	compiled = append(compiled, uint8(len(*logic.Statements)))
+	// Save the number of []Statement slices
+	compiled = append(compiled, uint8(len(logic.Statements)))
 
-	// Prepare to compile the []LStatement slices concurrently
-	c := make(chan common.BSliceIndex)
-	for idx, conditional := range *logic.Statements {
-		go compileStatements(conditional, idx, c)
+	// Prepare to compile the []Statement slices concurrently
+	c := make(chan bsliceResult)
+	for idx, conditional := range logic.Statements {
+		go compileStatements(conditional, keys, idx, c)
 	}
 
 	// Used to organize the compiled values as they come in
-	newBytes := make([][]byte, len(*logic.Statements))
+	newBytes := make([][]byte, len(logic.Statements))
 	reg := 0
+	if len(logic.Statements) == 0 {
+		close(c)
+	}
 	for bslice := range c {
+		if bslice.Error != nil && err == nil {
+			err = fmt.Errorf("statements %v: %v", bslice.Index, bslice.Error)
+		}
 		// The channel passes back a byte slice (bslice) with the index
 		// We sort by bslice index as they come in
 		// Unsure if this is an anti-pattern or idiomatic. Just something I came up with.
 		newBytes[bslice.Index] = bslice.Bslice
 		reg++
-		if reg == len(*logic.Statements) {
+		if reg == len(logic.Statements) {
 			close(c)
 		}
 	}
 
-	// Finally iterate through the []LStatement bslices in order and append to the compiled output
+	if err != nil {
+		return nil, err
+	}
+
+	// Finally iterate through the []Statement bslices in order and append to the compiled output
 	for _, bslice := range newBytes {
 		compiled = append(compiled, bslice...)
 	}
 
-	return compiled
+	return compiled, nil
 }
@@ -0,0 +1,289 @@
+package helpers
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+func TestCompileLogicDeterministic(t *testing.T) {
+	andGroup := models.AndGroup{}
+	for _, operator := range []string{"eq", "ne", "lt", "gt", "lte", "gte"} {
+		varValMap := map[uint64]interface{}{}
+		for vr := uint64(0); vr < 20; vr++ {
+			varValMap[vr] = float64(vr)
+		}
+		andGroup[operator] = varValMap
+	}
+	lblock := models.LBlock{
+		AlwaysExec: "bundle:0",
+		Statements: &[][]models.LStatement{
+			{
+				{Operators: &models.OrGroup{andGroup, andGroup}, Exec: "bundle:1"},
+				{Exec: "bundle:2"},
+			},
+		},
+	}
+
+	first, err := CompileLogic(&lblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		compiled, err := CompileLogic(&lblock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, compiled) {
+			t.Fatal("the same logical block compiled to different bytes")
+		}
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	project := models.Project{Title: "Story"}
+	items := []prepare.ProjectItem{
+		{DialogEntry: []string{"hello"}},
+		{DialogEntry: []string{"goodbye"}},
+	}
+	reversed := []prepare.ProjectItem{items[1], items[0]}
+
+	a, err := ContentHash(project, items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ContentHash(project, reversed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Error("the order of rows changed the content hash")
+	}
+
+	project.Title = "Another story"
+	c, err := ContentHash(project, items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == c {
+		t.Error("changing the title did not change the content hash")
+	}
+}
+
+func TestCompileLogicLimits(t *testing.T) {
+	statements := make([]models.LStatement, 300)
+	for i := range statements {
+		statements[i] = models.LStatement{Operators: &models.OrGroup{{"eq": {1: float64(i)}}}, Exec: "bundle:1"}
+	}
+
+	tests := map[string]models.LBlock{
+		"too many statements": {
+			AlwaysExec: "bundle:0",
+			Statements: &[][]models.LStatement{statements},
+		},
+		"long string value": {
+			AlwaysExec: "bundle:0",
+			Statements: &[][]models.LStatement{
+				{{Operators: &models.OrGroup{{"eq": {1: string(make([]byte, 70000))}}}, Exec: "bundle:1"}},
+			},
+		},
+		"large integer": {
+			AlwaysExec: "bundle:0",
+			Statements: &[][]models.LStatement{
+				{{Operators: &models.OrGroup{{"eq": {1: 1 << 40}}}, Exec: "bundle:1"}},
+			},
+		},
+		"long AlwaysExec key": {
+			AlwaysExec: string(make([]byte, 70000)),
+		},
+	}
+
+	for name, lblock := range tests {
+		if _, err := CompileLogic(&lblock); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
+
+func TestCompileLogicStringOperators(t *testing.T) {
+	valid := models.LBlock{
+		AlwaysExec: "bundle:0",
+		Statements: &[][]models.LStatement{
+			{
+				{
+					Operators: &models.OrGroup{{
+						"contains":   {1: "knight"},
+						"startswith": {2: "Sir"},
+						"endswith":   {3: VarRef(4)},
+						"ieq":        {5: "ni"},
+						"regex":      {6: "^[a-z]+$"},
+						"in":         {7: []interface{}{"red", "blue", 1.0}},
+					}},
+					Exec: "bundle:1",
+				},
+			},
+		},
+	}
+	if _, err := CompileLogic(&valid); err != nil {
+		t.Error(err)
+	}
+
+	invalid := map[string]models.AndGroup{
+		"bad regex":          {"regex": {1: "([a-z]"}},
+		"contains a number":  {"contains": {1: 1.0}},
+		"in without a list":  {"in": {1: "red"}},
+		"eq with a list":     {"eq": {1: []interface{}{"red"}}},
+		"in with a variable": {"in": {1: []interface{}{VarRef(2)}}},
+		"unknown operator":   {"like": {1: "red"}},
+	}
+	for name, andGroup := range invalid {
+		lblock := models.LBlock{
+			AlwaysExec: "bundle:0",
+			Statements: &[][]models.LStatement{
+				{{Operators: &models.OrGroup{andGroup}, Exec: "bundle:1"}},
+			},
+		}
+		if _, err := CompileLogic(&lblock); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
+
+func TestKeyTable(t *testing.T) {
+	block := &Block{
+		AlwaysExec: "",
+		Statements: [][]Statement{
+			{
+				{Condition: ExprCompare{"eq", 1, true}, Exec: "pub:node:bundle:1"},
+				{Condition: ExprCompare{"eq", 2, true}, Exec: "pub:node:bundle:2"},
+				{Exec: "pub:node:bundle:1"},
+			},
+		},
+	}
+	keys, err := newKeyTable(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.prefix != "pub:node:bundle:" || len(keys.keys) != 2 {
+		t.Errorf("expected a shared prefix and 2 keys, got %q and %v", keys.prefix, keys.keys)
+	}
+	if keys.index[""] != 0 || keys.index["pub:node:bundle:1"] != 1 || keys.index["pub:node:bundle:2"] != 2 {
+		t.Errorf("unexpected indexes %v", keys.index)
+	}
+
+	// The prefix and count, then the two suffixes
+	if compiled := keys.compile(); len(compiled) != 2+len(keys.prefix)+2+2*(2+1) {
+		t.Errorf("unexpected key table %v", compiled)
+	}
+}
+
+func TestRandomGroup(t *testing.T) {
+	compile := func(statements []prepare.RawLStatement) error {
+		block := &Block{Statements: [][]Statement{make([]Statement, len(statements))}}
+		for j, stmt := range statements {
+			condition, random, err := StatementCondition(stmt)
+			if err != nil {
+				return err
+			}
+			block.Statements[0][j] = Statement{Condition: condition, Exec: fmt.Sprintf("bundle:%v", j), Random: random}
+		}
+		_, err := CompileBlock(block)
+		return err
+	}
+
+	invalid := map[string][]prepare.RawLStatement{
+		"missing weight": {
+			{Random: &prepare.RandomWeight{Weight: 1}},
+			{},
+		},
+		"mixed seeds": {
+			{Random: &prepare.RandomWeight{Weight: 1, Seed: 1.0}},
+			{Random: &prepare.RandomWeight{Weight: 1, Seed: 2.0}},
+		},
+		"zero weight": {
+			{Random: &prepare.RandomWeight{Weight: 0}},
+		},
+		"fractional weight": {
+			{Random: &prepare.RandomWeight{Weight: 1.5}},
+		},
+		"seeded and not": {
+			{Random: &prepare.RandomWeight{Weight: 1, Seed: 0.0}},
+			{Random: &prepare.RandomWeight{Weight: 1}},
+		},
+		"unresolved seed": {
+			{Random: &prepare.RandomWeight{Weight: 1, Seed: "visits"}},
+		},
+		"random operator": {
+			{Operators: &models.OrGroup{{"random": {0: 1.0}}}},
+		},
+	}
+	for name, statements := range invalid {
+		if err := compile(statements); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+
+	stmt := prepare.RawLStatement{
+		Operators: &models.OrGroup{{"eq": {1: "a"}}},
+		Random:    &prepare.RandomWeight{Weight: 3, Seed: 5.0},
+	}
+	condition, random, err := StatementCondition(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *random != (Random{Weight: 3, Seeded: true, Seed: 5}) || condition != (ExprCompare{"eq", 1, "a"}) {
+		t.Errorf("unexpected statement %v %v", condition, random)
+	}
+
+	condition, random, err = StatementCondition(prepare.RawLStatement{Random: &prepare.RandomWeight{Weight: 2, Seed: 0.0}})
+	if err != nil || condition != nil || *random != (Random{Weight: 2, Seeded: true, Seed: 0}) {
+		t.Errorf("expected a weight seeded by variable 0, got %v %v %v", condition, random, err)
+	}
+	_, random, err = StatementCondition(prepare.RawLStatement{Random: &prepare.RandomWeight{Weight: 2}})
+	if err != nil || *random != (Random{Weight: 2}) {
+		t.Errorf("expected an unseeded weight, got %v %v", random, err)
+	}
+}
+
+func TestStatementCondition(t *testing.T) {
+	// a && (b || !c) && d, where d is written in the OrGroup and the rest as the Condition
+	stmt := prepare.RawLStatement{
+		Operators: &models.OrGroup{{"lt": {4: 10.0}}},
+		Random:    &prepare.RandomWeight{Weight: 2},
+		Condition: map[string]interface{}{"and": []interface{}{
+			map[string]interface{}{"eq": map[string]interface{}{"1": true}},
+			map[string]interface{}{"or": []interface{}{
+				map[string]interface{}{"gt": map[string]interface{}{"0": 3.0}},
+				map[string]interface{}{"not": map[string]interface{}{"eq": map[string]interface{}{"3": "x"}}},
+			}},
+		}},
+	}
+	condition, random, err := StatementCondition(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ExprAnd{
+		ExprCompare{"lt", 4, 10.0},
+		ExprAnd{
+			ExprCompare{"eq", 1, true},
+			ExprOr{ExprCompare{"gt", 0, 3.0}, ExprNot{ExprCompare{"eq", 3, "x"}}},
+		},
+	}
+	if !reflect.DeepEqual(condition, expected) || random == nil || random.Weight != 2 {
+		t.Errorf("unexpected condition %#v %v", condition, random)
+	}
+
+	condition, _, err = StatementCondition(prepare.RawLStatement{Condition: stmt.Condition})
+	if err != nil || !reflect.DeepEqual(condition, expected[1]) {
+		t.Errorf("expected the Condition alone without an OrGroup, got %#v %v", condition, err)
+	}
+
+	invalid := prepare.RawLStatement{Condition: []interface{}{}}
+	if _, _, err := StatementCondition(invalid); err == nil {
+		t.Error("expected an error for a condition which isn't an expression")
+	}
+}
@@ -0,0 +1,82 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/talkative-ai/core/models"
+)
+
+// Operators understood by lakshmi beyond those of models.GenerateOperatorStrIntMap
+// The core operators are bit flags up to 1 << 5, so these begin after them.
+const (
+	// OperatorContains is true when the variable contains the string value
+	OperatorContains uint8 = 64 + iota
+	// OperatorStartsWith is true when the variable begins with the string value
+	OperatorStartsWith
+	// OperatorEndsWith is true when the variable ends with the string value
+	OperatorEndsWith
+	// OperatorEqualFold is true when the variable equals the string value, ignoring case
+	OperatorEqualFold
+	// OperatorRegex is true when the variable matches the regular expression value
+	OperatorRegex
+	// OperatorIn is true when the variable equals any value within the list value
+	OperatorIn
+)
+
+// GenerateOperatorStrIntMap returns every operator lakshmi can compile,
+// mapping each operator as written in an AndGroup to its compiled byte
+func GenerateOperatorStrIntMap() map[string]uint8 {
+	operators := map[string]uint8{
+		"contains":   OperatorContains,
+		"startswith": OperatorStartsWith,
+		"endswith":   OperatorEndsWith,
+		"ieq":        OperatorEqualFold,
+		"regex":      OperatorRegex,
+		"in":         OperatorIn,
+	}
+	for str, op := range models.GenerateOperatorStrIntMap() {
+		operators[str] = uint8(op)
+	}
+	return operators
+}
+
+// validateComparison checks that a value makes sense for the operator,
+// so that a bad comparison fails the publish rather than the runtime
+func validateComparison(operator string, val interface{}) error {
+	if _, ok := val.([]interface{}); ok && operator != "in" {
+		return fmt.Errorf("operator %v does not accept a list", operator)
+	}
+	if _, ok := val.(Calc); ok {
+		return checkCalcComparison(operator, val)
+	}
+
+	switch operator {
+	case "contains", "startswith", "endswith", "ieq":
+		switch val.(type) {
+		case string, VarRef:
+			return nil
+		}
+		return fmt.Errorf("operator %v requires a string, found %T", operator, val)
+	case "regex":
+		pattern, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("operator regex requires a string pattern, found %T", val)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", pattern, err)
+		}
+	case "in":
+		list, ok := val.([]interface{})
+		if !ok {
+			return fmt.Errorf("operator in requires a list, found %T", val)
+		}
+		for _, item := range list {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}, VarRef, Calc:
+				return fmt.Errorf("operator in requires a list of literal values, found %T", item)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package helpers
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// BundledBlock is a logical block whose conditions have been normalized
+// and whose action bundles have been compiled, but not yet stored.
+// This is the form the optimizer works on, as it can see what each bundle contains.
+type BundledBlock struct {
+	AlwaysExec []byte
+	Statements [][]BundledStatement
+}
+
+// BundledStatement mirrors Statement with the compiled action bundle in place of its key
+type BundledStatement struct {
+	Condition Expr
+	Exec      []byte
+	Random    *Random
+}
+
+// keyedBundle is an action bundle along with the Redis key it is stored at
+type keyedBundle struct {
+	Key    string
+	Bundle []byte
+}
+
+// OptimizeStats tallies what the optimizer saved over a whole publish
+// It is shared between the goroutines compiling each dialog node
+type OptimizeStats struct {
+	bytes int64
+	keys  int64
+}
+
+func (s *OptimizeStats) add(bytes, keys int) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.bytes, int64(bytes))
+	atomic.AddInt64(&s.keys, int64(keys))
+}
+
+// Bytes returns the number of bytes that were not written to Redis
+func (s *OptimizeStats) Bytes() int64 {
+	return atomic.LoadInt64(&s.bytes)
+}
+
+// Keys returns the number of Redis keys that were not written
+func (s *OptimizeStats) Keys() int64 {
+	return atomic.LoadInt64(&s.keys)
+}
+
+func (s *OptimizeStats) String() string {
+	return fmt.Sprintf("%v bytes and %v keys", s.Bytes(), s.Keys())
+}
+
+// BundleRawLBlock compiles the action bundles of a RawLBlock concurrently
+// and normalizes its conditions into expression trees
+func BundleRawLBlock(raw *prepare.RawLBlock) (*BundledBlock, error) {
+	block := &BundledBlock{}
+	wg := sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		block.AlwaysExec = prepare.BundleActions(raw.AlwaysExec)
+	}()
+
+	if raw.Statements == nil {
+		wg.Wait()
+		return block, nil
+	}
+
+	block.Statements = make([][]BundledStatement, len(*raw.Statements))
+	for i, statements := range *raw.Statements {
+		block.Statements[i] = make([]BundledStatement, len(statements))
+		for j, stmt := range statements {
+			condition, random, err := StatementCondition(stmt)
+			if err != nil {
+				wg.Wait()
+				return nil, fmt.Errorf("statements %v: statement %v: %v", i, j, err)
+			}
+			block.Statements[i][j].Condition = condition
+			block.Statements[i][j].Random = random
+
+			wg.Add(1)
+			go func(i, j int, actions prepare.ActionSet) {
+				defer wg.Done()
+				block.Statements[i][j].Exec = prepare.BundleActions(actions)
+			}(i, j, stmt.Exec)
+		}
+	}
+
+	wg.Wait()
+	return block, nil
+}
+
+// keyBundles assigns a key to each action bundle in statement order,
+// returning the Block which refers to them along with the bundles to store.
+// Empty bundles are given the empty key and are not stored, unless keepEmpty is set.
+func (b *BundledBlock) keyBundles(key func(bundle []byte) string, keepEmpty bool) (*Block, []keyedBundle) {
+	bundles := []keyedBundle{}
+	bundleKey := func(bundle []byte) string {
+		if !keepEmpty && isEmptyBundle(bundle) {
+			return ""
+		}
+		k := key(bundle)
+		bundles = append(bundles, keyedBundle{k, bundle})
+		return k
+	}
+
+	block := &Block{AlwaysExec: bundleKey(b.AlwaysExec)}
+	if b.Statements == nil {
+		return block, bundles
+	}
+	block.Statements = make([][]Statement, len(b.Statements))
+	for i, statements := range b.Statements {
+		block.Statements[i] = make([]Statement, len(statements))
+		for j, stmt := range statements {
+			block.Statements[i][j] = Statement{Condition: stmt.Condition, Exec: bundleKey(stmt.Exec), Random: stmt.Random}
+		}
+	}
+	return block, bundles
+}
+
+// isEmptyBundle reports whether a bundle from prepare.BundleActions has no actions
+func isEmptyBundle(bundle []byte) bool {
+	return len(bundle) <= blob.HeaderLength
+}
+
+// storedSize is the number of bytes written to Redis for a compiled block and its bundles
+func storedSize(compiled []byte, bundles []keyedBundle) int {
+	size := len(compiled)
+	for _, b := range bundles {
+		size += len(b.Bundle)
+	}
+	return size
+}
+
+// OptimizeBlock returns an equivalent logical block which is cheaper to store and run.
+// Within each []Statement group it
+//
+//  1. Folds constant comparisons, dropping statements which can never be true,
+//     and turning those which are always true into an "else"
+//  2. Drops statements whose condition repeats an earlier one, as they can never run
+//  3. Merges neighbouring statements which run identical bundles into a single "or"
+//  4. Drops statements after an "else", as they can never run
+//  5. Drops trailing statements with empty bundles, as running them changes nothing
+//
+// Within a random group the order of the statements doesn't matter, and even an empty bundle
+// takes its share of the chances, so only the constant comparisons are folded.
+//
+// Groups left without statements are dropped, as are statements altogether if none remain.
+func OptimizeBlock(b *BundledBlock) *BundledBlock {
+	optimized := &BundledBlock{AlwaysExec: b.AlwaysExec}
+	for _, statements := range b.Statements {
+		group := optimizeStatements(statements)
+		if len(group) > 0 {
+			optimized.Statements = append(optimized.Statements, group)
+		}
+	}
+	return optimized
+}
+
+func optimizeStatements(statements []BundledStatement) []BundledStatement {
+	if len(statements) > 0 && statements[0].Random != nil {
+		return foldRandomStatements(statements)
+	}
+
+	group := []BundledStatement{}
+	seen := []Expr{}
+
+	for _, stmt := range statements {
+		// 1. Fold constant comparisons
+		if stmt.Condition != nil {
+			folded, known, value := FoldExpr(stmt.Condition)
+			if known && !value {
+				continue
+			}
+			stmt.Condition = folded
+			if known {
+				stmt.Condition = nil
+			}
+		}
+
+		// 2. Drop repeated conditions
+		repeated := false
+		for _, condition := range seen {
+			if reflect.DeepEqual(condition, stmt.Condition) {
+				repeated = true
+				break
+			}
+		}
+		if repeated {
+			continue
+		}
+		seen = append(seen, stmt.Condition)
+
+		// 3. Merge with the previous statement when running the same bundle
+		if last := len(group) - 1; last >= 0 && bytes.Equal(group[last].Exec, stmt.Exec) {
+			group[last].Condition = mergeOr(group[last].Condition, stmt.Condition)
+		} else {
+			group = append(group, stmt)
+		}
+
+		// 4. Nothing after an "else" can run
+		if stmt.Condition == nil {
+			break
+		}
+	}
+
+	// 5. Drop trailing statements that do nothing
+	for len(group) > 0 && isEmptyBundle(group[len(group)-1].Exec) {
+		group = group[:len(group)-1]
+	}
+	return group
+}
+
+// foldRandomStatements folds the constant comparisons within a random group
+func foldRandomStatements(statements []BundledStatement) []BundledStatement {
+	group := []BundledStatement{}
+	for _, stmt := range statements {
+		if stmt.Condition != nil {
+			folded, known, value := FoldExpr(stmt.Condition)
+			if known && !value {
+				continue
+			}
+			stmt.Condition = folded
+			if known {
+				stmt.Condition = nil
+			}
+		}
+		group = append(group, stmt)
+	}
+	return group
+}
+
+// mergeOr joins two conditions, where a nil condition is always true
+func mergeOr(a, b Expr) Expr {
+	if a == nil || b == nil {
+		return nil
+	}
+	if or, ok := a.(ExprOr); ok && len(or) < math.MaxUint8 {
+		return append(or[:len(or):len(or)], b)
+	}
+	return ExprOr{a, b}
+}
+
+// FoldExpr simplifies the constant parts of an expression
+// When known is set, the whole expression is constant and value is its result.
+// Otherwise folded is the simplified expression.
+func FoldExpr(expr Expr) (folded Expr, known bool, value bool) {
+	switch e := expr.(type) {
+	case ExprAnd:
+		return foldExprList(e, false)
+	case ExprOr:
+		return foldExprList(e, true)
+	case ExprNot:
+		child, known, value := FoldExpr(e.Expr)
+		if known {
+			return nil, true, !value
+		}
+		if not, ok := child.(ExprNot); ok {
+			return not.Expr, false, false
+		}
+		return ExprNot{child}, false, false
+	case ExprCompare:
+		if c, ok := e.Value.(Calc); ok {
+			e.Value = foldCalc(c)
+			if n, ok := e.Value.(CalcNumber); ok {
+				e.Value = float64(n)
+			}
+		}
+		if list, ok := e.Value.([]interface{}); ok && e.Operator == "in" && len(list) == 0 {
+			return nil, true, false
+		}
+		return e, false, false
+	case ExprCalc:
+		e.Left, e.Right = foldCalc(e.Left), foldCalc(e.Right)
+		left, leftOk := e.Left.(CalcNumber)
+		right, rightOk := e.Right.(CalcNumber)
+		if leftOk && rightOk {
+			if result, ok := compareNumbers(e.Operator, float64(left), float64(right)); ok {
+				return nil, true, result
+			}
+		}
+		return e, false, false
+	}
+	return expr, false, false
+}
+
+// foldExprList folds the children of an and (or when isOr is set)
+// The children which are constant are dropped, unless they decide the result.
+func foldExprList(exprs []Expr, isOr bool) (Expr, bool, bool) {
+	children := []Expr{}
+	for _, expr := range exprs {
+		child, known, value := FoldExpr(expr)
+		if known && value == isOr {
+			// true within an or, or false within an and
+			return nil, true, isOr
+		}
+		if !known {
+			children = append(children, child)
+		}
+	}
+	switch len(children) {
+	case 0:
+		// Every child was true within an and, or false within an or
+		return nil, true, !isOr
+	case 1:
+		return children[0], false, false
+	}
+	if isOr {
+		return ExprOr(children), false, false
+	}
+	return ExprAnd(children), false, false
+}
+
+// foldCalc computes the parts of an arithmetic expression which don't depend on variables
+// Division by zero is left alone, so that it fails at runtime as written.
+func foldCalc(c Calc) Calc {
+	switch v := c.(type) {
+	case CalcNeg:
+		inner := foldCalc(v.Calc)
+		if n, ok := inner.(CalcNumber); ok {
+			return -n
+		}
+		return CalcNeg{inner}
+	case CalcBinary:
+		left, right := foldCalc(v.Left), foldCalc(v.Right)
+		a, leftOk := left.(CalcNumber)
+		b, rightOk := right.(CalcNumber)
+		if !leftOk || !rightOk {
+			return CalcBinary{v.Op, left, right}
+		}
+		switch v.Op {
+		case '+':
+			return a + b
+		case '-':
+			return a - b
+		case '*':
+			return a * b
+		case '/':
+			if b != 0 {
+				return a / b
+			}
+		case '%':
+			if b != 0 {
+				return CalcNumber(math.Mod(float64(a), float64(b)))
+			}
+		}
+		return CalcBinary{v.Op, left, right}
+	}
+	return c
+}
+
+// compareNumbers applies a numeric comparison operator
+// ok is false when the operator doesn't compare numbers
+func compareNumbers(operator string, a, b float64) (result bool, ok bool) {
+	switch operator {
+	case "eq":
+		return a == b, true
+	case "ne":
+		return a != b, true
+	case "lt":
+		return a < b, true
+	case "gt":
+		return a > b, true
+	case "lte":
+		return a <= b, true
+	case "gte":
+		return a >= b, true
+	}
+	return false, false
+}
@@ -0,0 +1,130 @@
+package helpers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/lakshmi/blob"
+)
+
+// testBundle returns a fake action bundle, which is empty for an empty name
+func testBundle(name string) []byte {
+	return append(blob.Header(blob.KindActionBundle), []byte(name)...)
+}
+
+func TestOptimizeBlock(t *testing.T) {
+	a := ExprCompare{Operator: "eq", Var: 1, Value: "a"}
+	b := ExprCompare{Operator: "eq", Var: 2, Value: "b"}
+	always := ExprCalc{Operator: "gt", Left: CalcNumber(3), Right: CalcBinary{'-', CalcNumber(2), CalcNumber(1)}}
+	never := ExprAnd{a, ExprNot{always}}
+
+	block := &BundledBlock{
+		AlwaysExec: testBundle(""),
+		Statements: [][]BundledStatement{
+			// Merged neighbours, a repeated condition and a constant false condition
+			{
+				{Condition: a, Exec: testBundle("x")},
+				{Condition: b, Exec: testBundle("x")},
+				{Condition: a, Exec: testBundle("y")},
+				{Condition: never, Exec: testBundle("y")},
+				{Condition: ExprCompare{Operator: "in", Var: 3, Value: []interface{}{}}, Exec: testBundle("y")},
+				{Exec: testBundle("z")},
+			},
+			// A constant true condition becomes an "else", and what follows is dropped
+			{
+				{Condition: ExprAnd{b, always}, Exec: testBundle("x")},
+				{Condition: ExprOr{never, always}, Exec: testBundle("y")},
+				{Condition: a, Exec: testBundle("z")},
+			},
+			// Trailing empty bundles are dropped, leaving nothing
+			{
+				{Condition: a, Exec: testBundle("")},
+				{Exec: testBundle("")},
+			},
+			{},
+		},
+	}
+	expected := &BundledBlock{
+		AlwaysExec: testBundle(""),
+		Statements: [][]BundledStatement{
+			{
+				{Condition: ExprOr{a, b}, Exec: testBundle("x")},
+				{Exec: testBundle("z")},
+			},
+			{
+				{Condition: b, Exec: testBundle("x")},
+				{Exec: testBundle("y")},
+			},
+		},
+	}
+
+	optimized := OptimizeBlock(block)
+	if !reflect.DeepEqual(optimized, expected) {
+		t.Errorf("expected %+v, got %+v", expected, optimized)
+	}
+
+	// Only the non-empty bundles are stored
+	lblock, bundles := optimized.keyBundles(func(bundle []byte) string { return fmt.Sprintf("bundle:%s", bundle) }, false)
+	if lblock.AlwaysExec != "" || len(bundles) != 4 {
+		t.Errorf("expected an empty AlwaysExec and 4 bundles, got %+v and %v bundles", lblock, len(bundles))
+	}
+	if _, err := CompileBlock(lblock); err != nil {
+		t.Fatal(err)
+	}
+
+	if optimized := OptimizeBlock(&BundledBlock{Statements: [][]BundledStatement{{{Exec: testBundle("")}}}}); optimized.Statements != nil {
+		t.Errorf("expected no statements, got %+v", optimized.Statements)
+	}
+}
+
+func TestFoldExpr(t *testing.T) {
+	// #1 > 2 * 3 folds its constant side
+	folded, known, _ := FoldExpr(ExprCalc{"gt", CalcVar(1), CalcBinary{'*', CalcNumber(2), CalcNumber(3)}})
+	if known || !reflect.DeepEqual(folded, ExprCalc{"gt", CalcVar(1), CalcNumber(6)}) {
+		t.Errorf("unexpected fold %v", folded)
+	}
+
+	// A constant calc value becomes a plain number
+	folded, known, _ = FoldExpr(ExprCompare{"lt", 1, CalcNeg{CalcNumber(4)}})
+	if known || !reflect.DeepEqual(folded, ExprCompare{"lt", 1, float64(-4)}) {
+		t.Errorf("unexpected fold %v", folded)
+	}
+
+	// Division by zero is left for the runtime
+	folded, known, _ = FoldExpr(ExprCalc{"eq", CalcBinary{'/', CalcNumber(1), CalcBinary{'-', CalcNumber(1), CalcNumber(1)}}, CalcNumber(0)})
+	if known {
+		t.Errorf("expected division by zero not to fold, got %v", folded)
+	}
+
+	// Double negation cancels
+	a := ExprCompare{"eq", 1, true}
+	folded, known, _ = FoldExpr(ExprNot{ExprNot{a}})
+	if known || !reflect.DeepEqual(folded, a) {
+		t.Errorf("unexpected fold %v", folded)
+	}
+}
+
+func TestOptimizeRandomBlock(t *testing.T) {
+	a := ExprCompare{Operator: "eq", Var: 1, Value: "a"}
+	never := ExprCompare{Operator: "in", Var: 2, Value: []interface{}{}}
+	block := &BundledBlock{
+		Statements: [][]BundledStatement{{
+			{Condition: a, Exec: testBundle("x"), Random: &Random{Weight: 1}},
+			{Condition: a, Exec: testBundle("x"), Random: &Random{Weight: 1}},
+			{Condition: never, Exec: testBundle("y"), Random: &Random{Weight: 1}},
+			{Exec: testBundle(""), Random: &Random{Weight: 8}},
+		}},
+	}
+	// Only the statement which can never be picked is dropped
+	expected := &BundledBlock{
+		Statements: [][]BundledStatement{{
+			block.Statements[0][0],
+			block.Statements[0][1],
+			block.Statements[0][3],
+		}},
+	}
+	if optimized := OptimizeBlock(block); !reflect.DeepEqual(optimized, expected) {
+		t.Errorf("expected %+v, got %+v", expected, optimized)
+	}
+}
@@ -1,22 +1,96 @@
 package helpers
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
 
 	"github.com/talkative-ai/core/db"
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/blob"
+	"github.com/talkative-ai/lakshmi/prepare"
 )
 
-func CreateVersionedProject(tx *sql.Tx, projectID string, version int64) error {
-	submitQuery := `
-		INSERT INTO static_published_projects_versioned
-			("ProjectID", "Version", "Title", "Category", "Tags", "ProjectData", "TriggerData")
-		SELECT
-			$1 "ProjectID",
-			$2 "Version",
-			p."Title",
-			p."Category",
-			p."Tags",
-			COALESCE((
+// ContentHash returns a hash of everything that the dialogs and triggers of a publish are compiled from,
+// along with the compiled format version.
+// Compilation is deterministic, so two publishes with the same hash
+// write exactly the same data to Redis.
+func ContentHash(project models.Project, items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem) (string, error) {
+	// The rows arrive in no particular order, so each row is
+	// serialized on its own and the rows are sorted
+	rows := []string{}
+	for _, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return "", err
+		}
+		rows = append(rows, "item:"+string(b))
+	}
+	for _, trigger := range triggers {
+		b, err := json.Marshal(trigger)
+		if err != nil {
+			return "", err
+		}
+		rows = append(rows, "trigger:"+string(b))
+	}
+	sort.Strings(rows)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "format:%v\n", blob.Version)
+	fmt.Fprintf(hash, "title:%q\n", project.Title)
+	fmt.Fprintf(hash, "start_zone_id:%v\n", project.StartZoneID.UUID.String())
+	for _, row := range rows {
+		fmt.Fprintf(hash, "%v\n", row)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Project is the dialogs and triggers of a project, as lakshmi reads them
+// Core would drop what lakshmi adds to the logical blocks, so they are decoded by lakshmi itself.
+// See prepare.RawLBlock
+type Project struct {
+	ProjectData []prepare.ProjectItem
+	TriggerData []prepare.ProjectTriggerItem
+}
+
+// projectRows is the JSON of the dialogs and triggers of a project, as it is selected
+type projectRows struct {
+	ProjectData string
+	TriggerData string
+}
+
+func (rows projectRows) decode() (Project, error) {
+	project := Project{}
+	if err := json.Unmarshal([]byte(rows.ProjectData), &project.ProjectData); err != nil {
+		return project, fmt.Errorf("invalid project data: %v", err)
+	}
+	if err := json.Unmarshal([]byte(rows.TriggerData), &project.TriggerData); err != nil {
+		return project, fmt.Errorf("invalid trigger data: %v", err)
+	}
+	return project, nil
+}
+
+// GetVersionedProject loads a project as it was submitted for the given version
+func GetVersionedProject(projectID uuid.UUID, version int64) (Project, error) {
+	var rows projectRows
+	err := db.DBMap.SelectOne(&rows, `
+			SELECT "ProjectData", "TriggerData"
+			FROM static_published_projects_versioned
+			WHERE "ProjectID"=$1
+			AND "Version"=$2
+		`, projectID, version)
+	if err != nil {
+		return Project{}, err
+	}
+	return rows.decode()
+}
+
+// workbenchProjectData selects the dialog nodes of the workbench project $1, as prepare.ProjectItem
+const workbenchProjectData = `COALESCE((
 				SELECT jsonb_agg(data)
 				FROM (
 					SELECT DISTINCT
@@ -44,8 +118,10 @@ func CreateVersionedProject(tx *sql.Tx, projectID string, version int64) error {
 							ON dr."ParentNodeID"=d."ID" OR dr."ChildNodeID"=d."ID"
 						WHERE p."ID"=$1
 				) data
-			), '[]'::jsonb) AS "ProjectData",
-			COALESCE((
+			), '[]'::jsonb)`
+
+// workbenchTriggerData selects the triggers of the workbench project $1, as prepare.ProjectTriggerItem
+const workbenchTriggerData = `COALESCE((
 				SELECT jsonb_agg(triggers)
 				FROM (
 					SELECT DISTINCT
@@ -59,7 +135,74 @@ func CreateVersionedProject(tx *sql.Tx, projectID string, version int64) error {
 						ON trig."ZoneID"=zone."ID"
 					WHERE zone."ProjectID"=$1
 				) triggers
-			), '[]'::jsonb) AS "TriggerData"
+			), '[]'::jsonb)`
+
+// GetWorkbenchProject loads the dialogs and triggers of a project as they are in the workbench,
+// the same as they would be submitted
+func GetWorkbenchProject(projectID uuid.UUID) (Project, error) {
+	query := `
+		SELECT
+			` + workbenchProjectData + ` AS "ProjectData",
+			` + workbenchTriggerData + ` AS "TriggerData"
+	`
+	var rows projectRows
+	if err := db.DBMap.SelectOne(&rows, query, projectID); err != nil {
+		return Project{}, err
+	}
+	return rows.decode()
+}
+
+// LockWorkbenchProject locks the dialog nodes and triggers of a workbench project until tx ends,
+// then loads them as GetWorkbenchProject does, so that they may be written back without losing a change made meanwhile
+// The project row is locked as well, so that two such transactions over a project take turns.
+func LockWorkbenchProject(tx *sql.Tx, projectID uuid.UUID) (Project, error) {
+	locks := []string{
+		`SELECT "ID" FROM workbench_projects WHERE "ID"=$1 FOR UPDATE`,
+		`SELECT d."ID"
+			FROM workbench_dialog_nodes d
+			JOIN workbench_zones_actors za
+				ON za."ActorID"=d."ActorID"
+			JOIN workbench_zones z
+				ON z."ID"=za."ZoneID"
+			WHERE z."ProjectID"=$1
+			FOR UPDATE OF d`,
+		`SELECT trig."ZoneID"
+			FROM workbench_triggers trig
+			JOIN workbench_zones zone
+				ON zone."ID"=trig."ZoneID"
+			WHERE zone."ProjectID"=$1
+			FOR UPDATE OF trig`,
+	}
+	for _, lock := range locks {
+		if _, err := tx.Exec(lock, projectID); err != nil {
+			return Project{}, err
+		}
+	}
+
+	query := `
+		SELECT
+			` + workbenchProjectData + ` AS "ProjectData",
+			` + workbenchTriggerData + ` AS "TriggerData"
+	`
+	var rows projectRows
+	if err := tx.QueryRow(query, projectID).Scan(&rows.ProjectData, &rows.TriggerData); err != nil {
+		return Project{}, err
+	}
+	return rows.decode()
+}
+
+func CreateVersionedProject(tx *sql.Tx, projectID string, version int64) error {
+	submitQuery := `
+		INSERT INTO static_published_projects_versioned
+			("ProjectID", "Version", "Title", "Category", "Tags", "ProjectData", "TriggerData")
+		SELECT
+			$1 "ProjectID",
+			$2 "Version",
+			p."Title",
+			p."Category",
+			p."Tags",
+			` + workbenchProjectData + ` AS "ProjectData",
+			` + workbenchTriggerData + ` AS "TriggerData"
 		FROM (
 			SELECT
 				"Title",
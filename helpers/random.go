@@ -0,0 +1,89 @@
+package helpers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// Random is the weight of a statement within a random []Statement group
+type Random struct {
+	Weight uint16
+	// Seeded is true when the value of the Seed variable decides the choice
+	Seeded bool
+	Seed   uint64
+}
+
+// GroupKind identifies how a compiled []Statement group picks the statement to run
+type GroupKind uint8
+
+const (
+	// GroupKindFirst runs the first statement whose condition is true
+	GroupKindFirst GroupKind = iota
+	// GroupKindRandom runs one of the true statements at random by weight
+	// Each statement is followed by its uint16 weight
+	GroupKindRandom
+	// GroupKindRandomSeeded is GroupKindRandom, followed by the uint64 ID of the seed variable
+	GroupKindRandomSeeded
+)
+
+// parseRandom reads the random weight of a statement, if it has one
+// When any statement of a []Statement group has a weight, every statement must,
+// and rather than the first true statement running, one of the true statements
+// is picked at random in proportion to its weight.
+func parseRandom(weight *prepare.RandomWeight) (*Random, error) {
+	if weight == nil {
+		return nil, nil
+	}
+	w := weight.Weight
+	if w < 1 || w > math.MaxUint16 || w != math.Trunc(w) {
+		return nil, fmt.Errorf("random weight %v must be a whole number from 1 to %v", w, math.MaxUint16)
+	}
+	random := &Random{Weight: uint16(w)}
+	if weight.Seed == nil {
+		return random, nil
+	}
+	seed, ok := weight.Seed.(float64)
+	if !ok || seed < 0 || seed != math.Trunc(seed) {
+		return nil, fmt.Errorf("random seed must be a variable, found %v", weight.Seed)
+	}
+	random.Seeded, random.Seed = true, uint64(seed)
+	return random, nil
+}
+
+// CheckRandomGroup checks that either every statement of a group has a random weight
+// or none do, and that the weights share the same seed.
+// It returns the kind of the group, and its seed variable if any.
+func CheckRandomGroup(randoms []*Random) (GroupKind, uint64, error) {
+	if len(randoms) == 0 || randoms[0] == nil {
+		for idx, random := range randoms {
+			if random != nil {
+				return 0, 0, fmt.Errorf("statement %v has a random weight, but statement 0 does not", idx)
+			}
+		}
+		return GroupKindFirst, 0, nil
+	}
+
+	first := randoms[0]
+	for idx, random := range randoms {
+		if random == nil {
+			return 0, 0, fmt.Errorf("statement %v has no random weight, but statement 0 does", idx)
+		}
+		if random.Seeded != first.Seeded || random.Seed != first.Seed {
+			return 0, 0, fmt.Errorf("statement %v is %v, but statement 0 is %v", idx, random.seeding(), first.seeding())
+		}
+	}
+	if !first.Seeded {
+		return GroupKindRandom, 0, nil
+	}
+	return GroupKindRandomSeeded, first.Seed, nil
+}
+
+// seeding describes how the choice of a statement is seeded, for errors
+func (r *Random) seeding() string {
+	if !r.Seeded {
+		return "not seeded"
+	}
+	return fmt.Sprintf("seeded by variable %v", r.Seed)
+}
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/mux"
 	"github.com/talkative-ai/core/db"
 	"github.com/talkative-ai/core/redis"
 	"github.com/talkative-ai/core/router"
+	"github.com/talkative-ai/lakshmi/prepare"
 	"github.com/talkative-ai/lakshmi/routes"
 )
 
@@ -30,6 +32,13 @@ func main() {
 	}
 	defer redis.Instance.Close()
 
+	// Audio is only prepared for smart speakers when there is somewhere to serve it from
+	mediaDir, mediaURL := os.Getenv("LAKSHMI_MEDIA_DIR"), os.Getenv("LAKSHMI_MEDIA_URL")
+	if mediaDir != "" && mediaURL != "" {
+		routes.Media = prepare.NewMedia(mediaDir, mediaURL)
+		log.Println("Preparing media into", mediaDir, "served at", mediaURL)
+	}
+
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
 	})
@@ -37,6 +46,10 @@ func main() {
 	r := mux.NewRouter()
 	router.ApplyRoute(r, routes.PostSubmit)
 	router.ApplyRoute(r, routes.PostPublish)
+	router.ApplyRoute(r, routes.PutVariables)
+	router.ApplyRoute(r, routes.PutLocales)
+	router.ApplyRoute(r, routes.GetTranslations)
+	router.ApplyRoute(r, routes.PutTranslations)
 
 	http.Handle("/", r)
 
@@ -2,13 +2,16 @@ package prepare
 
 import (
 	"encoding/binary"
+	"fmt"
 
 	"github.com/talkative-ai/core/common"
 	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/blob"
 )
 
-func BundleActions(AAS models.ActionSet) []byte {
-	bundle := []byte{}
+// BundleActions compiles the actions of an ActionSet into an action bundle
+func BundleActions(AAS ActionSet) []byte {
+	bundle := blob.Header(blob.KindActionBundle)
 	cinner := make(chan common.BSliceIndex)
 	actionCount := 0
 	for range AAS.Iterable() {
@@ -18,27 +21,15 @@ func BundleActions(AAS models.ActionSet) []byte {
 	i := 0
 	for a := range AAS.Iterable() {
 		go func(idx int, a models.RequestAction, cinner chan common.BSliceIndex) {
-			bytes := []byte{}
-
-			// Store the RAID
-			b := make([]byte, 8)
-			binary.LittleEndian.PutUint64(b, uint64(a.GetRAID()))
-			bytes = append(bytes, b...)
-
-			// Store the length of the compiled data
-			// This should never reach 4GB but having a buffer is always good
-			compiled := a.Compile()
-			b = make([]byte, 4)
-			binary.LittleEndian.PutUint32(b, uint32(len(compiled)))
-			bytes = append(bytes, b...)
-
-			// Store compiled data
-			bytes = append(bytes, compiled...)
-			finished := common.BSliceIndex{Index: idx, Bslice: bytes}
+			finished := common.BSliceIndex{Index: idx, Bslice: actionRecord(a)}
 			cinner <- finished
 		}(i, a, cinner)
 		i++
 	}
+	if actionCount == 0 {
+		// Nothing will ever be sent, so don't wait on it
+		close(cinner)
+	}
 	c := 0
 	for bslice := range cinner {
 		bslices[bslice.Index] = bslice.Bslice
@@ -53,3 +44,93 @@ func BundleActions(AAS models.ActionSet) []byte {
 	}
 	return bundle
 }
+
+// actionRecord compiles a request action into its record within an action bundle
+func actionRecord(a models.RequestAction) []byte {
+	a = requestAction(a)
+	bytes := []byte{}
+
+	// Store the RAID
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(a.GetRAID()))
+	bytes = append(bytes, b...)
+
+	// Store the length of the compiled data
+	// This should never reach 4GB but having a buffer is always good
+	compiled := a.Compile()
+	b = make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(len(compiled)))
+	bytes = append(bytes, b...)
+
+	// Store compiled data
+	return append(bytes, compiled...)
+}
+
+// requestAction swaps a play sound for the lakshmi request action it carries
+func requestAction(a models.RequestAction) models.RequestAction {
+	sound, ok := a.(models.RAPlaySound)
+	if !ok {
+		return a
+	}
+	switch action := sound.Val.(type) {
+	case RASpeech:
+		if sound.SoundType == models.RAPlaySoundTypeText {
+			return action
+		}
+	case RATemplate:
+		if sound.SoundType == models.RAPlaySoundTypeText {
+			return action
+		}
+	case RASpeechTemplate:
+		if sound.SoundType == models.RAPlaySoundTypeText {
+			return action
+		}
+	case RAVariants:
+		if sound.SoundType == models.RAPlaySoundTypeText || sound.SoundType == models.RAPlaySoundTypeAudio {
+			return action
+		}
+	}
+	return a
+}
+
+// blockActionSets returns the AlwaysExec of a logical block, followed by the Exec of each statement
+// The variants of each play sound follow the set they are within, as a set of their own
+// which shares their play sounds, so that every phase after PrepareVariants prepares them too.
+func blockActionSets(block *RawLBlock) []*ActionSet {
+	sets := []*ActionSet{&block.AlwaysExec}
+	if block.Statements != nil {
+		for _, statements := range *block.Statements {
+			for idx := range statements {
+				sets = append(sets, &statements[idx].Exec)
+			}
+		}
+	}
+	for _, set := range sets {
+		for _, sound := range set.PlaySounds {
+			if variants, ok := sound.Val.(RAVariants); ok {
+				sets = append(sets, &ActionSet{PlaySounds: variants.Sounds})
+			}
+		}
+	}
+	return sets
+}
+
+// prepareActions calls prepare with every ActionSet of the dialogs and triggers,
+// failing with the first error along with where it was met
+func prepareActions(items []ProjectItem, triggers []ProjectTriggerItem, prepare func(set *ActionSet) error) error {
+	for idx := range items {
+		for _, set := range blockActionSets(&items[idx].RawLBlock) {
+			if err := prepare(set); err != nil {
+				return fmt.Errorf("dialog node %v: %v", items[idx].DialogID.String(), err)
+			}
+		}
+	}
+	for idx := range triggers {
+		for _, set := range blockActionSets(&triggers[idx].RawLBlock) {
+			if err := prepare(set); err != nil {
+				return fmt.Errorf("trigger %v in zone %v: %v", triggers[idx].TriggerType, triggers[idx].ZoneID.String(), err)
+			}
+		}
+	}
+	return nil
+}
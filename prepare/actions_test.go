@@ -10,7 +10,7 @@ import (
 
 func TestBundleActions(t *testing.T) {
 
-	AAS := models.ActionSet{}
+	AAS := ActionSet{}
 	AAS.PlaySounds = make([]models.RAPlaySound, 2)
 	AAS.PlaySounds[0].SoundType = models.RAPlaySoundTypeText
 	AAS.PlaySounds[0].Val = "Hello world"
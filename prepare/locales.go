@@ -0,0 +1,251 @@
+package prepare
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/talkative-ai/core/models"
+)
+
+// DefaultLocale is the locale of a project which hasn't chosen its locales
+const DefaultLocale = "en"
+
+// SupportedLanguages are the languages which dialog inputs may be understood in
+var SupportedLanguages = map[string]bool{"de": true, "en": true, "es": true, "fr": true, "it": true, "ja": true, "ko": true}
+
+var localePattern = regexp.MustCompile(`^[a-z]{2}(-[A-Z]{2})?$`)
+
+// IsLocale reports whether tag is a locale, being a language optionally followed by a region, such as es or es-MX
+func IsLocale(tag string) bool {
+	return localePattern.MatchString(tag)
+}
+
+// LocaleLanguage returns the language of a locale
+func LocaleLanguage(locale string) string {
+	return strings.SplitN(locale, "-", 2)[0]
+}
+
+// CheckLocales fails unless locales is a list of distinct locales in supported languages
+// The first locale is the default, which anything untranslated falls back to.
+func CheckLocales(locales []string) error {
+	if len(locales) == 0 {
+		return fmt.Errorf("a project needs at least one locale")
+	}
+	seen := map[string]bool{}
+	for _, locale := range locales {
+		if !IsLocale(locale) {
+			return fmt.Errorf("invalid locale %q, expected a language and an optional region such as es or es-MX", locale)
+		}
+		if !SupportedLanguages[LocaleLanguage(locale)] {
+			return fmt.Errorf("the language of %v is not supported", locale)
+		}
+		if seen[locale] {
+			return fmt.Errorf("%v is listed more than once", locale)
+		}
+		seen[locale] = true
+	}
+	return nil
+}
+
+// EntryInputLocale splits the locale from an entry input written for a locale, such as "[es] hola"
+// Inputs without a locale belong to the default locale.
+func EntryInputLocale(input string) (string, string, bool) {
+	if !strings.HasPrefix(input, "[") {
+		return "", input, false
+	}
+	end := strings.Index(input, "]")
+	if end < 0 || !IsLocale(input[1:end]) {
+		return "", input, false
+	}
+	return input[1:end], strings.TrimSpace(input[end+1:]), true
+}
+
+// Translations returns the value of a play sound by locale, when it is written as translations,
+// such as {"en": "Hello", "es": "Hola"}
+func Translations(sound models.RAPlaySound) (map[string]interface{}, bool) {
+	m, ok := sound.Val.(map[string]interface{})
+	if !ok || len(m) == 0 || (sound.SoundType != models.RAPlaySoundTypeText && sound.SoundType != models.RAPlaySoundTypeAudio) {
+		return nil, false
+	}
+	for key := range m {
+		if !IsLocale(key) {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+// Localize returns a copy of the dialogs and triggers of a project as they are in one of its locales,
+// which is the first phase of preparation, before every other phase prepares each locale on its own.
+// The first of locales is the default. Entry inputs are those written for the locale,
+// and text and audio play sounds written as translations are swapped for their value in the locale.
+// Anything without a translation into the locale falls back to the default locale,
+// so that a project may be published before it is entirely translated.
+func Localize(items []ProjectItem, triggers []ProjectTriggerItem, locales []string, locale string) ([]ProjectItem, []ProjectTriggerItem, error) {
+	known := map[string]bool{}
+	for _, l := range locales {
+		known[l] = true
+	}
+	defaultLocale := locales[0]
+
+	// Everything the phases which prepare one locale change in place is copied, so that they don't change another
+	localizedItems := make([]ProjectItem, len(items))
+	for idx, item := range items {
+		if item.DialogEntry != nil {
+			item.DialogEntry = append([]string{}, item.DialogEntry...)
+		}
+		item.RawLBlock = copyBlock(item.RawLBlock)
+		localizedItems[idx] = item
+	}
+	localizedTriggers := make([]ProjectTriggerItem, len(triggers))
+	for idx, trigger := range triggers {
+		trigger.RawLBlock = copyBlock(trigger.RawLBlock)
+		localizedTriggers[idx] = trigger
+	}
+
+	for idx := range localizedItems {
+		item := &localizedItems[idx]
+		if item.DialogEntry == nil {
+			continue
+		}
+		inputs, defaults := []string{}, []string{}
+		for _, input := range item.DialogEntry {
+			l, text, ok := EntryInputLocale(input)
+			if ok && !known[l] {
+				return nil, nil, fmt.Errorf("dialog node %v: entry input %q is for %v, which is not a locale of the project", item.DialogID.String(), input, l)
+			}
+			if !ok {
+				defaults = append(defaults, text)
+			} else if l == locale {
+				inputs = append(inputs, text)
+			}
+		}
+		if locale == defaultLocale {
+			inputs = append(defaults, inputs...)
+		} else if len(inputs) == 0 {
+			inputs = defaults
+		}
+		item.DialogEntry = inputs
+	}
+
+	err := prepareActions(localizedItems, localizedTriggers, func(set *ActionSet) error {
+		for idx, sound := range set.PlaySounds {
+			translations, ok := Translations(sound)
+			if !ok {
+				continue
+			}
+			locales := []string{}
+			for l := range translations {
+				locales = append(locales, l)
+			}
+			sort.Strings(locales)
+			for _, l := range locales {
+				if !known[l] {
+					return fmt.Errorf("play sound has a translation into %v, which is not a locale of the project", l)
+				}
+			}
+			val, ok := translations[locale]
+			if !ok {
+				val, ok = translations[defaultLocale]
+			}
+			if !ok {
+				return fmt.Errorf("play sound is missing its translation into the default locale %v", defaultLocale)
+			}
+			set.PlaySounds[idx].Val = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return localizedItems, localizedTriggers, nil
+}
+
+// copyBlock copies the play sounds and conditions of a logical block
+func copyBlock(block RawLBlock) RawLBlock {
+	copied := RawLBlock{AlwaysExec: copyActionSet(block.AlwaysExec)}
+	if block.Statements == nil {
+		return copied
+	}
+	statements := make([][]RawLStatement, len(*block.Statements))
+	for i, group := range *block.Statements {
+		statements[i] = make([]RawLStatement, len(group))
+		for j, stmt := range group {
+			statements[i][j] = RawLStatement{
+				Operators: copyOperators(stmt.Operators),
+				Condition: copyValue(stmt.Condition),
+				Exec:      copyActionSet(stmt.Exec),
+			}
+			if stmt.Random != nil {
+				random := *stmt.Random
+				statements[i][j].Random = &random
+			}
+		}
+	}
+	copied.Statements = &statements
+	return copied
+}
+
+func copyActionSet(set ActionSet) ActionSet {
+	copied := ActionSet{}
+	if set.PlaySounds != nil {
+		copied.PlaySounds = make([]models.RAPlaySound, len(set.PlaySounds))
+		for idx, sound := range set.PlaySounds {
+			sound.Val = copyValue(sound.Val)
+			copied.PlaySounds[idx] = sound
+		}
+	}
+	if set.Actions != nil {
+		copied.Actions = make([]interface{}, len(set.Actions))
+		for idx, val := range set.Actions {
+			copied.Actions[idx] = copyValue(val)
+		}
+	}
+	return copied
+}
+
+// copyOperators copies the OrGroup of a statement, whose values prepareVariables rewrites in place
+func copyOperators(operators *models.OrGroup) *models.OrGroup {
+	if operators == nil {
+		return nil
+	}
+	copied := make(models.OrGroup, len(*operators))
+	for idx, andGroup := range *operators {
+		if andGroup == nil {
+			continue
+		}
+		copied[idx] = models.AndGroup{}
+		for op, varValMap := range andGroup {
+			if varValMap == nil {
+				copied[idx][op] = nil
+				continue
+			}
+			copied[idx][op] = map[uint64]interface{}{}
+			for varID, val := range varValMap {
+				copied[idx][op][varID] = copyValue(val)
+			}
+		}
+	}
+	return &copied
+}
+
+// copyValue copies the JSON objects and arrays within a value, leaving anything else as it is
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for idx := range v {
+			copied[idx] = copyValue(v[idx])
+		}
+		return copied
+	case map[string]interface{}:
+		copied := map[string]interface{}{}
+		for key := range v {
+			copied[key] = copyValue(v[key])
+		}
+		return copied
+	}
+	return val
+}
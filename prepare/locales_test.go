@@ -0,0 +1,153 @@
+package prepare
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+)
+
+func TestCheckLocales(t *testing.T) {
+	valid := [][]string{{"en"}, {"es-MX", "en", "de"}}
+	for _, locales := range valid {
+		if err := CheckLocales(locales); err != nil {
+			t.Errorf("%v: %v", locales, err)
+		}
+	}
+	invalid := [][]string{{}, {"EN"}, {"en_US"}, {"english"}, {"zz"}, {"en", "es", "en"}}
+	for _, locales := range invalid {
+		if err := CheckLocales(locales); err == nil {
+			t.Errorf("%v: expected an error", locales)
+		}
+	}
+}
+
+func TestEntryInputLocale(t *testing.T) {
+	expected := map[string][3]interface{}{
+		"[es] hola":    {"es", "hola", true},
+		"[pt-BR]olá":   {"pt-BR", "olá", true},
+		"hello":        {"", "hello", false},
+		"[wave] hello": {"", "[wave] hello", false},
+		"[es hola":     {"", "[es hola", false},
+	}
+	for input, want := range expected {
+		locale, text, ok := EntryInputLocale(input)
+		if got := [3]interface{}{locale, text, ok}; got != want {
+			t.Errorf("%v: expected %v, got %v", input, want, got)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	items := []ProjectItem{{DialogEntry: []string{"hello", "hi", "[es] hola", "[de] hallo"}}, {}}
+	items[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeText, Val: map[string]interface{}{"en": "Hello", "es": "Hola"}},
+		{SoundType: models.RAPlaySoundTypeText, Val: "Untranslated"},
+		{SoundType: models.RAPlaySoundTypeText, Val: map[string]interface{}{"variants": []interface{}{"Hi", "Hey"}}},
+	}
+	triggers := []ProjectTriggerItem{{}}
+	triggers[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeAudio, Val: map[string]interface{}{"en": "https://example.com/en.mp3", "fr": "https://example.com/fr.mp3"}},
+	}
+	locales := []string{"en", "es", "fr"}
+
+	expected := map[string]struct {
+		entry []string
+		text  interface{}
+		audio interface{}
+	}{
+		"en": {[]string{"hello", "hi"}, "Hello", "https://example.com/en.mp3"},
+		"es": {[]string{"hola"}, "Hola", "https://example.com/en.mp3"},
+		"fr": {[]string{"hello", "hi"}, "Hello", "https://example.com/fr.mp3"},
+	}
+	for locale, want := range expected {
+		localized, localizedTriggers, err := Localize(items, triggers, []string{"en", "es", "fr", "de"}, locale)
+		if err != nil {
+			t.Fatalf("%v: %v", locale, err)
+		}
+		if !reflect.DeepEqual(localized[0].DialogEntry, want.entry) {
+			t.Errorf("%v: expected entry inputs %v, got %v", locale, want.entry, localized[0].DialogEntry)
+		}
+		if localized[1].DialogEntry != nil {
+			t.Errorf("%v: expected a node without entry inputs to keep none, got %v", locale, localized[1].DialogEntry)
+		}
+		sounds := localized[0].RawLBlock.AlwaysExec.PlaySounds
+		if sounds[0].Val != want.text || sounds[1].Val != "Untranslated" {
+			t.Errorf("%v: expected %v and Untranslated, got %v and %v", locale, want.text, sounds[0].Val, sounds[1].Val)
+		}
+		if _, ok := sounds[2].Val.(map[string]interface{}); !ok {
+			t.Errorf("%v: expected variants to be left for PrepareVariants, got %v", locale, sounds[2].Val)
+		}
+		if audio := localizedTriggers[0].RawLBlock.AlwaysExec.PlaySounds[0].Val; audio != want.audio {
+			t.Errorf("%v: expected audio %v, got %v", locale, want.audio, audio)
+		}
+	}
+	if _, ok := items[0].RawLBlock.AlwaysExec.PlaySounds[0].Val.(map[string]interface{}); !ok || len(items[0].DialogEntry) != 4 {
+		t.Error("expected the project to be left as it was")
+	}
+
+	// de is not a locale of the project
+	if _, _, err := Localize(items, triggers, locales, "en"); err == nil {
+		t.Error("expected an error for an entry input in an unknown locale")
+	}
+	missingDefault := []ProjectTriggerItem{{}}
+	missingDefault[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeText, Val: map[string]interface{}{"es": "Hola"}},
+	}
+	if _, _, err := Localize(nil, missingDefault, locales, "fr"); err == nil {
+		t.Error("expected an error for text without a translation into the default locale")
+	}
+}
+
+func TestLocalizeKeepsBlock(t *testing.T) {
+	bell, _ := url.Parse("https://example.com/bell.mp3")
+	variable := RAVariable{Operation: VariableSet, ID: 7, Value: "open"}
+	items := []ProjectItem{{}}
+	items[0].RawLBlock = RawLBlock{
+		AlwaysExec: ActionSet{
+			PlaySounds: []models.RAPlaySound{{SoundType: models.RAPlaySoundTypeAudio, Val: bell}},
+			Actions:    []interface{}{variable},
+		},
+		Statements: &[][]RawLStatement{{
+			{
+				Operators: &models.OrGroup{{"eq": {1: map[string]interface{}{"var": "door"}}}},
+				Exec: ActionSet{PlaySounds: []models.RAPlaySound{
+					{SoundType: models.RAPlaySoundTypeText, Val: map[string]interface{}{"en": "Open", "es": "Abierta"}},
+				}},
+			},
+			{Exec: ActionSet{Actions: []interface{}{variable}}},
+		}},
+	}
+
+	localized, _, err := Localize(items, nil, []string{"en", "es"}, "es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := localized[0].RawLBlock
+	if !reflect.DeepEqual(block.AlwaysExec, items[0].RawLBlock.AlwaysExec) {
+		t.Errorf("expected the non-text actions to be kept, got %+v", block.AlwaysExec)
+	}
+	statements := *block.Statements
+	if len(statements) != 1 || len(statements[0]) != 2 {
+		t.Fatalf("expected the statements to be kept, got %+v", statements)
+	}
+	if !reflect.DeepEqual(statements[0][0].Operators, (*items[0].RawLBlock.Statements)[0][0].Operators) {
+		t.Errorf("expected the conditions to be kept, got %+v", statements[0][0].Operators)
+	}
+	if statements[0][0].Exec.PlaySounds[0].Val != "Abierta" || statements[0][1].Exec.Actions[0] != variable {
+		t.Errorf("unexpected statement actions %+v", statements[0])
+	}
+
+	// Preparing the locale in place leaves the project as it was
+	(*statements[0][0].Operators)[0]["eq"][1] = map[string]interface{}{"var": float64(1)}
+	block.AlwaysExec.PlaySounds[0].Val = "https://example.com/other.mp3"
+	original := *items[0].RawLBlock.Statements
+	if !reflect.DeepEqual((*original[0][0].Operators)[0]["eq"][1], map[string]interface{}{"var": "door"}) ||
+		items[0].RawLBlock.AlwaysExec.PlaySounds[0].Val != bell {
+		t.Error("expected the project to be left as it was")
+	}
+	if _, ok := original[0][0].Exec.PlaySounds[0].Val.(map[string]interface{}); !ok {
+		t.Error("expected the translations to be left as they were")
+	}
+}
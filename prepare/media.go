@@ -1,5 +1,545 @@
 package prepare
 
-func Resources() {
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/talkative-ai/core/models"
+)
+
+// The audio limits of smart speakers
+// Alexa only plays MP3s at 48kbps and one of these sample rates, for at most 240 seconds
+// within a response, and Google Assistant plays anything Alexa does.
+const (
+	MediaBitrate     = 48000
+	MediaMaxDuration = 240 * time.Second
+	// MediaMaxBytes is the most that is downloaded of a single audio file
+	MediaMaxBytes = 50 << 20
+	// MediaMaxRedirects is the most redirects followed to download a single audio file
+	MediaMaxRedirects = 5
+	// MediaTranscodeTimeout is the longest a single audio file may take to transcode
+	MediaTranscodeTimeout = 2 * time.Minute
+)
+
+// MediaSampleRates are the sample rates smart speakers play
+var MediaSampleRates = map[int]bool{16000: true, 22050: true, 24000: true}
+
+// AudioInfo describes an audio file
+type AudioInfo struct {
+	// Format is "mp3" or "wav"
+	Format     string
+	SampleRate int
+	// Bitrate is the highest bitrate of any frame, in bits per second
+	Bitrate  int
+	Duration time.Duration
+}
+
+// Check fails when smart speakers can't play the audio as it is
+func (info AudioInfo) Check() error {
+	if info.Format != "mp3" {
+		return fmt.Errorf("audio is %v rather than mp3", info.Format)
+	}
+	if info.Bitrate != MediaBitrate {
+		return fmt.Errorf("audio bitrate is %v rather than %v", info.Bitrate, MediaBitrate)
+	}
+	if !MediaSampleRates[info.SampleRate] {
+		return fmt.Errorf("audio sample rate %v is not one of 16000, 22050 or 24000", info.SampleRate)
+	}
+	return info.checkDuration()
+}
+
+// checkDuration fails when the audio is too long, which transcoding can't fix
+func (info AudioInfo) checkDuration() error {
+	if info.Duration > MediaMaxDuration {
+		return fmt.Errorf("audio lasts %v, which is longer than %v", info.Duration, MediaMaxDuration)
+	}
+	return nil
+}
+
+// ProbeAudio reads the format, sample rate, bitrate and duration of an MP3 or WAV file
+func ProbeAudio(b []byte) (AudioInfo, error) {
+	if len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WAVE" {
+		return probeWAV(b)
+	}
+	return probeMP3(b)
+}
+
+// The Layer III bitrates in kbps of MPEG 1, and of MPEG 2 and 2.5, by bitrate index
+var (
+	mp3BitratesV1 = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, -1}
+	mp3BitratesV2 = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, -1}
+)
+
+// The sample rates of MPEG 1, 2 and 2.5, by sample rate index
+var mp3SampleRates = map[uint32][3]int{
+	3: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	0: {11025, 12000, 8000},
+}
+
+// probeMP3 walks every frame header of an MPEG Layer III stream
+// Only the headers are read, so the duration doesn't rely on a Xing header being present.
+func probeMP3(b []byte) (AudioInfo, error) {
+	pos := 0
+	// Skip an ID3v2 tag, whose size is syncsafe
+	if len(b) >= 10 && string(b[:3]) == "ID3" {
+		size := int(b[6])<<21 | int(b[7])<<14 | int(b[8])<<7 | int(b[9])
+		pos = 10 + size
+	}
+
+	info := AudioInfo{Format: "mp3"}
+	samples := 0
+	for pos+4 <= len(b) {
+		header := binary.BigEndian.Uint32(b[pos:])
+		if header>>21 != 0x7ff {
+			// An ID3v1 tag or padding ends the stream
+			break
+		}
+		version := header >> 19 & 3
+		layer := header >> 17 & 3
+		bitrateIndex := header >> 12 & 15
+		sampleRateIndex := header >> 10 & 3
+		padding := int(header >> 9 & 1)
+		rates, ok := mp3SampleRates[version]
+		if !ok || layer != 1 || sampleRateIndex == 3 {
+			return AudioInfo{}, fmt.Errorf("audio is not MPEG Layer III")
+		}
+
+		sampleRate := rates[sampleRateIndex]
+		bitrate, samplesPerFrame := mp3BitratesV2[bitrateIndex]*1000, 576
+		if version == 3 {
+			bitrate, samplesPerFrame = mp3BitratesV1[bitrateIndex]*1000, 1152
+		}
+		if bitrate <= 0 {
+			return AudioInfo{}, fmt.Errorf("audio has a free or invalid bitrate")
+		}
+		if info.SampleRate != 0 && info.SampleRate != sampleRate {
+			return AudioInfo{}, fmt.Errorf("audio changes sample rate")
+		}
+		info.SampleRate = sampleRate
+		if bitrate > info.Bitrate {
+			info.Bitrate = bitrate
+		}
+		samples += samplesPerFrame
+		pos += samplesPerFrame/8*bitrate/sampleRate + padding
+	}
+	if samples == 0 {
+		return AudioInfo{}, fmt.Errorf("audio is neither mp3 nor wav")
+	}
+	info.Duration = time.Duration(samples) * time.Second / time.Duration(info.SampleRate)
+	return info, nil
+}
+
+// probeWAV reads the fmt and data chunks of a RIFF WAVE file
+func probeWAV(b []byte) (AudioInfo, error) {
+	info := AudioInfo{Format: "wav"}
+	byteRate := 0
+	dataSize := -1
+	for pos := 12; pos+8 <= len(b); {
+		id := string(b[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		body := b[pos+8:]
+		switch id {
+		case "fmt ":
+			if size < 16 || len(body) < 16 {
+				return AudioInfo{}, fmt.Errorf("wav has a short fmt chunk")
+			}
+			info.SampleRate = int(binary.LittleEndian.Uint32(body[4:]))
+			byteRate = int(binary.LittleEndian.Uint32(body[8:]))
+		case "data":
+			dataSize = size
+		}
+		// Chunks are padded to an even size
+		pos += 8 + size + size&1
+	}
+	if byteRate == 0 || dataSize < 0 {
+		return AudioInfo{}, fmt.Errorf("wav is missing its fmt or data chunk")
+	}
+	info.Bitrate = byteRate * 8
+	info.Duration = time.Duration(dataSize) * time.Second / time.Duration(byteRate)
+	return info, nil
+}
+
+// Fetcher downloads the audio at a URL
+type Fetcher func(source string) ([]byte, error)
+
+// HTTPFetch is a Fetcher which downloads over HTTPS, refusing files larger than MediaMaxBytes
+// Authors choose the URLs, so that a publish can't reach the services beside lakshmi,
+// every address it connects to must be public, as resolved by DNS, and every redirect is checked the same way.
+func HTTPFetch(source string) ([]byte, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMediaURL(u); err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: time.Minute, Transport: mediaTransport, CheckRedirect: checkMediaRedirect}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v responded with status %v", source, resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, MediaMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MediaMaxBytes {
+		return nil, fmt.Errorf("%v is larger than %v bytes", source, MediaMaxBytes)
+	}
+	return b, nil
+}
+
+// mediaTransport connects only to public addresses
+// The address is checked once it is resolved, just before connecting, so a host can't resolve
+// to a public address when checked and a private one when connected to. Proxies are never used,
+// as the address connected to would then be that of the proxy.
+var mediaTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkMediaIP(net.ParseIP(host))
+		},
+	}).DialContext,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// checkMediaURL fails unless audio may be downloaded from u
+func checkMediaURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("audio must be downloaded over https, found %v", u.Redacted())
+	}
+	return nil
+}
+
+// checkMediaRedirect is the CheckRedirect of HTTPFetch
+func checkMediaRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > MediaMaxRedirects {
+		return fmt.Errorf("%v redirected more than %v times", via[0].URL.Redacted(), MediaMaxRedirects)
+	}
+	return checkMediaURL(req.URL)
+}
+
+// checkMediaIP fails when ip isn't a public address
+func checkMediaIP(ip net.IP) error {
+	switch {
+	case ip == nil:
+		return fmt.Errorf("invalid address")
+	case ip.IsLoopback(), ip.IsPrivate(), ip.IsUnspecified(),
+		ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast(), ip.IsMulticast():
+		return fmt.Errorf("audio may not be downloaded from %v, which is not a public address", ip)
+	}
+	return nil
+}
+
+// Transcoder converts audio into an MP3 which smart speakers can play
+type Transcoder func(audio []byte) ([]byte, error)
+
+// FFmpeg is a Transcoder which runs the ffmpeg executable,
+// with the settings recommended for Alexa
+// The audio is downloaded from wherever the author chose, so ffmpeg is told its format rather than left to guess,
+// may only read from its pipe, such that a playlist can't make it open files or URLs, and is killed after MediaTranscodeTimeout.
+func FFmpeg(audio []byte) ([]byte, error) {
+	format, err := audioFormat(audio)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), MediaTranscodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-protocol_whitelist", "pipe",
+		"-f", format, "-i", "pipe:0", "-ac", "2", "-codec:a", "libmp3lame", "-b:a", "48k", "-ar", "24000", "-f", "mp3", "pipe:1")
+	cmd.Stdin = bytes.NewReader(audio)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ffmpeg took longer than %v", MediaTranscodeTimeout)
+		}
+		return nil, fmt.Errorf("ffmpeg: %v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// audioFormat reads the format of an audio file from its first bytes, as the ffmpeg name of its demuxer
+// Only MP3, WAV and Ogg are transcoded.
+func audioFormat(b []byte) (string, error) {
+	switch {
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WAVE":
+		return "wav", nil
+	case len(b) >= 4 && string(b[:4]) == "OggS":
+		return "ogg", nil
+	case len(b) >= 3 && string(b[:3]) == "ID3", len(b) >= 2 && b[0] == 0xff && b[1]&0xe0 == 0xe0:
+		return "mp3", nil
+	}
+	return "", fmt.Errorf("audio is neither mp3, wav nor ogg")
+}
+
+// BlobStore keeps prepared media where the runtimes can fetch it
+type BlobStore interface {
+	// Put stores data under name, and returns the URL it may be fetched from
+	// Names are checksums of the data, so data already stored under a name needn't be written again.
+	Put(name string, data []byte) (string, error)
+}
+
+// FileStore is a BlobStore within a local directory, which is served at BaseURL
+type FileStore struct {
+	Dir     string
+	BaseURL string
+}
+
+// Put implements BlobStore
+// A file already stored is only written again when it no longer matches its checksum.
+func (s *FileStore) Put(name string, data []byte) (string, error) {
+	path := filepath.Join(s.Dir, name)
+	if existing, err := ioutil.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return s.url(name), nil
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", err
+	}
+	// Write then rename, so a runtime never fetches half a file
+	tmp, err := ioutil.TempFile(s.Dir, name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return s.url(name), nil
+}
+
+func (s *FileStore) url(name string) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + name
+}
+
+// Media prepares the audio of a project, see Resources
+type Media struct {
+	Fetch Fetcher
+	// Transcode may be nil, in which case audio smart speakers can't play fails the publish
+	Transcode Transcoder
+	Store     BlobStore
+}
+
+// NewMedia returns a Media which downloads over HTTP, transcodes with ffmpeg
+// and stores the prepared audio within the directory served at baseURL
+func NewMedia(dir string, baseURL string) *Media {
+	return &Media{Fetch: HTTPFetch, Transcode: FFmpeg, Store: &FileStore{Dir: dir, BaseURL: baseURL}}
+}
+
+// Asset is an audio file prepared for smart speakers
+type Asset struct {
+	// Source is the URL the author wrote
+	Source string
+	// URL is where the prepared audio is stored
+	URL    string
+	SHA256 string
+	Info   AudioInfo
+	// Transcoded is true when the source couldn't be played as it was
+	Transcoded bool
+}
+
+// ssmlAudioSource matches the src of an SSML <audio>, which has already been validated by PrepareSSML
+var ssmlAudioSource = regexp.MustCompile(`(<audio\s[^>]*src=)("[^"]*"|'[^']*')`)
+
+// Resources is the media phase of compilation
+// It collects every audio URL of the project, from audio play sounds and SSML <audio>, checks each
+// against the limits of smart speakers, transcodes it when it can't be played as it is,
+// and stores the result under its checksum. The play sounds and SSML, including that of templates,
+// are then rewritten to refer to the stored asset instead of the URL the author wrote.
+// It must run after PrepareSSML. The assets are returned in the order of their sources.
+// The locales of a project share much of their audio, so rather than calling Resources for each,
+// the sources of every locale are given to Media.Prepare together, and each locale is rewritten with RewriteMedia.
+func Resources(items []ProjectItem, triggers []ProjectTriggerItem, media *Media) ([]Asset, error) {
+	assets, err := media.Prepare(MediaSources(items, triggers))
+	if err != nil {
+		return nil, err
+	}
+	RewriteMedia(items, triggers, assets)
+	return assets, nil
+}
+
+// MediaSources returns every audio URL within the dialogs and triggers, from audio play sounds and SSML <audio>
+func MediaSources(items []ProjectItem, triggers []ProjectTriggerItem) []string {
+	sources := []string{}
+	collect := func(set *ActionSet) error {
+		for _, sound := range set.PlaySounds {
+			if source, ok := audioSource(sound); ok {
+				sources = append(sources, source)
+			}
+			find := func(ssml string) string {
+				for _, match := range ssmlAudioSource.FindAllStringSubmatch(ssml, -1) {
+					sources = append(sources, ssmlAttributeValue(match[2]))
+				}
+				return ssml
+			}
+			switch speech := sound.Val.(type) {
+			case RASpeech:
+				find(speech.SSML)
+			case RASpeechTemplate:
+				mapTemplateText(speech.SSML, find)
+			}
+		}
+		return nil
+	}
+	prepareActions(items, triggers, collect)
+	return sources
+}
+
+// Prepare prepares each of the audio sources once, however often it is listed,
+// returning the assets in the order of their sources
+func (media *Media) Prepare(sources []string) ([]Asset, error) {
+	unique := map[string]bool{}
+	for _, source := range sources {
+		unique[source] = true
+	}
+	sorted := []string{}
+	for source := range unique {
+		sorted = append(sorted, source)
+	}
+	sort.Strings(sorted)
+	assets := []Asset{}
+	for _, source := range sorted {
+		asset, err := media.prepare(source)
+		if err != nil {
+			return nil, fmt.Errorf("audio %v: %v", source, err)
+		}
+		if _, err := url.Parse(asset.URL); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, nil
+}
+
+// RewriteMedia rewrites the audio play sounds and SSML of the dialogs and triggers
+// to refer to the assets prepared from their sources
+// Items may share their statements, so a source which isn't among the assets has already been rewritten.
+func RewriteMedia(items []ProjectItem, triggers []ProjectTriggerItem, assets []Asset) {
+	prepared := map[string]*url.URL{}
+	for _, asset := range assets {
+		// Media.Prepare has already checked that the URL parses
+		prepared[asset.Source], _ = url.Parse(asset.URL)
+	}
+	replace := func(ssml string) string {
+		return ssmlAudioSource.ReplaceAllStringFunc(ssml, func(audio string) string {
+			match := ssmlAudioSource.FindStringSubmatch(audio)
+			u, ok := prepared[ssmlAttributeValue(match[2])]
+			if !ok {
+				return audio
+			}
+			return match[1] + `"` + html.EscapeString(u.String()) + `"`
+		})
+	}
+	rewrite := func(set *ActionSet) error {
+		for idx, sound := range set.PlaySounds {
+			if source, ok := audioSource(sound); ok && prepared[source] != nil {
+				set.PlaySounds[idx].Val = prepared[source]
+			}
+			switch speech := sound.Val.(type) {
+			case RASpeech:
+				speech.SSML = replace(speech.SSML)
+				set.PlaySounds[idx].Val = speech
+			case RASpeechTemplate:
+				speech.SSML = mapTemplateText(speech.SSML, replace)
+				set.PlaySounds[idx].Val = speech
+			}
+		}
+		return nil
+	}
+	prepareActions(items, triggers, rewrite)
+}
+
+// audioSource returns the URL of an audio play sound
+// Audio decoded from JSON may hold its URL as a string rather than a *url.URL.
+func audioSource(sound models.RAPlaySound) (string, bool) {
+	if sound.SoundType != models.RAPlaySoundTypeAudio {
+		return "", false
+	}
+	switch v := sound.Val.(type) {
+	case *url.URL:
+		return v.String(), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+// ssmlAttributeValue unquotes and unescapes an SSML attribute value
+func ssmlAttributeValue(quoted string) string {
+	return html.UnescapeString(quoted[1 : len(quoted)-1])
+}
+
+// prepare fetches, checks, transcodes if need be, and stores the audio at source
+func (media *Media) prepare(source string) (Asset, error) {
+	audio, err := media.Fetch(source)
+	if err != nil {
+		return Asset{}, err
+	}
+	asset := Asset{Source: source}
+	asset.Info, err = ProbeAudio(audio)
+	if err == nil {
+		err = asset.Info.checkDuration()
+		if err != nil {
+			return Asset{}, err
+		}
+		err = asset.Info.Check()
+	}
+	if err != nil {
+		if media.Transcode == nil {
+			return Asset{}, err
+		}
+		audio, err = media.Transcode(audio)
+		if err != nil {
+			return Asset{}, err
+		}
+		asset.Transcoded = true
+		// Whatever comes out of the transcoder must be playable
+		if asset.Info, err = ProbeAudio(audio); err != nil {
+			return Asset{}, err
+		}
+		if err = asset.Info.Check(); err != nil {
+			return Asset{}, err
+		}
+	}
+
+	sum := sha256.Sum256(audio)
+	asset.SHA256 = hex.EncodeToString(sum[:])
+	asset.URL, err = media.Store.Put(asset.SHA256+".mp3", audio)
+	return asset, err
 }
@@ -0,0 +1,300 @@
+package prepare
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/talkative-ai/core/models"
+)
+
+// mp3 returns frames of silence in MPEG 2 Layer III at 24000Hz and the given bitrate index
+// Index 6 is 48kbps, and index 8 is 64kbps.
+func mp3(frames int, bitrateIndex uint32) []byte {
+	header := uint32(0x7ff)<<21 | 2<<19 | 1<<17 | 1<<16 | bitrateIndex<<12 | 1<<10
+	length := 576 / 8 * mp3BitratesV2[bitrateIndex] * 1000 / 24000
+	b := []byte{}
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, length)
+		binary.BigEndian.PutUint32(frame, header)
+		b = append(b, frame...)
+	}
+	return b
+}
+
+// wav returns 16 bit mono PCM of the given length at 16000Hz
+func wav(duration time.Duration) []byte {
+	data := int(duration / time.Millisecond * 32)
+	b := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk, 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 16000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 32000)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 2)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	b = append(b, fmtChunk...)
+	b = append(b, "data\x00\x00\x00\x00"...)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(data))
+	return append(b, make([]byte, data)...)
+}
+
+func TestProbeAudio(t *testing.T) {
+	tagged := append([]byte("ID3\x03\x00\x00\x00\x00\x00\x0a"), make([]byte, 10)...)
+	tagged = append(tagged, mp3(50, 6)...)
+	info, err := ProbeAudio(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := AudioInfo{Format: "mp3", SampleRate: 24000, Bitrate: 48000, Duration: 1200 * time.Millisecond}
+	if info != expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+	if err := info.Check(); err != nil {
+		t.Error(err)
+	}
+
+	info, err = ProbeAudio(append(mp3(10, 6), mp3(10, 8)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Bitrate != 64000 || info.Check() == nil {
+		t.Errorf("expected the highest bitrate to fail the check, got %+v", info)
+	}
+
+	info, err = ProbeAudio(wav(1500 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = AudioInfo{Format: "wav", SampleRate: 16000, Bitrate: 256000, Duration: 1500 * time.Millisecond}
+	if info != expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+	if info.Check() == nil {
+		t.Error("expected wav to fail the check")
+	}
+
+	if info := (AudioInfo{Format: "mp3", SampleRate: 24000, Bitrate: 48000, Duration: 241 * time.Second}); info.Check() == nil {
+		t.Error("expected long audio to fail the check")
+	}
+	for _, b := range [][]byte{nil, []byte("not audio at all"), []byte("RIFF\x00\x00\x00\x00WAVE")} {
+		if _, err := ProbeAudio(b); err == nil {
+			t.Errorf("%q: expected an error", b)
+		}
+	}
+}
+
+func TestResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playable, converted := mp3(50, 6), mp3(20, 6)
+	files := map[string][]byte{
+		"https://example.com/bell.mp3": playable,
+		"https://example.com/door.wav": wav(time.Second),
+	}
+	transcoded := 0
+	media := &Media{
+		Fetch: func(source string) ([]byte, error) {
+			if b, ok := files[source]; ok {
+				return b, nil
+			}
+			return nil, fmt.Errorf("not found")
+		},
+		Transcode: func(audio []byte) ([]byte, error) {
+			transcoded++
+			return converted, nil
+		},
+		Store: &FileStore{Dir: dir, BaseURL: "https://media.example.com/"},
+	}
+
+	bell, _ := url.Parse("https://example.com/bell.mp3")
+	speech, err := ParseSSML(`Knock <audio src="https://example.com/door.wav"/> <audio src="https://example.com/bell.mp3">ding</audio>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []ProjectItem{{}}
+	items[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeAudio, Val: bell},
+		{SoundType: models.RAPlaySoundTypeText, Val: speech},
+	}
+	triggers := []ProjectTriggerItem{{}}
+	triggers[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeAudio, Val: "https://example.com/door.wav"},
+	}
+
+	assets, err := Resources(items, triggers, media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 2 || assets[0].Source != "https://example.com/bell.mp3" || assets[1].Source != "https://example.com/door.wav" {
+		t.Fatalf("expected an asset for each source in order, got %+v", assets)
+	}
+	if assets[0].Transcoded || !assets[1].Transcoded || transcoded != 1 {
+		t.Errorf("expected only the wav to be transcoded, once, got %+v after %v transcodes", assets, transcoded)
+	}
+	for idx, b := range [][]byte{playable, converted} {
+		sum := sha256.Sum256(b)
+		checksum := hex.EncodeToString(sum[:])
+		if assets[idx].SHA256 != checksum || assets[idx].URL != "https://media.example.com/"+checksum+".mp3" {
+			t.Errorf("expected the asset to be stored under its checksum, got %+v", assets[idx])
+		}
+		stored, err := ioutil.ReadFile(filepath.Join(dir, checksum+".mp3"))
+		if err != nil || string(stored) != string(b) {
+			t.Errorf("expected %v to be stored, got %v", checksum, err)
+		}
+	}
+
+	sounds := items[0].RawLBlock.AlwaysExec.PlaySounds
+	if u, ok := sounds[0].Val.(*url.URL); !ok || u.String() != assets[0].URL {
+		t.Errorf("expected the audio to refer to %v, got %v", assets[0].URL, sounds[0].Val)
+	}
+	expected := fmt.Sprintf(`<speak>Knock <audio src="%v"/> <audio src="%v">ding</audio></speak>`, assets[1].URL, assets[0].URL)
+	if sounds[1].Val.(RASpeech).SSML != expected {
+		t.Errorf("expected %v, got %v", expected, sounds[1].Val.(RASpeech).SSML)
+	}
+	if u, ok := triggers[0].RawLBlock.AlwaysExec.PlaySounds[0].Val.(*url.URL); !ok || u.String() != assets[1].URL {
+		t.Errorf("expected the trigger audio to refer to %v, got %v", assets[1].URL, triggers[0].RawLBlock.AlwaysExec.PlaySounds[0].Val)
+	}
+
+	// A publish of the same media finds it already stored
+	if _, err := media.Store.Put(assets[0].SHA256+".mp3", playable); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResourcesInvalid(t *testing.T) {
+	files := map[string][]byte{
+		"https://example.com/long.mp3":   mp3(10500, 6),
+		"https://example.com/door.wav":   wav(time.Second),
+		"https://example.com/broken.mp3": []byte("not audio at all"),
+	}
+	for source := range files {
+		media := &Media{
+			Fetch: func(source string) ([]byte, error) { return files[source], nil },
+			Store: &FileStore{Dir: "unused", BaseURL: "https://media.example.com"},
+		}
+		u, _ := url.Parse(source)
+		items := []ProjectItem{{}}
+		items[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{{SoundType: models.RAPlaySoundTypeAudio, Val: u}}
+		if _, err := Resources(items, nil, media); err == nil {
+			t.Errorf("%v: expected an error without a transcoder", source)
+		}
+	}
+}
+
+func TestHTTPFetchRefuses(t *testing.T) {
+	// Each is refused before anything is sent
+	sources := []string{
+		"http://example.com/a.mp3",
+		"ftp://example.com/a.mp3",
+		"https://127.0.0.1/a.mp3",
+		"https://localhost/a.mp3",
+		"https://[::1]/a.mp3",
+		"https://10.1.2.3/a.mp3",
+		"https://192.168.0.1/a.mp3",
+		"https://169.254.169.254/latest/meta-data",
+		"https://0.0.0.0/a.mp3",
+	}
+	for _, source := range sources {
+		if _, err := HTTPFetch(source); err == nil {
+			t.Errorf("%v: expected an error", source)
+		}
+	}
+
+	via := []*http.Request{}
+	for i := 0; i <= MediaMaxRedirects; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("https://example.com/%v.mp3", i), nil)
+		via = append(via, req)
+	}
+	next, _ := http.NewRequest("GET", "https://example.com/next.mp3", nil)
+	if err := checkMediaRedirect(next, via[:MediaMaxRedirects]); err != nil {
+		t.Errorf("expected %v redirects to be followed, got %v", MediaMaxRedirects, err)
+	}
+	if err := checkMediaRedirect(next, via); err == nil {
+		t.Error("expected an error for too many redirects")
+	}
+	insecure, _ := http.NewRequest("GET", "http://example.com/next.mp3", nil)
+	if err := checkMediaRedirect(insecure, via[:1]); err == nil {
+		t.Error("expected an error for a redirect away from https")
+	}
+
+	if err := checkMediaIP(net.ParseIP("93.184.216.34")); err != nil {
+		t.Errorf("expected a public address to be allowed, got %v", err)
+	}
+}
+
+func TestAudioFormat(t *testing.T) {
+	formats := map[string][]byte{
+		"mp3": mp3(1, 6),
+		"wav": wav(time.Millisecond),
+		"ogg": []byte("OggS\x00\x02"),
+	}
+	for expected, b := range formats {
+		if format, err := audioFormat(b); err != nil || format != expected {
+			t.Errorf("expected %v, got %v %v", expected, format, err)
+		}
+	}
+
+	// Anything else is refused before ffmpeg is run
+	if _, err := FFmpeg([]byte("#EXTM3U\n#EXTINF:1,\nfile:///etc/passwd\n")); err == nil {
+		t.Error("expected an error transcoding a playlist")
+	}
+}
+
+func TestMediaPrepareShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fetched := map[string]int{}
+	media := &Media{
+		Fetch: func(source string) ([]byte, error) {
+			fetched[source]++
+			return mp3(50, 6), nil
+		},
+		Store: &FileStore{Dir: dir, BaseURL: "https://media.example.com"},
+	}
+
+	// Two locales, which share the bell
+	locales := [][]ProjectItem{{{}}, {{}}}
+	locales[0][0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeAudio, Val: "https://example.com/bell.mp3"},
+		{SoundType: models.RAPlaySoundTypeAudio, Val: "https://example.com/hello.mp3"},
+	}
+	locales[1][0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeAudio, Val: "https://example.com/bell.mp3"},
+		{SoundType: models.RAPlaySoundTypeAudio, Val: "https://example.com/hola.mp3"},
+	}
+	sources := []string{}
+	for _, items := range locales {
+		sources = append(sources, MediaSources(items, nil)...)
+	}
+	assets, err := media.Prepare(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 3 || fetched["https://example.com/bell.mp3"] != 1 {
+		t.Errorf("expected each source to be prepared once, got %+v after fetching %v", assets, fetched)
+	}
+	for _, items := range locales {
+		RewriteMedia(items, nil, assets)
+		if u, ok := items[0].RawLBlock.AlwaysExec.PlaySounds[0].Val.(*url.URL); !ok || u.String() != assets[0].URL {
+			t.Errorf("expected the bell to refer to %v, got %v", assets[0].URL, items[0].RawLBlock.AlwaysExec.PlaySounds[0].Val)
+		}
+	}
+}
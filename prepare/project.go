@@ -0,0 +1,93 @@
+package prepare
+
+import (
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+)
+
+// ProjectItem is a row of the dialogs of a project, as models.ProjectItem,
+// whose logical block is read as lakshmi reads it. See RawLBlock
+type ProjectItem struct {
+	ProjectID        uuid.UUID
+	ZoneID           uuid.UUID
+	ActorID          uuid.UUID
+	DialogID         uuid.UUID
+	DialogEntry      []string
+	LogicalSetAlways string
+	RawLBlock
+	IsRoot         bool
+	UnknownHandler bool
+	ParentDialogID uuid.NullUUID
+	ChildDialogID  uuid.NullUUID
+}
+
+// ProjectTriggerItem is a trigger of a project, as models.ProjectTriggerItem,
+// whose logical block is read as lakshmi reads it. See RawLBlock
+type ProjectTriggerItem struct {
+	ProjectID   uuid.UUID
+	ZoneID      uuid.UUID
+	TriggerType models.TriggerType
+	RawLBlock
+}
+
+// RawLBlock is models.RawLBlock along with what lakshmi adds to it, which core has no place for
+// It is read from the same JSON, so a block written for core alone reads the same as ever.
+type RawLBlock struct {
+	AlwaysExec ActionSet
+	Statements *[][]RawLStatement
+}
+
+// RawLStatement is models.RawLStatement with a condition of its own, beside the Operators
+// Condition is an expression tree, for what an OrGroup can't express, such as
+//
+//	{"Operators": [{"ne": {"4": "y"}}], "Condition": {"and": [{"eq": {"1": true}}, {"not": {"gt": {"2": 3}}}]}}
+//
+// The statement runs when both its Operators and its Condition are true. See helpers.StatementCondition
+type RawLStatement struct {
+	Operators *models.OrGroup
+	Condition interface{}   `json:",omitempty"`
+	Random    *RandomWeight `json:",omitempty"`
+	Exec      ActionSet
+}
+
+// RandomWeight makes a statement a weighted random choice among the statements of its array
+// Seed is the variable, by ID or name, whose value decides the choice. Without one the choice is random.
+//
+//	{"Random": {"Weight": 10}, "Exec": {...}}
+//	{"Random": {"Weight": 10, "Seed": "visits"}, "Condition": {"eq": {"weather": "rain"}}, "Exec": {...}}
+//
+// See helpers.StatementCondition
+type RandomWeight struct {
+	Weight float64
+	Seed   interface{} `json:",omitempty"`
+}
+
+// ActionSet is models.ActionSet along with the request actions of lakshmi, which are written
+// as a list of their own beside the PlaySounds:
+//
+//	{"PlaySounds": [{"SoundType": 0, "Val": "You found the key"}], "Actions": [{"set": "has_key", "value": true}, {"zone": "<zone id>"}]}
+//
+// Each action is read as its JSON until it is prepared, and is its request action after.
+// See PrepareVariables and PrepareZones
+type ActionSet struct {
+	PlaySounds []models.RAPlaySound
+	Actions    []interface{} `json:",omitempty"`
+}
+
+// Iterable returns the request actions of a prepared ActionSet, as models.ActionSet.Iterable
+// The actions come before the play sounds, so that the templates among them speak the values which were set.
+func (a ActionSet) Iterable() <-chan models.RequestAction {
+	c := make(chan models.RequestAction)
+	go func() {
+		for _, action := range a.Actions {
+			if action, ok := action.(models.RequestAction); ok {
+				c <- action
+			}
+		}
+		for _, p := range a.PlaySounds {
+			c <- p
+		}
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,210 @@
+package prepare
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/talkative-ai/core/models"
+)
+
+// RAIDSpeech is the RAID of RASpeech
+const RAIDSpeech = RAIDVariable + 2
+
+// RASpeech is a text play sound written in SSML, along with a plain text fallback
+// for runtimes which can't speak SSML, such as a chat window.
+// It is compiled as the uint16 length prefixed SSML document, then the uint16 length prefixed text.
+type RASpeech struct {
+	SSML string
+	Text string
+}
+
+// GetRAID implements models.RequestAction
+func (a RASpeech) GetRAID() models.RAID {
+	return RAIDSpeech
+}
+
+// Compile implements models.RequestAction
+func (a RASpeech) Compile() []byte {
+	b := []byte{}
+	for _, s := range []string{a.SSML, a.Text} {
+		l := make([]byte, 2)
+		binary.LittleEndian.PutUint16(l, uint16(len(s)))
+		b = append(b, l...)
+		b = append(b, s...)
+	}
+	return b
+}
+
+// ssmlAttributes lists the SSML tags supported by both Alexa and Google Assistant,
+// along with the attributes each may have, and whether the attribute is required
+var ssmlAttributes = map[string]map[string]bool{
+	"speak":    {},
+	"p":        {},
+	"s":        {},
+	"break":    {"time": false, "strength": false},
+	"emphasis": {"level": false},
+	"prosody":  {"rate": false, "pitch": false, "volume": false},
+	"say-as":   {"interpret-as": true, "format": false, "detail": false},
+	"sub":      {"alias": true},
+	"audio":    {"src": true},
+	"lang":     {"lang": true},
+}
+
+var ssmlValues = map[string]map[string]bool{
+	"strength": {"none": true, "x-weak": true, "weak": true, "medium": true, "strong": true, "x-strong": true},
+	"level":    {"strong": true, "moderate": true, "reduced": true},
+}
+
+var ssmlBreakTime = regexp.MustCompile(`^([0-9]+)(ms|s)$`)
+
+// xmlNamespace is the namespace of the xml: prefix, as decoded by encoding/xml
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// ssmlMaxBreak is the longest pause Alexa allows
+const ssmlMaxBreak = 10000
+
+// PrepareSSML validates the text play sounds which are written in SSML,
+// and swaps them for the RASpeech they compile to. Text is SSML when it contains a tag,
+// so a plain "<" must be escaped as "&lt;". The <speak> root may be left out.
+func PrepareSSML(items []ProjectItem, triggers []ProjectTriggerItem) error {
+	return prepareActions(items, triggers, func(set *ActionSet) error {
+		for idx, sound := range set.PlaySounds {
+			text, ok := sound.Val.(string)
+			if sound.SoundType != models.RAPlaySoundTypeText || !ok || !strings.Contains(text, "<") {
+				continue
+			}
+			speech, err := ParseSSML(text)
+			if err != nil {
+				return err
+			}
+			set.PlaySounds[idx].Val = speech
+		}
+		return nil
+	})
+}
+
+// ParseSSML validates an SSML document against the tags supported by both Alexa and Google Assistant,
+// returning it wrapped within <speak> along with its plain text
+func ParseSSML(text string) (RASpeech, error) {
+	ssml := strings.TrimSpace(text)
+	if !strings.HasPrefix(ssml, "<speak>") {
+		ssml = "<speak>" + ssml + "</speak>"
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(ssml))
+	plain := &strings.Builder{}
+	depth := 0
+	roots := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return RASpeech{}, fmt.Errorf("invalid SSML %q: %v", text, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			if depth == 0 && (t.Name.Local != "speak" || roots > 1) {
+				return RASpeech{}, fmt.Errorf("invalid SSML %q: a document has only one <speak>", text)
+			}
+			if depth > 0 && t.Name.Local == "speak" {
+				return RASpeech{}, fmt.Errorf("invalid SSML %q: <speak> may not be nested", text)
+			}
+			if err := checkSSMLElement(t); err != nil {
+				return RASpeech{}, fmt.Errorf("invalid SSML %q: %v", text, err)
+			}
+			if t.Name.Local == "break" {
+				plain.WriteByte(' ')
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if t.Name.Local == "p" || t.Name.Local == "s" {
+				plain.WriteByte(' ')
+			}
+		case xml.CharData:
+			if depth == 0 {
+				return RASpeech{}, fmt.Errorf("invalid SSML %q: text outside of <speak>", text)
+			}
+			plain.Write(t)
+		case xml.Comment:
+		default:
+			return RASpeech{}, fmt.Errorf("invalid SSML %q: unexpected %T", text, token)
+		}
+	}
+
+	speech := RASpeech{SSML: ssml, Text: strings.Join(strings.Fields(plain.String()), " ")}
+	if len(speech.SSML) > math.MaxUint16 {
+		return RASpeech{}, fmt.Errorf("SSML may be at most %v bytes", math.MaxUint16)
+	}
+	return speech, nil
+}
+
+// checkSSMLElement checks that an element and its attributes are supported
+func checkSSMLElement(element xml.StartElement) error {
+	name := element.Name.Local
+	attributes, ok := ssmlAttributes[name]
+	if !ok || element.Name.Space != "" {
+		return fmt.Errorf("<%v> is not supported by every runtime", name)
+	}
+
+	found := map[string]bool{}
+	for _, attr := range element.Attr {
+		key := attr.Name.Local
+		// xml:lang is the only namespaced attribute
+		if (attr.Name.Space == xmlNamespace) != (key == "lang") {
+			return fmt.Errorf("<%v> may not have the attribute %v", name, key)
+		}
+		if _, ok := attributes[key]; !ok {
+			return fmt.Errorf("<%v> may not have the attribute %v", name, key)
+		}
+		found[key] = true
+
+		if values, ok := ssmlValues[key]; ok && !values[attr.Value] {
+			return fmt.Errorf("<%v> has an unsupported %v %q", name, key, attr.Value)
+		}
+		switch key {
+		case "time":
+			match := ssmlBreakTime.FindStringSubmatch(attr.Value)
+			if match == nil {
+				return fmt.Errorf("<break> time %q must be in ms or s, such as 500ms", attr.Value)
+			}
+			ms, err := strconv.Atoi(match[1])
+			if err != nil {
+				return fmt.Errorf("<break> time %q is too long", attr.Value)
+			}
+			if match[2] == "s" {
+				ms *= 1000
+			}
+			if ms > ssmlMaxBreak {
+				return fmt.Errorf("<break> time %q is longer than %vs", attr.Value, ssmlMaxBreak/1000)
+			}
+		case "src":
+			u, err := url.Parse(attr.Value)
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("<audio> src %q must be an https URL", attr.Value)
+			}
+		default:
+			if strings.TrimSpace(attr.Value) == "" {
+				return fmt.Errorf("<%v> has an empty %v", name, key)
+			}
+		}
+	}
+	for key, required := range attributes {
+		if required && !found[key] {
+			return fmt.Errorf("<%v> needs the attribute %v", name, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package prepare
+
+import (
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+)
+
+func TestParseSSML(t *testing.T) {
+	valid := map[string]RASpeech{
+		`Hello <break time="500ms"/>world`: {
+			SSML: `<speak>Hello <break time="500ms"/>world</speak>`,
+			Text: "Hello world",
+		},
+		`<speak><p>The <emphasis level="strong">big</emphasis> <sub alias="aluminium">Al</sub> door.</p><s>It's <say-as interpret-as="cardinal">12</say-as> &amp; shut.</s></speak>`: {
+			SSML: `<speak><p>The <emphasis level="strong">big</emphasis> <sub alias="aluminium">Al</sub> door.</p><s>It's <say-as interpret-as="cardinal">12</say-as> &amp; shut.</s></speak>`,
+			Text: "The big Al door. It's 12 & shut.",
+		},
+		`<lang xml:lang="fr-FR">Bonjour</lang><audio src="https://example.com/a.mp3">a bell</audio>`: {
+			SSML: `<speak><lang xml:lang="fr-FR">Bonjour</lang><audio src="https://example.com/a.mp3">a bell</audio></speak>`,
+			Text: "Bonjoura bell",
+		},
+	}
+	for text, expected := range valid {
+		speech, err := ParseSSML(text)
+		if err != nil {
+			t.Errorf("%v: %v", text, err)
+			continue
+		}
+		if speech != expected {
+			t.Errorf("expected %+v, got %+v", expected, speech)
+		}
+	}
+
+	invalid := []string{
+		`Hello <b>world</b>`,
+		`<phoneme alphabet="ipa" ph="pɪˈkɑːn">pecan</phoneme>`,
+		`<break time="20s"/>`,
+		`<break time="soon"/>`,
+		`<break strength="huge"/>`,
+		`<emphasis level="none">a</emphasis>`,
+		`<say-as>12</say-as>`,
+		`<audio src="http://example.com/a.mp3"/>`,
+		`<sub alias="a" extra="b">x</sub>`,
+		`<s>unclosed`,
+		`<speak>a</speak><speak>b</speak>`,
+		`<speak><speak>a</speak></speak>`,
+		`a < b`,
+	}
+	for _, text := range invalid {
+		if _, err := ParseSSML(text); err == nil {
+			t.Errorf("%v: expected an error", text)
+		}
+	}
+}
+
+func TestPrepareSSML(t *testing.T) {
+	items := []ProjectItem{{}}
+	items[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeText, Val: "Plain text stays as it is"},
+		{SoundType: models.RAPlaySoundTypeText, Val: `Wait <break time="1s"/>for it`},
+	}
+	if err := PrepareSSML(items, nil); err != nil {
+		t.Fatal(err)
+	}
+	sounds := items[0].RawLBlock.AlwaysExec.PlaySounds
+	if sounds[0].Val != "Plain text stays as it is" {
+		t.Errorf("expected plain text to be left alone, got %v", sounds[0].Val)
+	}
+	if speech, ok := sounds[1].Val.(RASpeech); !ok || speech.Text != "Wait for it" {
+		t.Errorf("expected speech, got %+v", sounds[1].Val)
+	}
+
+	triggers := []ProjectTriggerItem{{}}
+	triggers[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{{SoundType: models.RAPlaySoundTypeText, Val: "<b>bold</b>"}}
+	if err := PrepareSSML(nil, triggers); err == nil {
+		t.Error("expected an error for unsupported SSML")
+	}
+}
@@ -0,0 +1,543 @@
+package prepare
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/talkative-ai/core/models"
+)
+
+// RAIDTemplate is the RAID of RATemplate
+const RAIDTemplate = RAIDVariable + 3
+
+// TemplateTokenKind is the kind of a token of a compiled template
+type TemplateTokenKind uint8
+
+const (
+	// TemplateText is literal text
+	TemplateText TemplateTokenKind = iota
+	// TemplateValue is the value of a variable
+	TemplateValue
+	// TemplatePlural is the singular form when a variable is 1, and the plural form otherwise
+	TemplatePlural
+	// TemplateIf is the Then tokens when a variable is truthy, and the Else tokens otherwise
+	// A variable is truthy when it is true, a number other than 0, or a string other than "".
+	TemplateIf
+)
+
+// TemplateToken is a token of a template, of which only the fields of its Kind are set
+type TemplateToken struct {
+	Kind     TemplateTokenKind
+	Text     string
+	ID       uint64
+	Singular string
+	Plural   string
+	// Negate inverts the condition of TemplateIf
+	Negate bool
+	Then   []TemplateToken
+	Else   []TemplateToken
+}
+
+// RATemplate is a text play sound with variables filled in by the runtime
+// The text is parsed into tokens at compile time, so the runtime only has to fill in the values.
+// It is compiled as a token list, being the uint16 number of tokens followed by each token:
+//
+// - uint8 kind
+// - (text) uint16 length prefixed text
+// - (value) uint64 variable ID
+// - (plural) uint64 variable ID, then the uint16 length prefixed singular and plural forms
+// - (if) uint64 variable ID, uint8 negate, then the token lists of Then and Else
+type RATemplate struct {
+	Tokens []TemplateToken
+}
+
+// GetRAID implements models.RequestAction
+func (a RATemplate) GetRAID() models.RAID {
+	return RAIDTemplate
+}
+
+// Compile implements models.RequestAction
+func (a RATemplate) Compile() []byte {
+	return appendTemplateTokens([]byte{}, a.Tokens)
+}
+
+// RAIDSpeechTemplate is the RAID of RASpeechTemplate
+const RAIDSpeechTemplate = RAIDVariable + 5
+
+// RASpeechTemplate is a template written in SSML, along with the template of its plain text fallback, as with RASpeech
+// The markup is within the text tokens of the SSML, and the runtime escapes the values of variables
+// as XML when it fills in the SSML. It is compiled as the token list of the SSML within <speak>,
+// then the token list of the plain text, each like that of RATemplate.
+type RASpeechTemplate struct {
+	SSML []TemplateToken
+	Text []TemplateToken
+}
+
+// GetRAID implements models.RequestAction
+func (a RASpeechTemplate) GetRAID() models.RAID {
+	return RAIDSpeechTemplate
+}
+
+// Compile implements models.RequestAction
+func (a RASpeechTemplate) Compile() []byte {
+	return appendTemplateTokens(appendTemplateTokens([]byte{}, a.SSML), a.Text)
+}
+
+func appendTemplateTokens(b []byte, tokens []TemplateToken) []byte {
+	b = appendUint16(b, len(tokens))
+	for _, token := range tokens {
+		b = append(b, byte(token.Kind))
+		switch token.Kind {
+		case TemplateText:
+			b = appendTemplateString(b, token.Text)
+		case TemplateValue:
+			b = appendUint64(b, token.ID)
+		case TemplatePlural:
+			b = appendUint64(b, token.ID)
+			b = appendTemplateString(b, token.Singular)
+			b = appendTemplateString(b, token.Plural)
+		case TemplateIf:
+			b = appendUint64(b, token.ID)
+			negate := byte(0)
+			if token.Negate {
+				negate = 1
+			}
+			b = append(b, negate)
+			b = appendTemplateTokens(b, token.Then)
+			b = appendTemplateTokens(b, token.Else)
+		}
+	}
+	return b
+}
+
+func appendUint16(b []byte, n int) []byte {
+	l := make([]byte, 2)
+	binary.LittleEndian.PutUint16(l, uint16(n))
+	return append(b, l...)
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	l := make([]byte, 8)
+	binary.LittleEndian.PutUint64(l, n)
+	return append(b, l...)
+}
+
+func appendTemplateString(b []byte, s string) []byte {
+	return append(appendUint16(b, len(s)), s...)
+}
+
+// templateTag matches a tag at the start of text: a value, a plural, or part of a conditional
+var templateTag = regexp.MustCompile(`^\{\s*(if\s+!?\s*[A-Za-z_][A-Za-z0-9_]*|else|end|[A-Za-z_][A-Za-z0-9_]*(\|[^{}|]*\|[^{}|]*)?)\s*\}`)
+
+// IsTemplate reports whether the text of a play sound is a template, which is when it contains a tag
+// Within a template, a plain "{" must be escaped as "{{", and a plain "}" as "}}".
+// Text without a tag is spoken as it is written, braces and all, as it was before templates.
+// Braces within the markup of SSML are never tags.
+func IsTemplate(text string) bool {
+	ssml := strings.Contains(text, "<")
+	for idx := 0; idx < len(text); idx++ {
+		if ssml && text[idx] == '<' {
+			if end := strings.IndexByte(text[idx:], '>'); end >= 0 {
+				idx += end
+			}
+			continue
+		}
+		if text[idx] != '{' {
+			continue
+		}
+		if idx+1 < len(text) && text[idx+1] == '{' {
+			idx++
+			continue
+		}
+		if templateTag.MatchString(text[idx:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrepareTemplates is the phase after PrepareVariables which parses the text play sounds written as templates,
+// and swaps them for the RATemplate they compile to. The tags of a template are:
+//
+//	{gold}                     the value of gold
+//	{gold|coin|coins}          coin when gold is 1, and coins otherwise
+//	{if door_open}...{end}     the text within when door_open is truthy
+//	{if !door_open}...{else}...{end}
+//
+// Every variable must be known, being either declared or set by a variable action of the project.
+// Text with a tag which names no known variable, such as "Say {yes} or {no}", is spoken as it is written,
+// as it was before templates.
+// Templates written in SSML are swapped for the RASpeechTemplate they compile to instead.
+func PrepareTemplates(items []ProjectItem, triggers []ProjectTriggerItem, vars Variables, declared map[uint64]bool) error {
+	known := map[uint64]bool{}
+	for id := range declared {
+		known[id] = true
+	}
+	prepareActions(items, triggers, func(set *ActionSet) error {
+		for _, val := range set.Actions {
+			if action, ok := val.(RAVariable); ok {
+				known[action.ID] = true
+			}
+		}
+		return nil
+	})
+
+	unknown := false
+	resolve := func(name string) (uint64, error) {
+		id, ok := vars[name]
+		if !ok || !known[id] {
+			unknown = true
+			return 0, fmt.Errorf("%v is neither declared nor set by any variable action", name)
+		}
+		return id, nil
+	}
+	return prepareActions(items, triggers, func(set *ActionSet) error {
+		for idx, sound := range set.PlaySounds {
+			text, ok := sound.Val.(string)
+			if sound.SoundType != models.RAPlaySoundTypeText || !ok || !IsTemplate(text) {
+				continue
+			}
+			unknown = false
+			if strings.Contains(text, "<") {
+				speech, err := ParseSSMLTemplate(text, resolve)
+				if unknown {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				set.PlaySounds[idx].Val = speech
+				continue
+			}
+			tokens, err := ParseTemplate(text, resolve)
+			if unknown {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// Text which only escapes its braces remains an ordinary play sound
+			if len(tokens) == 1 && tokens[0].Kind == TemplateText {
+				set.PlaySounds[idx].Val = tokens[0].Text
+				continue
+			}
+			set.PlaySounds[idx].Val = RATemplate{Tokens: tokens}
+		}
+		return nil
+	})
+}
+
+// ParseTemplate parses a template into its tokens, calling resolve for the ID of each variable
+// Every count and length within the compiled template fits within a uint16 when the template does.
+// When the template is SSML, its markup is literal text, so tags are only within the text of the SSML.
+func ParseTemplate(text string, resolve func(name string) (uint64, error)) ([]TemplateToken, error) {
+	if len(text) > math.MaxUint16 {
+		return nil, fmt.Errorf("a template may be at most %v bytes", math.MaxUint16)
+	}
+	p := &templateParser{text: text, ssml: strings.Contains(text, "<"), resolve: resolve}
+	tokens, end, err := p.tokens()
+	if err == nil && end != "" {
+		err = fmt.Errorf("{%v} without an {if}", end)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("template %q: %v", text, err)
+	}
+	return tokens, nil
+}
+
+type templateParser struct {
+	text    string
+	pos     int
+	ssml    bool
+	resolve func(name string) (uint64, error)
+}
+
+// tokens parses tokens until the end of the text, or an {else} or {end} tag, which it returns
+func (p *templateParser) tokens() ([]TemplateToken, string, error) {
+	tokens := []TemplateToken{}
+	literal := &strings.Builder{}
+	flush := func() {
+		if literal.Len() > 0 {
+			tokens = append(tokens, TemplateToken{Kind: TemplateText, Text: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if p.ssml && c == '<' {
+			end := strings.IndexByte(p.text[p.pos:], '>')
+			if end < 0 {
+				end = len(p.text) - p.pos - 1
+			}
+			literal.WriteString(p.text[p.pos : p.pos+end+1])
+			p.pos += end + 1
+			continue
+		}
+		if c != '{' && c != '}' {
+			literal.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 < len(p.text) && p.text[p.pos+1] == c {
+			literal.WriteByte(c)
+			p.pos += 2
+			continue
+		}
+		if c == '}' {
+			return nil, "", fmt.Errorf("unexpected } at %v, a plain } is written }}", p.pos)
+		}
+
+		end := strings.IndexAny(p.text[p.pos+1:], "{}")
+		if end < 0 || p.text[p.pos+1+end] != '}' {
+			return nil, "", fmt.Errorf("unclosed { at %v", p.pos)
+		}
+		tag := strings.TrimSpace(p.text[p.pos+1 : p.pos+1+end])
+		p.pos += end + 2
+		flush()
+		if tag == "else" || tag == "end" {
+			return tokens, tag, nil
+		}
+		token, err := p.tag(tag)
+		if err != nil {
+			return nil, "", err
+		}
+		tokens = append(tokens, token)
+	}
+	flush()
+	return tokens, "", nil
+}
+
+// tag parses the contents of a tag, along with the body of an {if}
+func (p *templateParser) tag(tag string) (TemplateToken, error) {
+	if strings.HasPrefix(tag, "if ") {
+		token := TemplateToken{Kind: TemplateIf, Else: []TemplateToken{}}
+		name := strings.TrimSpace(tag[3:])
+		if strings.HasPrefix(name, "!") {
+			token.Negate = true
+			name = strings.TrimSpace(name[1:])
+		}
+		var err error
+		if token.ID, err = p.variable(name); err != nil {
+			return token, err
+		}
+		var end string
+		if token.Then, end, err = p.tokens(); err != nil {
+			return token, err
+		}
+		if end == "else" {
+			if token.Else, end, err = p.tokens(); err != nil {
+				return token, err
+			}
+		}
+		if end == "else" {
+			return token, fmt.Errorf("{%v} has more than one {else}", tag)
+		}
+		if end != "end" {
+			return token, fmt.Errorf("{%v} is missing its {end}", tag)
+		}
+		return token, nil
+	}
+
+	parts := strings.Split(tag, "|")
+	id, err := p.variable(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return TemplateToken{}, err
+	}
+	switch len(parts) {
+	case 1:
+		return TemplateToken{Kind: TemplateValue, ID: id}, nil
+	case 3:
+		if p.ssml && strings.ContainsAny(parts[1]+parts[2], "<>") {
+			return TemplateToken{}, fmt.Errorf("{%v}: the forms of a plural may not contain SSML", tag)
+		}
+		return TemplateToken{Kind: TemplatePlural, ID: id, Singular: parts[1], Plural: parts[2]}, nil
+	}
+	return TemplateToken{}, fmt.Errorf("{%v} must be {name} or {name|singular|plural}", tag)
+}
+
+func (p *templateParser) variable(name string) (uint64, error) {
+	if !IsVariableName(name) {
+		return 0, fmt.Errorf("invalid variable name %q", name)
+	}
+	return p.resolve(name)
+}
+
+// ParseSSMLTemplate parses a template written in SSML, whose <speak> root may be left out, as with ParseSSML
+func ParseSSMLTemplate(text string, resolve func(name string) (uint64, error)) (RASpeechTemplate, error) {
+	ssml := strings.TrimSpace(text)
+	if !strings.HasPrefix(ssml, "<speak>") {
+		ssml = "<speak>" + ssml + "</speak>"
+	}
+	tokens, err := ParseTemplate(ssml, resolve)
+	if err != nil {
+		return RASpeechTemplate{}, err
+	}
+	speech, err := NewSpeechTemplate(tokens)
+	if err != nil {
+		return RASpeechTemplate{}, fmt.Errorf("template %q: %v", text, err)
+	}
+	return speech, nil
+}
+
+// NewSpeechTemplate validates the tokens of a template written in SSML, and derives the template of its plain text
+// Each {if} and {else} must hold whole elements, and the SSML must be valid whichever way the conditionals go.
+func NewSpeechTemplate(tokens []TemplateToken) (RASpeechTemplate, error) {
+	if err := checkSSMLBranches(tokens); err != nil {
+		return RASpeechTemplate{}, err
+	}
+	for _, then := range []bool{true, false} {
+		if _, err := ParseSSML(renderSSMLTemplate(tokens, then)); err != nil {
+			return RASpeechTemplate{}, err
+		}
+	}
+	text := plainTemplate(tokens)
+	if len(text) > 0 && text[0].Kind == TemplateText {
+		text[0].Text = strings.TrimLeft(text[0].Text, " ")
+	}
+	if last := len(text) - 1; last >= 0 && text[last].Kind == TemplateText {
+		text[last].Text = strings.TrimRight(text[last].Text, " ")
+	}
+	plain := []TemplateToken{}
+	for _, token := range text {
+		if token.Kind != TemplateText || token.Text != "" {
+			plain = append(plain, token)
+		}
+	}
+	return RASpeechTemplate{SSML: tokens, Text: plain}, nil
+}
+
+// renderSSMLTemplate renders a template written in SSML with a placeholder for each value,
+// taking either the first or the second form of every plural and conditional
+func renderSSMLTemplate(tokens []TemplateToken, then bool) string {
+	b := &strings.Builder{}
+	for _, token := range tokens {
+		switch token.Kind {
+		case TemplateText:
+			b.WriteString(token.Text)
+		case TemplateValue:
+			b.WriteString("0")
+		case TemplatePlural:
+			if then {
+				b.WriteString(token.Singular)
+			} else {
+				b.WriteString(token.Plural)
+			}
+		case TemplateIf:
+			if then {
+				b.WriteString(renderSSMLTemplate(token.Then, then))
+			} else {
+				b.WriteString(renderSSMLTemplate(token.Else, then))
+			}
+		}
+	}
+	return b.String()
+}
+
+// checkSSMLBranches fails unless the markup within each branch of every conditional is balanced
+func checkSSMLBranches(tokens []TemplateToken) error {
+	for _, token := range tokens {
+		if token.Kind != TemplateIf {
+			continue
+		}
+		for _, branch := range [][]TemplateToken{token.Then, token.Else} {
+			for _, then := range []bool{true, false} {
+				decoder := xml.NewDecoder(strings.NewReader("<branch>" + renderSSMLTemplate(branch, then) + "</branch>"))
+				for {
+					_, err := decoder.Token()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						return fmt.Errorf("each {if} and {else} must hold whole elements: %v", err)
+					}
+				}
+			}
+			if err := checkSSMLBranches(branch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// plainTemplate derives the tokens of the plain text of a template written in SSML, as ParseSSML derives plain text
+func plainTemplate(tokens []TemplateToken) []TemplateToken {
+	plain := []TemplateToken{}
+	for _, token := range tokens {
+		switch token.Kind {
+		case TemplateText:
+			token.Text = plainSSML(token.Text)
+		case TemplatePlural:
+			token.Singular, token.Plural = html.UnescapeString(token.Singular), html.UnescapeString(token.Plural)
+		case TemplateIf:
+			token.Then, token.Else = plainTemplate(token.Then), plainTemplate(token.Else)
+		}
+		plain = append(plain, token)
+	}
+	return plain
+}
+
+// plainSSML returns the text of a fragment of SSML, which needn't be balanced, with its whitespace collapsed
+func plainSSML(fragment string) string {
+	b := &strings.Builder{}
+	for len(fragment) > 0 {
+		start := strings.IndexByte(fragment, '<')
+		if start < 0 {
+			b.WriteString(fragment)
+			break
+		}
+		b.WriteString(fragment[:start])
+		end := strings.IndexByte(fragment[start:], '>')
+		if end < 0 {
+			break
+		}
+		tag := fragment[start+1 : start+end]
+		name := strings.FieldsFunc(tag, func(r rune) bool { return r == ' ' || r == '/' || r == '\t' || r == '\n' })
+		switch {
+		case len(name) > 0 && name[0] == "break" && !strings.HasPrefix(tag, "/"):
+			b.WriteByte(' ')
+		case strings.HasPrefix(tag, "/p") && len(name) > 0 && name[0] == "p",
+			strings.HasPrefix(tag, "/s") && len(name) > 0 && name[0] == "s":
+			b.WriteByte(' ')
+		}
+		fragment = fragment[start+end+1:]
+	}
+	text := html.UnescapeString(b.String())
+	collapsed := strings.Join(strings.Fields(text), " ")
+	if collapsed == "" {
+		if text != "" {
+			return " "
+		}
+		return ""
+	}
+	if strings.TrimLeft(text, " \t\n\r") != text {
+		collapsed = " " + collapsed
+	}
+	if strings.TrimRight(text, " \t\n\r") != text {
+		collapsed += " "
+	}
+	return collapsed
+}
+
+// mapTemplateText returns a copy of tokens whose text, including that within conditionals, is passed through fn
+// Markup is only within the text tokens of a template written in SSML, so an element is always within a single token.
+func mapTemplateText(tokens []TemplateToken, fn func(text string) string) []TemplateToken {
+	mapped := []TemplateToken{}
+	for _, token := range tokens {
+		switch token.Kind {
+		case TemplateText:
+			token.Text = fn(token.Text)
+		case TemplateIf:
+			token.Then, token.Else = mapTemplateText(token.Then, fn), mapTemplateText(token.Else, fn)
+		}
+		mapped = append(mapped, token)
+	}
+	return mapped
+}
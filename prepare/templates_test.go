@@ -0,0 +1,229 @@
+package prepare
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+)
+
+func TestParseTemplate(t *testing.T) {
+	vars := Variables{"gold": 1, "door_open": 2}
+	resolve := func(name string) (uint64, error) {
+		if id, ok := vars[name]; ok {
+			return id, nil
+		}
+		return 0, fmt.Errorf("unknown variable %v", name)
+	}
+
+	valid := map[string][]TemplateToken{
+		"You have {gold} {gold|coin|coins} left": {
+			{Kind: TemplateText, Text: "You have "},
+			{Kind: TemplateValue, ID: 1},
+			{Kind: TemplateText, Text: " "},
+			{Kind: TemplatePlural, ID: 1, Singular: "coin", Plural: "coins"},
+			{Kind: TemplateText, Text: " left"},
+		},
+		"The door is {if door_open}open{else}shut{if gold}, and you are rich{end}{end}.": {
+			{Kind: TemplateText, Text: "The door is "},
+			{Kind: TemplateIf, ID: 2,
+				Then: []TemplateToken{{Kind: TemplateText, Text: "open"}},
+				Else: []TemplateToken{
+					{Kind: TemplateText, Text: "shut"},
+					{Kind: TemplateIf, ID: 1, Then: []TemplateToken{{Kind: TemplateText, Text: ", and you are rich"}}, Else: []TemplateToken{}},
+				},
+			},
+			{Kind: TemplateText, Text: "."},
+		},
+		"{ if !door_open }Knock{end} {{literally}}": {
+			{Kind: TemplateIf, ID: 2, Negate: true, Then: []TemplateToken{{Kind: TemplateText, Text: "Knock"}}, Else: []TemplateToken{}},
+			{Kind: TemplateText, Text: " {literally}"},
+		},
+	}
+	for text, expected := range valid {
+		tokens, err := ParseTemplate(text, resolve)
+		if err != nil {
+			t.Errorf("%v: %v", text, err)
+			continue
+		}
+		if !reflect.DeepEqual(tokens, expected) {
+			t.Errorf("%v: expected %+v, got %+v", text, expected, tokens)
+		}
+	}
+
+	invalid := []string{
+		"{silver}",
+		"{gold",
+		"{gold}}",
+		"{gold|coin}",
+		"{gold|coin|coins|many}",
+		"{9lives}",
+		"{}",
+		"{if gold}rich",
+		"{if gold}a{else}b{else}c{end}",
+		"{else}",
+		"a{end}",
+		"{gold {door_open}}",
+	}
+	for _, text := range invalid {
+		if _, err := ParseTemplate(text, resolve); err == nil {
+			t.Errorf("%v: expected an error", text)
+		}
+	}
+}
+
+func TestPrepareTemplates(t *testing.T) {
+	items := []ProjectItem{{}}
+	items[0].RawLBlock.AlwaysExec.Actions = []interface{}{map[string]interface{}{"increment": "gold"}}
+	items[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeText, Val: "You have {gold} {gold|coin|coins}, {name}"},
+		{SoundType: models.RAPlaySoundTypeText, Val: "You have {{gold}} {gold}"},
+		{SoundType: models.RAPlaySoundTypeText, Val: "Plain text"},
+		{SoundType: models.RAPlaySoundTypeText, Val: "Say {yes} or {no}"},
+	}
+	vars := Variables{}
+	added, err := PrepareVariables(items, nil, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, []string{"gold"}) {
+		t.Errorf("expected only the names outside templates to be given IDs, got %v", added)
+	}
+
+	// name is only used within the template, so is only known once declared
+	if added := vars.Add([]string{"name", "gold"}); !reflect.DeepEqual(added, []string{"name"}) {
+		t.Errorf("expected the declared name to be given an ID, got %v", added)
+	}
+	undeclared := []ProjectItem{{RawLBlock: copyBlock(items[0].RawLBlock)}}
+	if err := PrepareTemplates(undeclared, nil, vars, nil); err != nil {
+		t.Fatal(err)
+	}
+	if val := undeclared[0].RawLBlock.AlwaysExec.PlaySounds[0].Val; val != "You have {gold} {gold|coin|coins}, {name}" {
+		t.Errorf("expected a template naming an unknown variable to be spoken as written, got %+v", val)
+	}
+	if err := PrepareTemplates(items, nil, vars, map[uint64]bool{vars["name"]: true}); err != nil {
+		t.Fatal(err)
+	}
+	sounds := items[0].RawLBlock.AlwaysExec.PlaySounds
+	template, ok := sounds[0].Val.(RATemplate)
+	if !ok || len(template.Tokens) != 6 || template.Tokens[3].ID != vars["gold"] || template.Tokens[5].ID != vars["name"] {
+		t.Errorf("unexpected template %+v", sounds[0].Val)
+	}
+	if escaped, ok := sounds[1].Val.(RATemplate); !ok || escaped.Tokens[0].Text != "You have {gold} " {
+		t.Errorf("expected braces within a template to be unescaped, got %+v", sounds[1].Val)
+	}
+	if sounds[2].Val != "Plain text" || sounds[3].Val != "Say {yes} or {no}" {
+		t.Errorf("expected plain text to remain plain, got %v", sounds[2:])
+	}
+	if _, ok := vars["yes"]; ok {
+		t.Error("expected the names of text which is not a template to be left unregistered")
+	}
+	if action := requestAction(sounds[0]); !reflect.DeepEqual(action, template) {
+		t.Errorf("expected the template to be bundled, got %+v", action)
+	}
+
+	triggers := []ProjectTriggerItem{{}}
+	triggers[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeText, Val: `<emphasis level="strong">{gold}</emphasis>`},
+	}
+	if err := PrepareTemplates(nil, triggers, vars, map[uint64]bool{vars["gold"]: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := triggers[0].RawLBlock.AlwaysExec.PlaySounds[0].Val.(RASpeechTemplate); !ok {
+		t.Errorf("expected a template within SSML, got %+v", triggers[0].RawLBlock.AlwaysExec.PlaySounds[0].Val)
+	}
+}
+
+func TestParseSSMLTemplate(t *testing.T) {
+	vars := Variables{"gold": 1, "door_open": 2}
+	resolve := func(name string) (uint64, error) {
+		if id, ok := vars[name]; ok {
+			return id, nil
+		}
+		return 0, fmt.Errorf("unknown variable %v", name)
+	}
+
+	speech, err := ParseSSMLTemplate(`You have <emphasis>{gold}</emphasis> {gold|coin|coins} &amp; <say-as interpret-as="characters">{x}</say-as>.{if door_open}<break time="1s"/>The door is open.{end}`, func(name string) (uint64, error) {
+		if name == "x" {
+			return 3, nil
+		}
+		return resolve(name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssml := []TemplateToken{
+		{Kind: TemplateText, Text: "<speak>You have <emphasis>"},
+		{Kind: TemplateValue, ID: 1},
+		{Kind: TemplateText, Text: "</emphasis> "},
+		{Kind: TemplatePlural, ID: 1, Singular: "coin", Plural: "coins"},
+		{Kind: TemplateText, Text: ` &amp; <say-as interpret-as="characters">`},
+		{Kind: TemplateValue, ID: 3},
+		{Kind: TemplateText, Text: "</say-as>."},
+		{Kind: TemplateIf, ID: 2, Then: []TemplateToken{{Kind: TemplateText, Text: `<break time="1s"/>The door is open.`}}, Else: []TemplateToken{}},
+		{Kind: TemplateText, Text: "</speak>"},
+	}
+	text := []TemplateToken{
+		{Kind: TemplateText, Text: "You have "},
+		{Kind: TemplateValue, ID: 1},
+		{Kind: TemplateText, Text: " "},
+		{Kind: TemplatePlural, ID: 1, Singular: "coin", Plural: "coins"},
+		{Kind: TemplateText, Text: " & "},
+		{Kind: TemplateValue, ID: 3},
+		{Kind: TemplateText, Text: "."},
+		{Kind: TemplateIf, ID: 2, Then: []TemplateToken{{Kind: TemplateText, Text: " The door is open."}}, Else: []TemplateToken{}},
+	}
+	if !reflect.DeepEqual(speech, RASpeechTemplate{SSML: ssml, Text: text}) {
+		t.Errorf("expected %+v and %+v, got %+v", ssml, text, speech)
+	}
+	if IsTemplate(`<audio src="https://example.com/{gold}.mp3"/>`) {
+		t.Error("expected braces within markup not to be a tag")
+	}
+
+	invalid := []string{
+		`{if gold}<emphasis>{end}rich</emphasis>`,
+		`<emphasis>{if gold}rich{else}</emphasis>{end}`,
+		`<emphasis>{gold|<b>coin</b>|coins}</emphasis>`,
+		`<blink>{gold}</blink>`,
+		`<emphasis>{gold}`,
+		`<emphasis>{silver}</emphasis>`,
+	}
+	for _, text := range invalid {
+		if _, err := ParseSSMLTemplate(text, resolve); err == nil {
+			t.Errorf("expected an error for %v", text)
+		}
+	}
+}
+
+func TestPrepareTemplatesLiteralBraces(t *testing.T) {
+	// Lines written before templates, whose braces aren't tags, are spoken as they always were
+	literal := []string{
+		"Braces {{like this}}",
+		"Pick one of {1, 2, 3} :-{",
+		`The note reads {"to": "you"}`,
+		"{ if you must }",
+		"{}",
+		"Mind the gap }{",
+	}
+	items := []ProjectItem{{}}
+	for _, text := range literal {
+		items[0].RawLBlock.AlwaysExec.PlaySounds = append(items[0].RawLBlock.AlwaysExec.PlaySounds, models.RAPlaySound{SoundType: models.RAPlaySoundTypeText, Val: text})
+	}
+	vars := Variables{}
+	added, err := PrepareVariables(items, nil, vars)
+	if err != nil || len(added) != 0 {
+		t.Fatalf("expected no variables, got %v, %v", added, err)
+	}
+	if err := PrepareTemplates(items, nil, vars, nil); err != nil {
+		t.Fatal(err)
+	}
+	for idx, sound := range items[0].RawLBlock.AlwaysExec.PlaySounds {
+		if IsTemplate(literal[idx]) {
+			t.Errorf("%v: expected not to be a template", literal[idx])
+		}
+		if action := requestAction(sound); !reflect.DeepEqual(action, models.RAPlaySound{SoundType: models.RAPlaySoundTypeText, Val: literal[idx]}) {
+			t.Errorf("%v: expected an unchanged play sound, got %+v", literal[idx], action)
+		}
+	}
+}
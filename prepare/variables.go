@@ -1,5 +1,513 @@
 package prepare
 
-func PrepareVariables() {
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/talkative-ai/core/models"
+)
+
+// Variables maps the names of the variables of a project to their IDs
+// Once a name has an ID it keeps it across publishes, so the registry is stored with the project.
+type Variables map[string]uint64
+
+// Names returns the name of each variable ID
+func (vars Variables) Names() map[uint64]string {
+	names := map[uint64]string{}
+	for name, id := range vars {
+		names[id] = name
+	}
+	return names
+}
+
+// Add gives each of the names which has no ID the next free ID, and returns the names it added
+// Names are given IDs in sorted order, so that the same project always gets the same IDs.
+func (vars Variables) Add(names []string) []string {
+	seen := map[string]bool{}
+	added := []string{}
+	for _, name := range names {
+		if _, ok := vars[name]; !ok && !seen[name] {
+			seen[name] = true
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	next := FirstVariableID
+	for _, id := range vars {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	for _, name := range added {
+		vars[name] = next
+		next++
+	}
+	return added
+}
+
+// FirstVariableID is the ID given to the first named variable of a project
+// Named variables are kept well clear of the numeric IDs authors may write directly.
+const FirstVariableID uint64 = 1 << 32
+
+// RAIDVariable is the RAID of RAVariable
+// The RAIDs of core count up from 0, so lakshmi's own begin far above them.
+const RAIDVariable models.RAID = 1 << 16
+
+// VariableOperation is what a variable action does to its variable
+type VariableOperation uint8
+
+const (
+	// VariableSet sets the variable to a string, number or boolean value
+	VariableSet VariableOperation = iota
+	// VariableIncrement adds a number to the variable, 1 by default
+	VariableIncrement
+	// VariableDecrement subtracts a number from the variable, 1 by default
+	VariableDecrement
+	// VariableToggle negates a boolean variable
+	VariableToggle
+)
+
+var variableOperations = map[string]VariableOperation{
+	"set":       VariableSet,
+	"increment": VariableIncrement,
+	"decrement": VariableDecrement,
+	"toggle":    VariableToggle,
+}
+
+// The value types of a compiled variable action match those of compiled logic
+const (
+	variableValueString uint8 = 0
+	variableValueFloat  uint8 = 2
+	variableValueBool   uint8 = 3
+)
+
+// RAVariable is a request action which sets, increments, decrements or toggles a variable
+// It is compiled as:
+//
+// - uint8 operation
+// - uint64 variable ID
+// - (set) uint8 value type, then a uint16 length prefixed string, a float64 or a uint8 boolean
+// - (increment and decrement) float64 amount
+type RAVariable struct {
+	Operation VariableOperation
+	ID        uint64
+	Value     interface{}
+}
+
+// GetRAID implements models.RequestAction
+func (a RAVariable) GetRAID() models.RAID {
+	return RAIDVariable
+}
+
+// Compile implements models.RequestAction
+func (a RAVariable) Compile() []byte {
+	b := make([]byte, 9)
+	b[0] = byte(a.Operation)
+	binary.LittleEndian.PutUint64(b[1:], a.ID)
+	switch a.Operation {
+	case VariableSet:
+		switch v := a.Value.(type) {
+		case string:
+			b = append(b, variableValueString, 0, 0)
+			binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(len(v)))
+			b = append(b, v...)
+		case float64:
+			b = append(b, variableValueFloat)
+			b = appendFloat(b, v)
+		case bool:
+			value := byte(0)
+			if v {
+				value = 1
+			}
+			b = append(b, variableValueBool, value)
+		}
+	case VariableIncrement, VariableDecrement:
+		b = appendFloat(b, a.Value.(float64))
+	}
+	return b
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	n := make([]byte, 8)
+	binary.LittleEndian.PutUint64(n, math.Float64bits(f))
+	return append(b, n...)
+}
+
+// PrepareVariables is the phase before compilation which resolves variable names to IDs
+// It collects every variable name used within the conditions and actions of the dialogs and triggers,
+// gives each new name the next free ID, and rewrites the items to refer to the IDs.
+// Within conditions, names are written as {"var": "gold"} values, as $gold within calc expressions,
+// as the variables compared within the Condition of a statement, such as {"eq": {"gold": 10}},
+// and as the Seed of its random weight.
+// An OrGroup is keyed by numeric ID, so it may only name variables within its values.
+// Templates may only name variables which are declared or set by a variable action, so the names
+// within them are left to PrepareTemplates, and declared names are given their IDs with Variables.Add.
+// The names added to vars are returned in the order they were given their IDs.
+// Where the registry is shared, the names should be registered first, see VariableNames.
+func PrepareVariables(items []ProjectItem, triggers []ProjectTriggerItem, vars Variables) ([]string, error) {
+	blocks := variableBlocks(items, triggers)
+	w := &variableWalker{vars: vars, names: map[string]bool{}}
+	if err := w.blocks(blocks); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range w.names {
+		names = append(names, name)
+	}
+	added := vars.Add(names)
+
+	w.rewrite = true
+	if err := w.blocks(blocks); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// VariableNames returns every variable name used within the dialogs and triggers, sorted,
+// without rewriting them
+// It lets the names be registered before PrepareVariables, which then adds none.
+func VariableNames(items []ProjectItem, triggers []ProjectTriggerItem) ([]string, error) {
+	w := &variableWalker{vars: Variables{}, names: map[string]bool{}}
+	if err := w.blocks(variableBlocks(items, triggers)); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range w.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func variableBlocks(items []ProjectItem, triggers []ProjectTriggerItem) []*RawLBlock {
+	blocks := []*RawLBlock{}
+	for idx := range items {
+		blocks = append(blocks, &items[idx].RawLBlock)
+	}
+	for idx := range triggers {
+		blocks = append(blocks, &triggers[idx].RawLBlock)
+	}
+	return blocks
+}
+
+// variableWalker visits every variable name within raw logical blocks,
+// first to collect the names, and then to rewrite them once rewrite is set
+type variableWalker struct {
+	vars    Variables
+	names   map[string]bool
+	rewrite bool
+}
+
+// resolve returns the ID of a variable name, noting the name while collecting
+func (w *variableWalker) resolve(name string) (uint64, error) {
+	if !IsVariableName(name) {
+		return 0, fmt.Errorf("invalid variable name %q", name)
+	}
+	w.names[name] = true
+	return w.vars[name], nil
+}
+
+func (w *variableWalker) blocks(blocks []*RawLBlock) error {
+	for _, block := range blocks {
+		if err := w.block(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *variableWalker) block(block *RawLBlock) error {
+	if err := w.actions(&block.AlwaysExec); err != nil {
+		return err
+	}
+	if block.Statements == nil {
+		return nil
+	}
+	for _, statements := range *block.Statements {
+		for idx := range statements {
+			if err := w.actions(&statements[idx].Exec); err != nil {
+				return err
+			}
+			condition, err := w.expr(statements[idx].Condition)
+			if err != nil {
+				return err
+			}
+			if w.rewrite {
+				statements[idx].Condition = condition
+			}
+			if random := statements[idx].Random; random != nil {
+				if name, ok := random.Seed.(string); ok {
+					id, err := w.resolve(name)
+					if err != nil {
+						return err
+					}
+					if w.rewrite {
+						random.Seed = float64(id)
+					}
+				}
+			}
+			if statements[idx].Operators == nil {
+				continue
+			}
+			for _, andGroup := range *statements[idx].Operators {
+				for _, varValMap := range andGroup {
+					for varID, val := range varValMap {
+						rewritten, err := w.value(val)
+						if err != nil {
+							return err
+						}
+						varValMap[varID] = rewritten
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expr visits the JSON of an expression tree, see helpers.ParseExpr
+// Its comparisons may name their variables, as in {"eq": {"gold": 10}}, which are rewritten to their IDs
+// like those of the values and calc expressions within it.
+func (w *variableWalker) expr(val interface{}) (interface{}, error) {
+	node, ok := val.(map[string]interface{})
+	if !ok {
+		// Anything else fails within helpers.ParseExpr
+		return val, nil
+	}
+	if len(node) == 1 {
+		for key, child := range node {
+			switch key {
+			case "and", "or":
+				list, ok := child.([]interface{})
+				if !ok {
+					return val, nil
+				}
+				for idx := range list {
+					rewritten, err := w.expr(list[idx])
+					if err != nil {
+						return nil, err
+					}
+					list[idx] = rewritten
+				}
+				return val, nil
+			case "not":
+				rewritten, err := w.expr(child)
+				if err != nil {
+					return nil, err
+				}
+				node[key] = rewritten
+				return val, nil
+			case "calc":
+				return w.value(val)
+			}
+		}
+	}
+
+	// Otherwise the node is an AndGroup of comparisons
+	for operator, comparisons := range node {
+		varValMap, ok := comparisons.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rewritten := map[string]interface{}{}
+		for variable, value := range varValMap {
+			v, err := w.value(value)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := strconv.ParseUint(variable, 10, 64); err != nil {
+				id, err := w.resolve(variable)
+				if err != nil {
+					return nil, err
+				}
+				variable = strconv.FormatUint(id, 10)
+			}
+			rewritten[variable] = v
+		}
+		if w.rewrite {
+			node[operator] = rewritten
+		}
+	}
+	return val, nil
+}
+
+// value visits a JSON condition value
+// Only the {"var": "name"} and {"calc": "..."} objects are changed.
+func (w *variableWalker) value(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case []interface{}:
+		for idx := range v {
+			rewritten, err := w.value(v[idx])
+			if err != nil {
+				return nil, err
+			}
+			v[idx] = rewritten
+		}
+	case map[string]interface{}:
+		if name, ok := v["var"].(string); ok && len(v) == 1 {
+			id, err := w.resolve(name)
+			if err != nil || !w.rewrite {
+				return val, err
+			}
+			return map[string]interface{}{"var": float64(id)}, nil
+		}
+		if text, ok := v["calc"].(string); ok && len(v) == 1 {
+			rewritten, err := w.calc(text)
+			if err != nil || !w.rewrite {
+				return val, err
+			}
+			return map[string]interface{}{"calc": rewritten}, nil
+		}
+		for key := range v {
+			rewritten, err := w.value(v[key])
+			if err != nil {
+				return nil, err
+			}
+			v[key] = rewritten
+		}
+	}
+	return val, nil
+}
+
+// calc replaces each $name within a calc expression with the #ID of the variable
+func (w *variableWalker) calc(text string) (string, error) {
+	out := &strings.Builder{}
+	for pos := 0; pos < len(text); pos++ {
+		if text[pos] != '$' {
+			out.WriteByte(text[pos])
+			continue
+		}
+		end := pos + 1
+		for end < len(text) && isVariableNameByte(text[end], end == pos+1) {
+			end++
+		}
+		id, err := w.resolve(text[pos+1 : end])
+		if err != nil {
+			return "", fmt.Errorf("%v in calc %q", err, text)
+		}
+		fmt.Fprintf(out, "#%v", id)
+		pos = end - 1
+	}
+	return out.String(), nil
+}
+
+// actions replaces the variable actions of an ActionSet with the RAVariable they are,
+// leaving its zone changes to PrepareZones
+func (w *variableWalker) actions(set *ActionSet) error {
+	for idx, val := range set.Actions {
+		if isZoneChange(val) {
+			continue
+		}
+		action, err := w.variableAction(val)
+		if err != nil {
+			return err
+		}
+		if w.rewrite {
+			set.Actions[idx] = action
+		}
+	}
+	return nil
+}
+
+// variableAction reads the JSON form of a variable action
+func (w *variableWalker) variableAction(val interface{}) (RAVariable, error) {
+	if action, ok := val.(RAVariable); ok {
+		// Already prepared, such as when items share their actions
+		return action, nil
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return RAVariable{}, fmt.Errorf("a variable action must be an object, found %T", val)
+	}
+
+	action := RAVariable{}
+	var variable interface{}
+	found := 0
+	for key, operation := range variableOperations {
+		if v, ok := m[key]; ok {
+			action.Operation = operation
+			variable = v
+			found++
+		}
+	}
+	if found != 1 {
+		return RAVariable{}, fmt.Errorf("a variable action must have exactly one of set, increment, decrement or toggle")
+	}
+	value, hasValue := m["value"]
+	if len(m) > 2 || (len(m) == 2 && !hasValue) {
+		return RAVariable{}, fmt.Errorf("a variable action may only have a variable and a value")
+	}
+
+	switch v := variable.(type) {
+	case string:
+		id, err := w.resolve(v)
+		if err != nil {
+			return RAVariable{}, err
+		}
+		action.ID = id
+	case float64:
+		if v < 0 || v != math.Trunc(v) {
+			return RAVariable{}, fmt.Errorf("invalid variable ID %v", v)
+		}
+		action.ID = uint64(v)
+	default:
+		return RAVariable{}, fmt.Errorf("a variable action must name its variable, found %T", variable)
+	}
+
+	switch action.Operation {
+	case VariableSet:
+		switch v := value.(type) {
+		case string:
+			if len(v) > math.MaxUint16 {
+				return RAVariable{}, fmt.Errorf("the value of a variable action may be at most %v bytes", math.MaxUint16)
+			}
+		case float64, bool:
+		default:
+			return RAVariable{}, fmt.Errorf("set needs a string, number or boolean value, found %T", value)
+		}
+		action.Value = value
+	case VariableIncrement, VariableDecrement:
+		if !hasValue {
+			value = float64(1)
+		}
+		if _, ok := value.(float64); !ok {
+			return RAVariable{}, fmt.Errorf("increment and decrement need a numeric value, found %T", value)
+		}
+		action.Value = value
+	case VariableToggle:
+		if hasValue {
+			return RAVariable{}, fmt.Errorf("toggle takes no value")
+		}
+	}
+	return action, nil
+}
+
+// IsVariableName reports whether name may name a variable
+func IsVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for idx := 0; idx < len(name); idx++ {
+		if !isVariableNameByte(name[idx], idx == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isVariableNameByte reports whether c may appear within a variable name
+// Names are letters, digits and underscores, and don't begin with a digit.
+func isVariableNameByte(c byte, first bool) bool {
+	switch {
+	case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
 }
@@ -0,0 +1,134 @@
+package prepare
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+)
+
+func TestPrepareVariables(t *testing.T) {
+	items := []ProjectItem{{}}
+	err := json.Unmarshal([]byte(`{
+		"AlwaysExec": {
+			"PlaySounds": [{"SoundType": 0, "Val": "Welcome"}],
+			"Actions": [{"increment": "visits"}]
+		},
+		"Statements": [[
+			{
+				"Operators": [{"gt": {"1": {"var": "gold"}}}],
+				"Condition": {"and": [
+					{"not": {"calc": "$gold * 2 > $price"}},
+					{"eq": {"door_open": true, "7": {"var": "gold"}}}
+				]},
+				"Exec": {"Actions": [{"set": "gold", "value": 0}]}
+			},
+			{"Random": {"Weight": 1, "Seed": "visits"}}
+		]]
+	}`), &items[0].RawLBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	triggers := []ProjectTriggerItem{{}}
+	triggers[0].RawLBlock.AlwaysExec.Actions = []interface{}{map[string]interface{}{"toggle": "door_open"}}
+
+	names, err := VariableNames(items, triggers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"door_open", "gold", "price", "visits"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+	if _, ok := (*items[0].Statements)[0][0].Condition.(map[string]interface{})["and"].([]interface{})[1].(map[string]interface{})["eq"].(map[string]interface{})["door_open"]; !ok {
+		t.Fatal("VariableNames rewrote the items")
+	}
+
+	// gold already has an ID from an earlier publish, which it keeps
+	vars := Variables{"gold": FirstVariableID + 5}
+	added, err := PrepareVariables(items, triggers, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, []string{"door_open", "price", "visits"}) {
+		t.Errorf("unexpected names added %v", added)
+	}
+	expected := Variables{
+		"gold":      FirstVariableID + 5,
+		"door_open": FirstVariableID + 6,
+		"price":     FirstVariableID + 7,
+		"visits":    FirstVariableID + 8,
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected %v, got %v", expected, vars)
+	}
+
+	block := items[0].RawLBlock
+	if action := block.AlwaysExec.Actions[0]; !reflect.DeepEqual(action, RAVariable{VariableIncrement, FirstVariableID + 8, 1.0}) {
+		t.Errorf("unexpected action %+v", action)
+	}
+	stmt := (*block.Statements)[0][0]
+	if action := stmt.Exec.Actions[0]; !reflect.DeepEqual(action, RAVariable{VariableSet, FirstVariableID + 5, 0.0}) {
+		t.Errorf("unexpected action %+v", action)
+	}
+	andGroup := (*stmt.Operators)[0]
+	if val := andGroup["gt"][1]; !reflect.DeepEqual(val, map[string]interface{}{"var": float64(FirstVariableID + 5)}) {
+		t.Errorf("unexpected value %v", val)
+	}
+	condition := map[string]interface{}{"and": []interface{}{
+		map[string]interface{}{"not": map[string]interface{}{"calc": "#4294967301 * 2 > #4294967303"}},
+		map[string]interface{}{"eq": map[string]interface{}{
+			"4294967302": true,
+			"7":          map[string]interface{}{"var": float64(FirstVariableID + 5)},
+		}},
+	}}
+	if val := stmt.Condition; !reflect.DeepEqual(val, condition) {
+		t.Errorf("unexpected condition %v", val)
+	}
+	if seed := (*block.Statements)[0][1].Random.Seed; seed != float64(FirstVariableID+8) {
+		t.Errorf("unexpected random seed %v", seed)
+	}
+	if action := triggers[0].RawLBlock.AlwaysExec.Actions[0]; !reflect.DeepEqual(action, RAVariable{VariableToggle, FirstVariableID + 6, nil}) {
+		t.Errorf("unexpected action %+v", action)
+	}
+
+	// Preparing again changes nothing
+	added, err = PrepareVariables(items, triggers, vars)
+	if err != nil || len(added) != 0 || !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected nothing to change, got %v %v %v", added, vars, err)
+	}
+}
+
+func TestPrepareVariablesInvalid(t *testing.T) {
+	actions := map[string]interface{}{
+		"two operations":   map[string]interface{}{"set": "a", "toggle": "a"},
+		"unknown field":    map[string]interface{}{"set": "a", "to": 1.0},
+		"invalid name":     map[string]interface{}{"toggle": "1a"},
+		"toggle value":     map[string]interface{}{"toggle": "a", "value": true},
+		"increment string": map[string]interface{}{"increment": "a", "value": "1"},
+		"set list":         map[string]interface{}{"set": "a", "value": []interface{}{}},
+		"not an object":    "a",
+	}
+	for name, action := range actions {
+		items := []ProjectItem{{}}
+		items[0].RawLBlock.AlwaysExec.Actions = []interface{}{action}
+		if _, err := PrepareVariables(items, nil, Variables{}); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+
+	items := []ProjectItem{{}}
+	items[0].RawLBlock.Statements = &[][]RawLStatement{{
+		{Operators: &models.OrGroup{{"eq": {1: map[string]interface{}{"calc": "$ + 1"}}}}},
+	}}
+	if _, err := PrepareVariables(items, nil, Variables{}); err == nil {
+		t.Error("expected an error for an empty name within calc")
+	}
+
+	items[0].RawLBlock.Statements = &[][]RawLStatement{{
+		{Condition: map[string]interface{}{"not": map[string]interface{}{"eq": map[string]interface{}{"1a": 1.0}}}},
+	}}
+	if _, err := PrepareVariables(items, nil, Variables{}); err == nil {
+		t.Error("expected an error for an invalid name compared within a condition")
+	}
+}
@@ -0,0 +1,130 @@
+package prepare
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+
+	"github.com/talkative-ai/core/models"
+)
+
+// RAIDVariants is the RAID of RAVariants
+const RAIDVariants = RAIDVariable + 4
+
+// VariantPolicy is how the runtime picks which variant to play
+type VariantPolicy uint8
+
+const (
+	// VariantRandom picks any variant each time
+	VariantRandom VariantPolicy = iota
+	// VariantRoundRobin plays the variants in order, then starts again
+	VariantRoundRobin
+	// VariantShuffle plays every variant once in a random order before any repeats,
+	// and never plays the same variant twice in a row
+	VariantShuffle
+)
+
+var variantPolicies = map[string]VariantPolicy{
+	"random":      VariantRandom,
+	"round-robin": VariantRoundRobin,
+	"shuffle":     VariantShuffle,
+}
+
+// RAVariants is a text or audio play sound with several variants, of which the runtime plays one
+// The runtime keeps the state of round-robin and shuffle for each session,
+// by the key of the action bundle and the index of the action within it.
+// It is compiled as:
+//
+// - uint8 policy
+// - uint16 number of variants
+// - each variant, as a record of an action bundle: uint64 RAID, uint32 length, then the compiled action
+type RAVariants struct {
+	Policy VariantPolicy
+	Sounds []models.RAPlaySound
+}
+
+// GetRAID implements models.RequestAction
+func (a RAVariants) GetRAID() models.RAID {
+	return RAIDVariants
+}
+
+// Compile implements models.RequestAction
+func (a RAVariants) Compile() []byte {
+	b := []byte{byte(a.Policy), 0, 0}
+	binary.LittleEndian.PutUint16(b[1:], uint16(len(a.Sounds)))
+	for _, sound := range a.Sounds {
+		b = append(b, actionRecord(sound)...)
+	}
+	return b
+}
+
+// PrepareVariants is the first phase of preparation, which swaps the text and audio play sounds
+// written with variants for the RAVariants they compile to:
+//
+//	{"SoundType": 0, "Val": {"variants": ["Hello again", "Welcome back"], "policy": "shuffle"}}
+//	{"SoundType": 1, "Val": {"variants": ["https://example.com/a.mp3", "https://example.com/b.mp3"]}}
+//
+// The policy is random, round-robin or shuffle, and random by default.
+// Each variant is prepared by the later phases as though it were a play sound of its own,
+// so text variants may be SSML or templates. A single variant is left as an ordinary play sound.
+func PrepareVariants(items []ProjectItem, triggers []ProjectTriggerItem) error {
+	return prepareActions(items, triggers, func(set *ActionSet) error {
+		for idx, sound := range set.PlaySounds {
+			m, ok := sound.Val.(map[string]interface{})
+			if !ok || (sound.SoundType != models.RAPlaySoundTypeText && sound.SoundType != models.RAPlaySoundTypeAudio) {
+				continue
+			}
+			variants, err := variantsAction(sound.SoundType, m)
+			if err != nil {
+				return err
+			}
+			if len(variants.Sounds) == 1 {
+				set.PlaySounds[idx] = variants.Sounds[0]
+				continue
+			}
+			set.PlaySounds[idx].Val = variants
+		}
+		return nil
+	})
+}
+
+// variantsAction reads the JSON form of a play sound with variants
+func variantsAction(soundType models.RAPlaySoundType, m map[string]interface{}) (RAVariants, error) {
+	action := RAVariants{}
+	list, ok := m["variants"].([]interface{})
+	if !ok {
+		return action, fmt.Errorf("a play sound object must have a list of variants")
+	}
+	if len(list) == 0 || len(list) > math.MaxUint16 {
+		return action, fmt.Errorf("a play sound must have between 1 and %v variants, found %v", math.MaxUint16, len(list))
+	}
+	if policy, ok := m["policy"]; ok {
+		name, _ := policy.(string)
+		if action.Policy, ok = variantPolicies[name]; !ok {
+			return action, fmt.Errorf("unknown variant policy %#v, expected random, round-robin or shuffle", policy)
+		}
+	}
+	for key := range m {
+		if key != "variants" && key != "policy" {
+			return action, fmt.Errorf("a play sound with variants may only have variants and a policy, found %v", key)
+		}
+	}
+
+	for _, variant := range list {
+		value, ok := variant.(string)
+		if !ok {
+			return action, fmt.Errorf("each variant must be a string, found %T", variant)
+		}
+		sound := models.RAPlaySound{SoundType: soundType, Val: value}
+		if soundType == models.RAPlaySoundTypeAudio {
+			u, err := url.Parse(value)
+			if err != nil || !u.IsAbs() || u.Host == "" {
+				return action, fmt.Errorf("audio variant %q must be an absolute URL", value)
+			}
+			sound.Val = u
+		}
+		action.Sounds = append(action.Sounds, sound)
+	}
+	return action, nil
+}
@@ -0,0 +1,77 @@
+package prepare
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+)
+
+func TestPrepareVariants(t *testing.T) {
+	items := []ProjectItem{{}}
+	err := json.Unmarshal([]byte(`{
+		"AlwaysExec": {"PlaySounds": [
+			{"SoundType": 0, "Val": {"variants": ["Hello again", "Welcome <break time=\"1s\"/>back"], "policy": "shuffle"}},
+			{"SoundType": 1, "Val": {"variants": ["https://example.com/a.mp3", "https://example.com/b.mp3"]}},
+			{"SoundType": 0, "Val": {"variants": ["Only one"], "policy": "round-robin"}},
+			{"SoundType": 0, "Val": "Plain text"}
+		]}
+	}`), &items[0].RawLBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PrepareVariants(items, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Later phases prepare each variant
+	if err := PrepareSSML(items, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sounds := items[0].RawLBlock.AlwaysExec.PlaySounds
+	speech, _ := ParseSSML(`Welcome <break time="1s"/>back`)
+	expected := RAVariants{Policy: VariantShuffle, Sounds: []models.RAPlaySound{
+		{SoundType: models.RAPlaySoundTypeText, Val: "Hello again"},
+		{SoundType: models.RAPlaySoundTypeText, Val: speech},
+	}}
+	if !reflect.DeepEqual(sounds[0].Val, expected) {
+		t.Errorf("expected %+v, got %+v", expected, sounds[0].Val)
+	}
+	audio, ok := sounds[1].Val.(RAVariants)
+	if !ok || audio.Policy != VariantRandom || len(audio.Sounds) != 2 {
+		t.Fatalf("expected random audio variants, got %+v", sounds[1].Val)
+	}
+	if u, ok := audio.Sounds[1].Val.(*url.URL); !ok || u.String() != "https://example.com/b.mp3" {
+		t.Errorf("expected an audio URL, got %v", audio.Sounds[1].Val)
+	}
+	if sounds[2].Val != "Only one" || sounds[3].Val != "Plain text" {
+		t.Errorf("expected single variants and plain text to be ordinary play sounds, got %v and %v", sounds[2].Val, sounds[3].Val)
+	}
+	if action := requestAction(sounds[0]); !reflect.DeepEqual(action, expected) {
+		t.Errorf("expected the variants to be bundled, got %+v", action)
+	}
+
+	invalid := []string{
+		`{"variants": []}`,
+		`{"variants": "Hello"}`,
+		`{"variants": ["Hello", 1]}`,
+		`{"variants": ["Hello"], "policy": "sometimes"}`,
+		`{"variants": ["Hello"], "weights": [1]}`,
+		`{"text": "Hello"}`,
+	}
+	for _, val := range invalid {
+		sound := models.RAPlaySound{SoundType: models.RAPlaySoundTypeText}
+		json.Unmarshal([]byte(val), &sound.Val)
+		items := []ProjectItem{{}}
+		items[0].RawLBlock.AlwaysExec.PlaySounds = []models.RAPlaySound{sound}
+		if err := PrepareVariants(items, nil); err == nil {
+			t.Errorf("%v: expected an error", val)
+		}
+	}
+	sound := models.RAPlaySound{SoundType: models.RAPlaySoundTypeAudio, Val: map[string]interface{}{"variants": []interface{}{"sounds/a.mp3"}}}
+	if err := PrepareVariants(nil, []ProjectTriggerItem{{RawLBlock: RawLBlock{AlwaysExec: ActionSet{PlaySounds: []models.RAPlaySound{sound}}}}}); err == nil {
+		t.Error("expected an error for a relative audio variant")
+	}
+}
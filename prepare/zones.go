@@ -0,0 +1,98 @@
+package prepare
+
+import (
+	"fmt"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+)
+
+// RAIDChangeZone is the RAID of RAChangeZone
+const RAIDChangeZone = RAIDVariable + 1
+
+// RAChangeZone is a request action which moves the player into another zone
+// It is compiled as the 16 bytes of the zone ID.
+type RAChangeZone struct {
+	ZoneID uuid.UUID
+}
+
+// GetRAID implements models.RequestAction
+func (a RAChangeZone) GetRAID() models.RAID {
+	return RAIDChangeZone
+}
+
+// Compile implements models.RequestAction
+func (a RAChangeZone) Compile() []byte {
+	return append([]byte{}, a.ZoneID[:]...)
+}
+
+// PrepareZones checks that every zone change within the dialogs and triggers
+// leads to one of the zones of the project, and swaps each for the RAChangeZone it is.
+// A zone change is written among the Actions of an ActionSet as
+//
+//	{"zone": "<zone id>"}
+func PrepareZones(items []ProjectItem, triggers []ProjectTriggerItem, zones map[uuid.UUID]bool) error {
+	return prepareActions(items, triggers, func(set *ActionSet) error {
+		for idx, val := range set.Actions {
+			if !isZoneChange(val) {
+				continue
+			}
+			action, err := zoneAction(val)
+			if err != nil {
+				return err
+			}
+			if !zones[action.ZoneID] {
+				return fmt.Errorf("zone change leads to %v, which is not a zone of the project", action.ZoneID.String())
+			}
+			set.Actions[idx] = action
+		}
+		return nil
+	})
+}
+
+// isZoneChange reports whether an action is a zone change, rather than a variable action
+func isZoneChange(val interface{}) bool {
+	if _, ok := val.(RAChangeZone); ok {
+		return true
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = m["zone"]
+	return ok
+}
+
+// zoneAction reads the JSON form of a zone change
+func zoneAction(val interface{}) (RAChangeZone, error) {
+	if action, ok := val.(RAChangeZone); ok {
+		// Already prepared, such as when items share their actions
+		return action, nil
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return RAChangeZone{}, fmt.Errorf("a zone change must be an object with only a zone, found %v", val)
+	}
+	id, ok := m["zone"].(string)
+	if !ok {
+		return RAChangeZone{}, fmt.Errorf("a zone change must have a zone ID, found %v", m["zone"])
+	}
+	zoneID, err := uuid.FromString(id)
+	if err != nil {
+		return RAChangeZone{}, fmt.Errorf("invalid zone ID %q", id)
+	}
+	return RAChangeZone{ZoneID: zoneID}, nil
+}
+
+// ZoneChanges returns the zones which a prepared logical block may lead to, in the order they appear
+func ZoneChanges(block *RawLBlock) []uuid.UUID {
+	zones := []uuid.UUID{}
+	for _, set := range blockActionSets(block) {
+		for _, val := range set.Actions {
+			if action, ok := val.(RAChangeZone); ok {
+				zones = append(zones, action.ZoneID)
+			}
+		}
+	}
+	return zones
+}
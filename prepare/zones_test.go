@@ -0,0 +1,58 @@
+package prepare
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/talkative-ai/core/models"
+	uuid "github.com/talkative-ai/go.uuid"
+)
+
+func TestPrepareZones(t *testing.T) {
+	cave, _ := uuid.FromString("00000000-0000-0000-0000-00000000000c")
+	forest, _ := uuid.FromString("00000000-0000-0000-0000-00000000000f")
+	zones := map[uuid.UUID]bool{cave: true, forest: true}
+
+	items := []ProjectItem{{ZoneID: forest}}
+	items[0].RawLBlock.Statements = &[][]RawLStatement{{
+		{Exec: ActionSet{
+			PlaySounds: []models.RAPlaySound{{SoundType: models.RAPlaySoundTypeText, Val: "Into the cave"}},
+			Actions:    []interface{}{map[string]interface{}{"zone": cave.String()}},
+		}},
+	}}
+	if err := PrepareZones(items, nil, zones); err != nil {
+		t.Fatal(err)
+	}
+	if changes := ZoneChanges(&items[0].RawLBlock); !reflect.DeepEqual(changes, []uuid.UUID{cave}) {
+		t.Errorf("expected a change into the cave, got %v", changes)
+	}
+	// Preparing again changes nothing
+	if err := PrepareZones(items, nil, zones); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]interface{}{
+		"unknown zone":   map[string]interface{}{"zone": "00000000-0000-0000-0000-000000000001"},
+		"invalid zone":   map[string]interface{}{"zone": "cave"},
+		"unknown fields": map[string]interface{}{"zone": cave.String(), "then": "forest"},
+	}
+	for name, val := range invalid {
+		triggers := []ProjectTriggerItem{{ZoneID: cave}}
+		triggers[0].RawLBlock.AlwaysExec.Actions = []interface{}{val}
+		if err := PrepareZones(nil, triggers, zones); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+
+	// Actions without a zone are variable actions, which PrepareVariables refuses
+	for _, val := range []interface{}{map[string]interface{}{"to": cave.String()}, cave.String()} {
+		triggers := []ProjectTriggerItem{{ZoneID: cave}}
+		triggers[0].RawLBlock.AlwaysExec.Actions = []interface{}{val}
+		if err := PrepareZones(nil, triggers, zones); err != nil {
+			t.Errorf("%v: expected zone preparation to leave it, got %v", val, err)
+		}
+		if _, err := PrepareVariables(nil, triggers, Variables{}); err == nil {
+			t.Errorf("%v: expected an error", val)
+		}
+	}
+}
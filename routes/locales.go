@@ -0,0 +1,166 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/talkative-ai/core/common"
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/core/myerrors"
+	"github.com/talkative-ai/core/prehandle"
+	"github.com/talkative-ai/core/redis"
+	"github.com/talkative-ai/core/router"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/analyze"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// PutLocales router.Route
+// Path: "/v1/locales/{id}",
+// Method: "PUT",
+// Accepts a list of locales, such as ["en", "es", "de"], of which the first is the default
+// Replaces the locales of the project
+var PutLocales = &router.Route{
+	Path:       "/v1/locales/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}",
+	Method:     "PUT",
+	Handler:    http.HandlerFunc(putLocalesHandler),
+	Prehandler: []prehandle.Prehandler{prehandle.SetJSON},
+}
+
+func putLocalesHandler(w http.ResponseWriter, r *http.Request) {
+	urlparams := mux.Vars(r)
+	projectID, err := uuid.FromString(urlparams["id"])
+	if err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Message: "bad_id",
+			Req:     r,
+		})
+		return
+	}
+
+	locales := []string{}
+	if err := json.NewDecoder(r.Body).Decode(&locales); err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Log:     err.Error(),
+			Req:     r,
+			Message: "Invalid locales",
+		})
+		return
+	}
+	if err := prepare.CheckLocales(locales); err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Log:     err.Error(),
+			Req:     r,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	b, _ := json.Marshal(locales)
+	common.RedisSET(localesKey(projectID), b).Exec(redis.Instance)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// localesKey is the Redis key of the locales of a project, as a JSON list
+// Like the variable declarations, they belong to the project rather than any one publish.
+func localesKey(projectID uuid.UUID) string {
+	return fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(projectID.String()), "locales")
+}
+
+// getLocales loads the locales of a project, the first being the default
+// A project which hasn't chosen its locales only has prepare.DefaultLocale.
+func getLocales(projectID uuid.UUID) ([]string, error) {
+	stored := redis.Instance.Get(localesKey(projectID)).Val()
+	if stored == "" {
+		return []string{prepare.DefaultLocale}, nil
+	}
+	locales := []string{}
+	if err := json.Unmarshal([]byte(stored), &locales); err != nil {
+		return nil, fmt.Errorf("invalid locales stored for project %v: %v", projectID.String(), err)
+	}
+	if err := prepare.CheckLocales(locales); err != nil {
+		return nil, fmt.Errorf("invalid locales stored for project %v: %v", projectID.String(), err)
+	}
+	return locales, nil
+}
+
+// localeProject is a project as prepared for one of its locales
+type localeProject struct {
+	locale       string
+	items        []prepare.ProjectItem
+	triggers     []prepare.ProjectTriggerItem
+	declarations map[uint64]analyze.Declaration
+}
+
+// prepareLocale localizes the dialogs and triggers of a project, then runs every phase of preparation over them
+// but the media, which prepareMedia runs over every locale at once
+func prepareLocale(projectID uuid.UUID, workbenchProject models.Project, items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, locales []string, locale string) (*localeProject, error) {
+	items, triggers, err := prepare.Localize(items, triggers, locales, locale)
+	if err != nil {
+		return nil, &helpers.CompileError{Entity: "locales", Err: err}
+	}
+	prepared := &localeProject{locale: locale, items: items, triggers: triggers}
+	prepared.declarations, err = prepareLogic(projectID, items, triggers, true)
+	if err != nil {
+		return nil, inLocale(err, locales, locale)
+	}
+
+	// Zone changes may only lead to the zones of the project
+	zones := map[uuid.UUID]bool{}
+	for _, item := range items {
+		zones[item.ZoneID] = true
+	}
+	for _, trigger := range triggers {
+		zones[trigger.ZoneID] = true
+	}
+	if workbenchProject.StartZoneID.Valid {
+		zones[workbenchProject.StartZoneID.UUID] = true
+	}
+	if err := prepare.PrepareZones(items, triggers, zones); err != nil {
+		return nil, inLocale(&helpers.CompileError{Entity: "zones", Err: err}, locales, locale)
+	}
+	if err := prepare.PrepareSSML(items, triggers); err != nil {
+		return nil, inLocale(&helpers.CompileError{Entity: "SSML", Err: err}, locales, locale)
+	}
+	return prepared, nil
+}
+
+// inLocale names the locale within a problem with a locale other than the default
+// Problems within lakshmi itself, and type errors, which are reported as diagnostics, are left as they are.
+func inLocale(err error, locales []string, locale string) error {
+	if compileErr, ok := err.(*helpers.CompileError); ok && locale != locales[0] {
+		return &helpers.CompileError{Entity: fmt.Sprintf("locale %v", locale), Err: compileErr}
+	}
+	return err
+}
+
+// localizedContentHash hashes what every locale of a publish is compiled from,
+// along with what the publish writes beside them: the locales, the default locale first,
+// and the declared variables with their defaults
+func localizedContentHash(project models.Project, localized []*localeProject, locales []string, declarations map[uint64]analyze.Declaration) (string, error) {
+	// Maps are marshalled with their keys sorted, so the same declarations always hash the same
+	declared, err := json.Marshal(declarations)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "locales:%v\n", strings.Join(locales, ","))
+	fmt.Fprintf(hash, "declarations:%s\n", declared)
+	for _, prepared := range localized {
+		h, err := helpers.ContentHash(project, prepared.items, prepared.triggers)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%v:%v\n", prepared.locale, h)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
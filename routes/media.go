@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"fmt"
+
+	"github.com/talkative-ai/core/common"
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// Media prepares the audio of each publish for smart speakers
+// It is nil unless configured, in which case audio URLs are compiled as they are written.
+var Media *prepare.Media
+
+// prepareMedia prepares the audio of every locale of a publish, see prepare.Resources
+// The sources of all the locales are prepared together, so that audio they share is only
+// downloaded, transcoded and stored once, and every locale refers to the same assets.
+func prepareMedia(localized []*localeProject) ([]prepare.Asset, error) {
+	sources := []string{}
+	for _, prepared := range localized {
+		sources = append(sources, prepare.MediaSources(prepared.items, prepared.triggers)...)
+	}
+	assets, err := Media.Prepare(sources)
+	if err != nil {
+		return nil, &helpers.CompileError{Entity: "media", Err: err}
+	}
+	for _, prepared := range localized {
+		prepare.RewriteMedia(prepared.items, prepared.triggers, assets)
+	}
+	return assets, nil
+}
+
+// compileMedia stores where each audio source was prepared to, and its checksum,
+// within the static metadata of the publish
+func compileMedia(redisWriter chan common.RedisCommand, publishID string, assets []prepare.Asset) {
+	key := fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "media")
+	for _, asset := range assets {
+		redisWriter <- common.RedisHSET(key, asset.Source, []byte(fmt.Sprintf("%v %v", asset.URL, asset.SHA256)))
+	}
+}
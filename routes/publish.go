@@ -1,9 +1,12 @@
 package routes
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,8 +19,12 @@ import (
 	"github.com/talkative-ai/core/redis"
 	"github.com/talkative-ai/core/router"
 	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/analyze"
+	"github.com/talkative-ai/lakshmi/blob"
 	"github.com/talkative-ai/lakshmi/compile"
+	"github.com/talkative-ai/lakshmi/decompile"
 	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
 )
 
 // PostPublish router.Route
@@ -56,6 +63,9 @@ func PostPublishHandler(w http.ResponseWriter, r *http.Request) {
 		isDemo = true
 	}
 
+	// Optionally re-read and decode everything written, before the publish is marked as published
+	isVerified := r.URL.Query().Get("verify") != ""
+
 	if isDemo {
 		version = -1
 		publishID = fmt.Sprintf("demo:%+v", publishID)
@@ -75,11 +85,26 @@ func PostPublishHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	err = initiateCompiler(projectID, publishID, version, isDemo)
+	diagnostics, err := initiateCompiler(projectID, publishID, version, isDemo, isVerified)
 	if err != nil {
 		common.RedisSET(
 			fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "status"),
 			[]byte(fmt.Sprintf("%v", models.PublishStatusProblem))).Exec(redis.Instance)
+		// Problems with the project itself are reported back to the author
+		if typeErr, ok := err.(*analyze.TypeError); ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			respondDiagnostics(w, typeErr.Diagnostics)
+			return
+		}
+		if compileErr, ok := err.(*helpers.CompileError); ok {
+			myerrors.Respond(w, &myerrors.MySimpleError{
+				Code:    http.StatusUnprocessableEntity,
+				Log:     compileErr.Error(),
+				Req:     r,
+				Message: compileErr.Error(),
+			})
+			return
+		}
 		myerrors.Respond(w, &myerrors.MySimpleError{
 			Code: http.StatusInternalServerError,
 			Log:  err.Error(),
@@ -87,6 +112,19 @@ func PostPublishHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+
+	respondDiagnostics(w, diagnostics)
+}
+
+// respondDiagnostics reports the likely mistakes found within the project back to the author
+// They never prevent a project from being submitted or published.
+func respondDiagnostics(w http.ResponseWriter, diagnostics []analyze.Diagnostic) {
+	if diagnostics == nil {
+		diagnostics = []analyze.Diagnostic{}
+	}
+	json.NewEncoder(w).Encode(struct {
+		Diagnostics []analyze.Diagnostic
+	}{diagnostics})
 }
 
 type SyncGroup struct {
@@ -95,21 +133,25 @@ type SyncGroup struct {
 	wgSema uint8
 }
 
-func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDemo bool) error {
+// initiateCompiler compiles and stores a versioned project,
+// returning the diagnostics found within its logic
+// When verify is set, the stored data is decoded again with verifyPublish before it is marked as published.
+func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDemo bool, verify bool) ([]analyze.Diagnostic, error) {
+
+	// Refuse, before anything is written, to overwrite data compiled in a newer format
+	// A runtime deployed alongside the newer lakshmi may not read ours
+	formatVersion, err := redis.Instance.HGet(models.KeynavProjectMetadataStatic(publishID), "format_version").Int64()
+	if err == nil && formatVersion > int64(blob.Version) {
+		return nil, fmt.Errorf("published data is in format version %v, which is newer than %v", formatVersion, blob.Version)
+	}
 
 	common.RedisSET(
 		fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "status"),
 		[]byte(fmt.Sprintf("%v", models.PublishStatusPublishing)))
 
-	var project models.VersionedProject
-	err := db.DBMap.SelectOne(&project, `
-			SELECT *
-			FROM static_published_projects_versioned
-			WHERE "ProjectID"=$1
-			AND "Version"=$2
-		`, projectID, version)
+	project, err := helpers.GetVersionedProject(projectID, version)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	projectItems := project.ProjectData
@@ -122,6 +164,48 @@ func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDe
 		triggerItems[idx].ProjectID = projectID
 	}
 
+	locales, err := getLocales(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	workbenchProject := models.Project{}
+	err = db.DBMap.SelectOne(&workbenchProject, `SELECT * FROM workbench_projects WHERE "ID"=$1`, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each locale is prepared from its own copy of the project, the default locale first
+	localized := []*localeProject{}
+	for _, locale := range locales {
+		prepared, err := prepareLocale(projectID, workbenchProject, projectItems, triggerItems, locales, locale)
+		if err != nil {
+			return nil, err
+		}
+		localized = append(localized, prepared)
+	}
+	declarations := localized[0].declarations
+	assets := []prepare.Asset{}
+	if Media != nil {
+		fmt.Println("Preparing media")
+		if assets, err = prepareMedia(localized); err != nil {
+			return nil, err
+		}
+	}
+
+	diagnostics := analyze.Project(localized[0].items)
+	diagnostics = append(diagnostics, analyze.Translations(projectItems, triggerItems, locales)...)
+	for _, diagnostic := range diagnostics {
+		fmt.Println("Diagnostic:", diagnostic)
+	}
+
+	// Compilation is deterministic, so the hash tells whether this publish changes anything
+	contentHash, err := localizedContentHash(workbenchProject, localized, locales, declarations)
+	if err != nil {
+		return nil, err
+	}
+	previousHash := redis.Instance.HGet(models.KeynavProjectMetadataStatic(publishID), "content_hash").Val()
+
 	// Delete old published data
 	membersSlice := redis.Instance.SMembers(fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "keys"))
 	redis.Instance.Del(membersSlice.Val()...)
@@ -167,32 +251,32 @@ func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDe
 		Error error
 	}
 
+	optimizeStats := &helpers.OptimizeStats{}
+	bundleStore := helpers.NewBundleStore(publishID)
+
 	compileDialogChannel := make(chan compileDialogResult)
 	go func() {
 		fmt.Println("Compiling dialog and graph")
-		items := []models.ProjectItem(projectItems)
-		graph, err := compile.Dialog(redisWriter, &items, publishID)
+		items := []prepare.ProjectItem(localized[0].items)
+		graph, err := compile.Dialog(redisWriter, &items, publishID, bundleStore, optimizeStats, prepare.LocaleLanguage(locales[0]))
 		result := compileDialogResult{graph, err}
 		compileDialogChannel <- result
 	}()
 
+	compileDefaults(redisWriter, publishID, declarations)
+	compileMedia(redisWriter, publishID, assets)
+
 	compileMetadataChannel := make(chan error)
 	go func() {
-		project := models.Project{}
-		err = db.DBMap.SelectOne(&project, `SELECT * FROM workbench_projects WHERE "ID"=$1`, projectID)
-		if err != nil {
-			compileMetadataChannel <- err
-			return
-		}
-		items := []models.ProjectItem(projectItems)
-		err := compile.Metadata(redisWriter, project, &items, version, publishID, isDemo)
+		items := []prepare.ProjectItem(localized[0].items)
+		err := compile.Metadata(redisWriter, workbenchProject, &items, version, publishID, isDemo, locales)
 		compileMetadataChannel <- err
 	}()
 
 	compileActorChannel := make(chan error)
 	go func() {
 		fmt.Println("Compiling actors into zones")
-		items := []models.ProjectItem(projectItems)
+		items := []prepare.ProjectItem(localized[0].items)
 		err := compile.Actor(redisWriter, &items, publishID)
 		compileActorChannel <- err
 	}()
@@ -200,41 +284,103 @@ func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDe
 	compileTriggerChannel := make(chan error)
 	go func() {
 		fmt.Println("Compiling triggers into zones")
-		triggerItems := []models.ProjectTriggerItem(project.TriggerData)
-		err := compile.Trigger(redisWriter, &triggerItems, publishID)
+		triggerItems := []prepare.ProjectTriggerItem(localized[0].triggers)
+		err := compile.Trigger(redisWriter, &triggerItems, publishID, bundleStore)
 		compileTriggerChannel <- err
 	}()
 
-	for i := 0; i < 4; i++ {
+	compileZoneChannel := make(chan error)
+	go func() {
+		fmt.Println("Compiling zone exits")
+		items := []prepare.ProjectItem(localized[0].items)
+		triggerItems := []prepare.ProjectTriggerItem(localized[0].triggers)
+		err := compile.Zones(redisWriter, &items, &triggerItems, publishID)
+		compileZoneChannel <- err
+	}()
+
+	// The bundle stores of the other locales, which are only read once the locales are compiled
+	localeBundles := []*helpers.BundleStore{}
+	compileLocaleChannel := make(chan error)
+	go func() {
+		for _, prepared := range localized[1:] {
+			fmt.Println("Compiling dialog and triggers in", prepared.locale)
+			items := []prepare.ProjectItem(prepared.items)
+			triggerItems := []prepare.ProjectTriggerItem(prepared.triggers)
+			store, err := compile.Locale(redisWriter, &items, &triggerItems, publishID, prepared.locale, optimizeStats)
+			if err != nil {
+				compileLocaleChannel <- &helpers.CompileError{Entity: fmt.Sprintf("locale %v", prepared.locale), Err: err}
+				return
+			}
+			localeBundles = append(localeBundles, store)
+		}
+		compileLocaleChannel <- nil
+	}()
+
+	// Every phase is waited for, even once one has failed, as they all write through redisWriter
+	var compileErr error
+	for i := 0; i < 6; i++ {
 		select {
 		case msgDialog := <-compileDialogChannel:
 			if msgDialog.Error != nil {
 				fmt.Println("There was a problem compiling/saving the dialog", msgDialog.Error)
-				return msgDialog.Error
+				if compileErr == nil {
+					compileErr = msgDialog.Error
+				}
+				continue
 			}
 			fmt.Println("Successfully compiled and stored dialog graph")
+			fmt.Println("The optimizer saved", optimizeStats)
 
 		case msgMetadata := <-compileMetadataChannel:
 			if msgMetadata != nil {
 				fmt.Println("There was a problem compiling the metadata", msgMetadata)
-				return msgMetadata
+				if compileErr == nil {
+					compileErr = msgMetadata
+				}
+				continue
 			}
 			fmt.Println("Successfully compiled metadata")
 
 		case msgActor := <-compileActorChannel:
 			if msgActor != nil {
 				fmt.Println("There was a problem compiling the actors", msgActor)
-				return msgActor
+				if compileErr == nil {
+					compileErr = msgActor
+				}
+				continue
 			}
 			fmt.Println("Successfully compiled actors")
 
 		case msgTrigger := <-compileTriggerChannel:
 			if msgTrigger != nil {
 				fmt.Println("There was a problem compiling the triggers", msgTrigger)
-				return msgTrigger
+				if compileErr == nil {
+					compileErr = msgTrigger
+				}
+				continue
 			}
 			fmt.Println("Successfully compiled triggers")
 
+		case msgZone := <-compileZoneChannel:
+			if msgZone != nil {
+				fmt.Println("There was a problem compiling the zone exits", msgZone)
+				if compileErr == nil {
+					compileErr = msgZone
+				}
+				continue
+			}
+			fmt.Println("Successfully compiled zone exits")
+
+		case msgLocale := <-compileLocaleChannel:
+			if msgLocale != nil {
+				fmt.Println("There was a problem compiling the locales", msgLocale)
+				if compileErr == nil {
+					compileErr = msgLocale
+				}
+				continue
+			}
+			fmt.Println("Successfully compiled", len(localized)-1, "other locales")
+
 		}
 	}
 
@@ -246,11 +392,21 @@ func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDe
 	swg.wgSema = 1
 	swg.wgMu.Unlock()
 	swg.wg.Wait()
+	if compileErr != nil {
+		return nil, compileErr
+	}
+
+	if verify {
+		if err := verifyPublish(publishID, localized[0].items, localized[0].triggers); err != nil {
+			return nil, err
+		}
+		fmt.Println("Successfully verified the compiled data")
+	}
 
 	if !isDemo {
 		_, err = db.Instance.Exec(`DELETE FROM workbench_projects_needing_review WHERE "ProjectID"=$1`, projectID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		team := models.Team{}
 		err = db.DBMap.SelectOne(&team, `
@@ -260,12 +416,12 @@ func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDe
 		WHERE p."ID"=$1
 	`, projectID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		_, err = db.Instance.Exec(`INSERT INTO published_workbench_projects ("ProjectID", "TeamID") VALUES ($1, $2)`, projectID, team.ID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -277,5 +433,177 @@ func initiateCompiler(projectID uuid.UUID, publishID string, version int64, isDe
 		fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "pubtime"),
 		[]byte(fmt.Sprintf("%v", time.Now().UnixNano()))).Exec(redis.Instance)
 
+	if contentHash == previousHash {
+		fmt.Println("Republish of", publishID, "changed nothing, content hash", contentHash)
+	}
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "content_hash", []byte(contentHash)).Exec(redis.Instance)
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), fmt.Sprintf("content_hash:%v", version), []byte(contentHash)).Exec(redis.Instance)
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "optimizer_saved_bytes", []byte(fmt.Sprintf("%v", optimizeStats.Bytes()))).Exec(redis.Instance)
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "optimizer_saved_keys", []byte(fmt.Sprintf("%v", optimizeStats.Keys()))).Exec(redis.Instance)
+
+	fmt.Println("Deduplicated", bundleStore)
+	references, unique, referencedBytes, uniqueBytes := bundleStore.Stats()
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "bundles_referenced", []byte(fmt.Sprintf("%v", references))).Exec(redis.Instance)
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "bundles_stored", []byte(fmt.Sprintf("%v", unique))).Exec(redis.Instance)
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "bundles_referenced_bytes", []byte(fmt.Sprintf("%v", referencedBytes))).Exec(redis.Instance)
+	common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), "bundles_stored_bytes", []byte(fmt.Sprintf("%v", uniqueBytes))).Exec(redis.Instance)
+	for idx, store := range localeBundles {
+		locale := localized[idx+1].locale
+		fmt.Println("Deduplicated in", locale, store)
+		_, unique, _, uniqueBytes := store.Stats()
+		common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), fmt.Sprintf("bundles_stored:%v", locale), []byte(fmt.Sprintf("%v", unique))).Exec(redis.Instance)
+		common.RedisHSET(models.KeynavProjectMetadataStatic(publishID), fmt.Sprintf("bundles_stored_bytes:%v", locale), []byte(fmt.Sprintf("%v", uniqueBytes))).Exec(redis.Instance)
+	}
+
+	return diagnostics, nil
+}
+
+// verifyPublish re-reads every key written by a publish, and checks that
+// each compiled blob decodes and that every action bundle it refers to was stored
+// Triggers are stored within hashes, so each field of a hash is checked as well.
+// The keys of the compiled dialog nodes, triggers and variable defaults must hold blobs, so they are never skipped.
+func verifyPublish(publishID string, items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem) error {
+	blobs := map[string][]byte{}
+	keys := redis.Instance.SMembers(fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "keys")).Val()
+	for _, key := range keys {
+		switch redis.Instance.Type(key).Val() {
+		case "string":
+			b, err := redis.Instance.Get(key).Bytes()
+			if err != nil {
+				return err
+			}
+			blobs[key] = b
+		case "hash":
+			fields, err := redis.Instance.HGetAll(key).Result()
+			if err != nil {
+				return err
+			}
+			for field, value := range fields {
+				blobs[fmt.Sprintf("%v %v", key, field)] = []byte(value)
+			}
+		}
+	}
+
+	kinds := map[string]blob.Kind{
+		fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "variable_defaults"): blob.KindActionBundle,
+	}
+	for _, item := range items {
+		kinds[models.KeynavCompiledEntity(publishID, models.AEIDDialogNode, item.DialogID.String())] = blob.KindDialogNode
+	}
+	for _, trigger := range triggers {
+		kinds[fmt.Sprintf("%v %v", models.KeynavCompiledTriggersWithinZone(publishID, trigger.ZoneID.String()), trigger.TriggerType)] = blob.KindTrigger
+	}
+
+	problems := decompile.Verify(blobs, kinds)
+	for _, problem := range problems {
+		fmt.Println("Verification:", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("verification found %v problems within the compiled data of %v", len(problems), publishID)
+	}
+	return nil
+}
+
+// prepareVariables resolves the variable names of a project to their IDs,
+// returning the registry of every name, including those declared
+// The registry is kept in Redis under the project, rather than the publish, so that a name
+// keeps its ID across every publish and demo. New names are only stored when store is set,
+// otherwise they are given IDs for this preparation alone.
+func prepareVariables(projectID uuid.UUID, items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, declared []string, store bool) (prepare.Variables, error) {
+	vars, err := getVariables(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if store {
+		names, err := prepare.VariableNames(items, triggers)
+		if err != nil {
+			return nil, &helpers.CompileError{Entity: "variables", Err: err}
+		}
+		added := []string{}
+		for _, name := range append(names, declared...) {
+			if _, ok := vars[name]; !ok {
+				// Marked until registered, as a declared name may be used as well
+				vars[name] = 0
+				added = append(added, name)
+			}
+		}
+		if len(added) > 0 {
+			sort.Strings(added)
+			fmt.Println("New variables:", strings.Join(added, ", "))
+			if err := registerVariables(projectID, added); err != nil {
+				return nil, err
+			}
+			// Another publish may have registered some of the names first, with IDs of its own
+			if vars, err = getVariables(projectID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	added := vars.Add(declared)
+	used, err := prepare.PrepareVariables(items, triggers, vars)
+	if err != nil {
+		return nil, &helpers.CompileError{Entity: "variables", Err: err}
+	}
+	added = append(added, used...)
+	if len(added) > 0 && !store {
+		fmt.Println("New variables:", strings.Join(added, ", "))
+	}
+	return vars, nil
+}
+
+// getVariables reads the variable registry of a project
+func getVariables(projectID uuid.UUID) (prepare.Variables, error) {
+	stored, err := redis.Instance.HGetAll(variablesKey(projectID, "variables")).Result()
+	if err != nil {
+		return nil, err
+	}
+	vars := prepare.Variables{}
+	for name, id := range stored {
+		vars[name], err = strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID %q stored for variable %v", id, name)
+		}
+	}
+	return vars, nil
+}
+
+// registerVariables gives each of the names an ID within the variable registry of a project
+// Publishes of the same project may run at once, so each ID is taken from a counter which
+// only ever increments, and a name keeps whichever ID was registered for it first.
+// Both directions are stored, so the runtime can name the variables it reports on.
+func registerVariables(projectID uuid.UUID, names []string) error {
+	counterKey := variablesKey(projectID, "variable_counter")
+	namesKey := variablesKey(projectID, "variable_names")
+	for _, name := range names {
+		for {
+			n, err := redis.Instance.Incr(counterKey).Result()
+			if err != nil {
+				return err
+			}
+			id := fmt.Sprintf("%v", prepare.FirstVariableID+uint64(n)-1)
+			// Registries from before the counter may already hold the ID
+			claimed, err := redis.Instance.HSetNX(namesKey, id, name).Result()
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
+			registered, err := redis.Instance.HSetNX(variablesKey(projectID, "variables"), name, id).Result()
+			if err != nil {
+				return err
+			}
+			if !registered {
+				redis.Instance.HDel(namesKey, id)
+			}
+			break
+		}
+	}
 	return nil
 }
+
+func variablesKey(projectID uuid.UUID, field string) string {
+	return fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(projectID.String()), field)
+}
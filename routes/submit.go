@@ -7,7 +7,9 @@ import (
 
 	"github.com/talkative-ai/core/common"
 	"github.com/talkative-ai/core/db"
+	"github.com/talkative-ai/lakshmi/analyze"
 	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
 
 	"github.com/gorilla/mux"
 	"github.com/talkative-ai/core/models"
@@ -107,4 +109,50 @@ func postSubmitHandler(w http.ResponseWriter, r *http.Request) {
 	common.RedisSET(
 		fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(projectID.String()), "status"),
 		[]byte(fmt.Sprintf("%v", models.PublishStatusUnderReview))).Exec(redis.Instance)
+
+	// Let the author know of likely mistakes while the project awaits review
+	// The submit has already succeeded, so when they can't be found it still responds as it did without them
+	diagnostics, err := submitDiagnostics(projectID, currentVersion)
+	if err != nil {
+		fmt.Println("Could not find the diagnostics of the submitted project", projectID, err)
+		return
+	}
+	respondDiagnostics(w, diagnostics)
+}
+
+// submitDiagnostics finds the likely mistakes of a submitted version of a project, in each of its locales
+// Problems which would fail the publish are diagnostics too, so an error means they couldn't be found at all.
+func submitDiagnostics(projectID uuid.UUID, version int64) ([]analyze.Diagnostic, error) {
+	project, err := helpers.GetVersionedProject(projectID, version)
+	if err != nil {
+		return nil, err
+	}
+	locales, err := getLocales(projectID)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics := []analyze.Diagnostic{}
+	defaultItems := project.ProjectData
+	for _, locale := range locales {
+		items, triggers, err := prepare.Localize(project.ProjectData, project.TriggerData, locales, locale)
+		if err != nil {
+			err = &helpers.CompileError{Entity: "locales", Err: err}
+			return []analyze.Diagnostic{{Message: err.Error()}}, nil
+		}
+		if locale == locales[0] {
+			defaultItems = items
+		}
+		_, err = prepareLogic(projectID, items, triggers, false)
+		// Type errors will fail the publish, so the author hears of them now,
+		// though only once for the locale in which they are first found
+		if typeErr, ok := err.(*analyze.TypeError); ok {
+			diagnostics = append(diagnostics, typeErr.Diagnostics...)
+			break
+		}
+		if err != nil {
+			return []analyze.Diagnostic{{Message: inLocale(err, locales, locale).Error()}}, nil
+		}
+	}
+	diagnostics = append(diagnostics, analyze.Project(defaultItems)...)
+	return append(diagnostics, analyze.Translations(project.ProjectData, project.TriggerData, locales)...), nil
 }
@@ -0,0 +1,290 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/talkative-ai/core/db"
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/core/myerrors"
+	"github.com/talkative-ai/core/prehandle"
+	"github.com/talkative-ai/core/redis"
+	"github.com/talkative-ai/core/router"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/export"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// maxTranslationsBytes is the largest translations file which may be imported
+const maxTranslationsBytes = 16 << 20
+
+// GetTranslations router.Route
+// Path: "/v1/translations/{id}/{locale}",
+// Method: "GET",
+// Accepts ?format=xliff (the default) or ?format=csv, and ?version= to choose the submitted version
+// Responds with every translatable string of the latest submitted version of the project,
+// along with its translations into the locale so far
+var GetTranslations = &router.Route{
+	Path:    "/v1/translations/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/{locale}",
+	Method:  "GET",
+	Handler: http.HandlerFunc(getTranslationsHandler),
+}
+
+// PutTranslations router.Route
+// Path: "/v1/translations/{id}/{locale}",
+// Method: "PUT",
+// Accepts translations into the locale as XLIFF 2.0, or as CSV with ?format=csv
+// Applies them to the dialogs and triggers of the project in the workbench,
+// unless any are stale or unknown, and responds with the export.Report
+var PutTranslations = &router.Route{
+	Path:       "/v1/translations/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/{locale}",
+	Method:     "PUT",
+	Handler:    http.HandlerFunc(putTranslationsHandler),
+	Prehandler: []prehandle.Prehandler{prehandle.SetJSON},
+}
+
+func getTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	urlparams := mux.Vars(r)
+	projectID, err := uuid.FromString(urlparams["id"])
+	if err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Message: "bad_id",
+			Req:     r,
+		})
+		return
+	}
+	locale := urlparams["locale"]
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "xliff" && format != "csv" {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Req:     r,
+			Message: "Unknown format, expected xliff or csv",
+		})
+		return
+	}
+
+	locales, err := getLocales(projectID)
+	if err != nil {
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	if err := export.CheckLocale(locales, locale); err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Req:     r,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	var version int64
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err = strconv.ParseInt(v, 10, 64)
+	} else {
+		version, err = redis.Instance.HGet(models.KeynavProjectMetadataStatic(projectID.String()), "version").Int64()
+	}
+	if err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusNotFound,
+			Log:     err.Error(),
+			Req:     r,
+			Message: "The project has no such submitted version",
+		})
+		return
+	}
+	project, err := helpers.GetVersionedProject(projectID, version)
+	if err == sql.ErrNoRows {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusNotFound,
+			Req:     r,
+			Message: "The project has no such submitted version",
+		})
+		return
+	}
+	if err != nil {
+		myerrors.ServerError(w, r, err)
+		return
+	}
+
+	units, err := export.Units(project.ProjectData, project.TriggerData, locales, locale)
+	if err != nil {
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	var b []byte
+	filename := fmt.Sprintf("%v.%v", projectID.String(), locale)
+	if format == "csv" {
+		b, err = export.CSV(units)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		filename += ".csv"
+	} else {
+		b, err = export.XLIFF(units, projectID.String(), locales[0], locale)
+		w.Header().Set("Content-Type", "application/xliff+xml")
+		filename += ".xlf"
+	}
+	if err != nil {
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(b)
+}
+
+func putTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	urlparams := mux.Vars(r)
+	projectID, err := uuid.FromString(urlparams["id"])
+	if err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Message: "bad_id",
+			Req:     r,
+		})
+		return
+	}
+	locale := urlparams["locale"]
+
+	locales, err := getLocales(projectID)
+	if err != nil {
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	if err := export.CheckLocale(locales, locale); err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Req:     r,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxTranslationsBytes))
+	if err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Log:     err.Error(),
+			Req:     r,
+			Message: "Invalid translations",
+		})
+		return
+	}
+	var units []export.Unit
+	switch r.URL.Query().Get("format") {
+	case "", "xliff":
+		var targetLocale string
+		targetLocale, units, err = export.ReadXLIFF(data)
+		if err == nil && targetLocale != "" && targetLocale != locale {
+			err = fmt.Errorf("the translations are into %v, not %v", targetLocale, locale)
+		}
+	case "csv":
+		units, err = export.ReadCSV(data)
+	default:
+		err = fmt.Errorf("unknown format, expected xliff or csv")
+	}
+	if err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Log:     err.Error(),
+			Req:     r,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// The project is read and written within one transaction, holding its rows,
+	// so that an edit or import made meanwhile is never overwritten
+	tx, err := db.Instance.Begin()
+	if err != nil {
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	project, err := helpers.LockWorkbenchProject(tx, projectID)
+	if err != nil {
+		tx.Rollback()
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	report, err := export.Import(project.ProjectData, project.TriggerData, locales, locale, units)
+	if err != nil {
+		tx.Rollback()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	if err := saveTranslations(tx, project, report); err != nil {
+		tx.Rollback()
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		myerrors.ServerError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// saveTranslations writes the dialog nodes and triggers changed by an import back to the workbench within tx
+func saveTranslations(tx *sql.Tx, project helpers.Project, report export.Report) error {
+	saved := map[uuid.UUID]bool{}
+	for _, id := range report.Dialogs {
+		saved[id] = false
+	}
+	for _, item := range project.ProjectData {
+		if done, ok := saved[item.DialogID]; !ok || done {
+			continue
+		}
+		saved[item.DialogID] = true
+		entry, alwaysExec, statements, err := marshalTranslated(item.DialogEntry, item.RawLBlock)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE workbench_dialog_nodes
+			SET "EntryInput"=$2, "AlwaysExec"=$3, "Statements"=$4
+			WHERE "ID"=$1
+		`, item.DialogID, entry, alwaysExec, statements)
+		if err != nil {
+			return err
+		}
+	}
+	for _, idx := range report.Triggers {
+		trigger := project.TriggerData[idx]
+		_, alwaysExec, statements, err := marshalTranslated(nil, trigger.RawLBlock)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE workbench_triggers
+			SET "AlwaysExec"=$3, "Statements"=$4
+			WHERE "ZoneID"=$1 AND "TriggerType"=$2
+		`, trigger.ZoneID, trigger.TriggerType, alwaysExec, statements)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalTranslated returns the JSON of the columns which an import may change
+func marshalTranslated(entry []string, block prepare.RawLBlock) (string, string, string, error) {
+	e, err := json.Marshal(entry)
+	if err != nil {
+		return "", "", "", err
+	}
+	alwaysExec, err := json.Marshal(block.AlwaysExec)
+	if err != nil {
+		return "", "", "", err
+	}
+	statements, err := json.Marshal(block.Statements)
+	if err != nil {
+		return "", "", "", err
+	}
+	return string(e), string(alwaysExec), string(statements), nil
+}
@@ -0,0 +1,173 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/talkative-ai/core/common"
+	"github.com/talkative-ai/core/models"
+	"github.com/talkative-ai/core/myerrors"
+	"github.com/talkative-ai/core/prehandle"
+	"github.com/talkative-ai/core/redis"
+	"github.com/talkative-ai/core/router"
+	uuid "github.com/talkative-ai/go.uuid"
+	"github.com/talkative-ai/lakshmi/analyze"
+	"github.com/talkative-ai/lakshmi/helpers"
+	"github.com/talkative-ai/lakshmi/prepare"
+)
+
+// PutVariables router.Route
+// Path: "/v1/variables/{id}",
+// Method: "PUT",
+// Accepts a map of variable names to their analyze.Declaration
+// Replaces the variable declarations of the project
+var PutVariables = &router.Route{
+	Path:       "/v1/variables/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}",
+	Method:     "PUT",
+	Handler:    http.HandlerFunc(putVariablesHandler),
+	Prehandler: []prehandle.Prehandler{prehandle.SetJSON},
+}
+
+func putVariablesHandler(w http.ResponseWriter, r *http.Request) {
+	urlparams := mux.Vars(r)
+	projectID, err := uuid.FromString(urlparams["id"])
+	if err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Message: "bad_id",
+			Req:     r,
+		})
+		return
+	}
+
+	declarations := map[string]analyze.Declaration{}
+	if err := json.NewDecoder(r.Body).Decode(&declarations); err != nil {
+		myerrors.Respond(w, &myerrors.MySimpleError{
+			Code:    http.StatusBadRequest,
+			Log:     err.Error(),
+			Req:     r,
+			Message: "Invalid declarations",
+		})
+		return
+	}
+	for name, declaration := range declarations {
+		err := declaration.Check()
+		if !prepare.IsVariableName(name) {
+			err = fmt.Errorf("invalid variable name")
+		}
+		if err != nil {
+			myerrors.Respond(w, &myerrors.MySimpleError{
+				Code:    http.StatusBadRequest,
+				Log:     err.Error(),
+				Req:     r,
+				Message: fmt.Sprintf("%v: %v", name, err),
+			})
+			return
+		}
+	}
+
+	key := declarationsKey(projectID)
+	redis.Instance.Del(key)
+	for name, declaration := range declarations {
+		b, _ := json.Marshal(declaration)
+		common.RedisHSET(key, name, b).Exec(redis.Instance)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// declarationsKey is the Redis hash of the declarations of a project, mapping each name to its JSON
+// Like the variable registry, it belongs to the project rather than any one publish.
+func declarationsKey(projectID uuid.UUID) string {
+	return fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(projectID.String()), "variable_declarations")
+}
+
+// getDeclarations loads the declarations of a project by variable name
+func getDeclarations(projectID uuid.UUID) (map[string]analyze.Declaration, error) {
+	stored, err := redis.Instance.HGetAll(declarationsKey(projectID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	declarations := map[string]analyze.Declaration{}
+	for name, b := range stored {
+		declaration := analyze.Declaration{}
+		if err := json.Unmarshal([]byte(b), &declaration); err != nil {
+			return nil, fmt.Errorf("invalid declaration stored for variable %v: %v", name, err)
+		}
+		declarations[name] = declaration
+	}
+	return declarations, nil
+}
+
+// prepareLogic runs the phases of preparation which concern variables over localized dialogs and triggers:
+// variants, whose text may use variables, the variable IDs, templates, and the type check,
+// which fails with an *analyze.TypeError. It returns the declarations of the variables.
+// New variable names are only stored when store is set.
+func prepareLogic(projectID uuid.UUID, items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, store bool) (map[uint64]analyze.Declaration, error) {
+	if err := prepare.PrepareVariants(items, triggers); err != nil {
+		return nil, &helpers.CompileError{Entity: "variants", Err: err}
+	}
+	named, err := getDeclarations(projectID)
+	if err != nil {
+		return nil, err
+	}
+	// Declared variables are given IDs even when only templates use them, see prepare.PrepareTemplates
+	declared := []string{}
+	for name := range named {
+		declared = append(declared, name)
+	}
+	vars, err := prepareVariables(projectID, items, triggers, declared, store)
+	if err != nil {
+		return nil, err
+	}
+	declarations := map[uint64]analyze.Declaration{}
+	for name, declaration := range named {
+		declarations[vars[name]] = declaration
+	}
+	if err := prepareTemplates(items, triggers, vars, declarations); err != nil {
+		return nil, err
+	}
+	if typeDiagnostics := analyze.Types(items, triggers, declarations, vars.Names()); len(typeDiagnostics) > 0 {
+		return nil, &analyze.TypeError{Diagnostics: typeDiagnostics}
+	}
+	return declarations, nil
+}
+
+// prepareTemplates compiles the templates of a project, whose variables must be declared or set by an action
+func prepareTemplates(items []prepare.ProjectItem, triggers []prepare.ProjectTriggerItem, vars prepare.Variables, declarations map[uint64]analyze.Declaration) error {
+	declared := map[uint64]bool{}
+	for id := range declarations {
+		declared[id] = true
+	}
+	if err := prepare.PrepareTemplates(items, triggers, vars, declared); err != nil {
+		return &helpers.CompileError{Entity: "templates", Err: err}
+	}
+	return nil
+}
+
+// compileDefaults stores the defaults of the declared variables as an action bundle
+// of set actions, which the runtime runs before anything else in a new session
+func compileDefaults(redisWriter chan common.RedisCommand, publishID string, declarations map[uint64]analyze.Declaration) {
+	set := prepare.ActionSet{}
+	for _, id := range sortedIDs(declarations) {
+		if declarations[id].Default == nil {
+			continue
+		}
+		set.Actions = append(set.Actions, prepare.RAVariable{Operation: prepare.VariableSet, ID: id, Value: declarations[id].Default})
+	}
+	if len(set.Actions) == 0 {
+		return
+	}
+	redisWriter <- common.RedisSET(fmt.Sprintf("%v:%v", models.KeynavProjectMetadataStatic(publishID), "variable_defaults"), prepare.BundleActions(set))
+}
+
+func sortedIDs(declarations map[uint64]analyze.Declaration) []uint64 {
+	ids := make([]uint64, 0, len(declarations))
+	for id := range declarations {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}